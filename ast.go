@@ -0,0 +1,212 @@
+package renekton
+
+/*
+语法树. 每个节点记录它在输入中的位置, 语义检查出错时同样可以指出位置
+*/
+
+type Stmt interface {
+	stmtNode()
+}
+
+type Expr interface {
+	exprNode()
+	Position() int
+}
+
+// INSERT INTO table [(column, ...)] VALUES (expr, ...)
+type InsertStmt struct {
+	Table   *Identifier
+	Columns []*Identifier // 为空表示按表定义的顺序
+	Values  []Expr
+}
+
+// SELECT * | column, ... FROM table [WHERE expr]
+type SelectStmt struct {
+	Columns []*Identifier // 为空表示*
+	Table   *Identifier
+	Where   Expr
+}
+
+// UPDATE table SET column = expr, ... [WHERE expr]
+type UpdateStmt struct {
+	Table       *Identifier
+	Assignments []*Assignment
+	Where       Expr
+}
+
+type Assignment struct {
+	Column *Identifier
+	Value  Expr
+}
+
+// DELETE FROM table [WHERE expr]
+type DeleteStmt struct {
+	Table *Identifier
+	Where Expr
+}
+
+// CREATE TABLE name (column type [(size)] [NOT NULL] [PRIMARY KEY] [AUTOINCREMENT] [UNIQUE], ... [, PRIMARY KEY (column, ...)])
+type CreateTableStmt struct {
+	Name       *Identifier
+	Columns    []*ColumnDef
+	PrimaryKey []*Identifier // 表级的PRIMARY KEY约束, 可以包含多列
+	SQL        string        // 语句原文, 保存在catalog中, 打开数据库时重新解析
+}
+
+type ColumnDef struct {
+	Name          *Identifier
+	Type          *Identifier // 类型名不是关键字, 在语义检查时识别
+	Size          *IntegerLiteral
+	NotNull       bool
+	PrimaryKey    bool
+	Autoincrement bool
+	Unique        bool
+}
+
+// CREATE [UNIQUE] INDEX name ON table (column)
+type CreateIndexStmt struct {
+	Name   *Identifier
+	Table  *Identifier
+	Column *Identifier
+	Unique bool
+	SQL    string // 语句原文, 保存在catalog中
+}
+
+// DROP INDEX name
+type DropIndexStmt struct {
+	Name *Identifier
+}
+
+type BeginStmt struct{}
+type CommitStmt struct{}
+
+// ROLLBACK [TRANSACTION] [TO [SAVEPOINT] name], Savepoint为nil时回滚整个事务
+type RollbackStmt struct {
+	Savepoint *Identifier
+}
+
+type SavepointStmt struct {
+	Name *Identifier
+}
+
+type ReleaseStmt struct {
+	Name *Identifier
+}
+
+func (*InsertStmt) stmtNode()      {}
+func (*SelectStmt) stmtNode()      {}
+func (*UpdateStmt) stmtNode()      {}
+func (*DeleteStmt) stmtNode()      {}
+func (*CreateTableStmt) stmtNode() {}
+func (*CreateIndexStmt) stmtNode() {}
+func (*DropIndexStmt) stmtNode()   {}
+func (*BeginStmt) stmtNode()       {}
+func (*CommitStmt) stmtNode()      {}
+func (*RollbackStmt) stmtNode()    {}
+func (*SavepointStmt) stmtNode()   {}
+func (*ReleaseStmt) stmtNode()     {}
+
+// 表名, 列名, savepoint名
+type Identifier struct {
+	Name string
+	Pos  int
+}
+
+// 表达式中的列
+type ColumnRef struct {
+	Name string
+	Pos  int
+}
+
+type IntegerLiteral struct {
+	Value int64
+	Pos   int
+}
+
+type RealLiteral struct {
+	Value float64
+	Pos   int
+}
+
+type StringLiteral struct {
+	Value string
+	Pos   int
+}
+
+// X'...'
+type BlobLiteral struct {
+	Value []byte
+	Pos   int
+}
+
+type NullLiteral struct {
+	Pos int
+}
+
+// ?, Th从0开始按出现的顺序编号
+type Placeholder struct {
+	Th  int
+	Pos int
+}
+
+// 一元运算: NOT, -
+type UnaryExpr struct {
+	Op      string
+	Operand Expr
+	Pos     int
+}
+
+// 二元运算: 比较运算, LIKE, AND, OR
+type BinaryExpr struct {
+	Op    string
+	Left  Expr
+	Right Expr
+	Pos   int // 运算符的位置
+}
+
+// operand IS NULL. IS NOT NULL解析为NOT (operand IS NULL)
+type IsNullExpr struct {
+	Operand Expr
+	Pos     int // IS的位置
+}
+
+// operand BETWEEN low AND high
+type BetweenExpr struct {
+	Operand Expr
+	Low     Expr
+	High    Expr
+	Pos     int // BETWEEN的位置
+}
+
+// operand IN (value, ...)
+type InExpr struct {
+	Operand Expr
+	Values  []Expr
+	Pos     int // IN的位置
+}
+
+func (*ColumnRef) exprNode()      {}
+func (*IntegerLiteral) exprNode() {}
+func (*RealLiteral) exprNode()    {}
+func (*StringLiteral) exprNode()  {}
+func (*BlobLiteral) exprNode()    {}
+func (*NullLiteral) exprNode()    {}
+func (*Placeholder) exprNode()    {}
+func (*UnaryExpr) exprNode()      {}
+func (*BinaryExpr) exprNode()     {}
+func (*IsNullExpr) exprNode()     {}
+func (*BetweenExpr) exprNode()    {}
+func (*InExpr) exprNode()         {}
+
+func (e *ColumnRef) Position() int      { return e.Pos }
+func (e *IntegerLiteral) Position() int { return e.Pos }
+func (e *RealLiteral) Position() int    { return e.Pos }
+func (e *StringLiteral) Position() int  { return e.Pos }
+func (e *BlobLiteral) Position() int    { return e.Pos }
+func (e *NullLiteral) Position() int    { return e.Pos }
+func (e *Placeholder) Position() int    { return e.Pos }
+func (e *UnaryExpr) Position() int      { return e.Pos }
+func (e *BinaryExpr) Position() int     { return e.Left.Position() }
+func (e *IsNullExpr) Position() int     { return e.Operand.Position() }
+func (e *BetweenExpr) Position() int    { return e.Operand.Position() }
+func (e *InExpr) Position() int         { return e.Operand.Position() }
@@ -0,0 +1,82 @@
+package renekton
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// 没有给出INTEGER主键时分配主键: 普通的表用最大的主键加1, AUTOINCREMENT的表不会重复使用删除过的主键
+func TestAutoincrement(t *testing.T) {
+	db, path := testOpen(t, JOURNAL_MODE_ROLLBACK, 10)
+	for _, sql := range []string{
+		"create table plain (id integer primary key, v text)",
+		"create table auto (id integer primary key autoincrement, v text)",
+	} {
+		if _, err := db.Exec(sql); err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+	}
+	exec := func(sql string, args ...any) {
+		t.Helper()
+		if _, err := db.Exec(sql, args...); err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+	}
+	checkIds := func(table string, want ...int64) {
+		t.Helper()
+		if got := queryIds(t, db, "select id from "+table); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: ids %v, want %v", table, got, want)
+		}
+	}
+
+	for _, table := range []string{"plain", "auto"} {
+		for i := 0; i < 3; i++ {
+			exec("insert into " + table + " (v) values ('x')")
+		}
+		exec("insert into " + table + " values (10, 'x')")
+		exec("insert into " + table + " (v) values ('x')")
+		checkIds(table, 1, 2, 3, 10, 11)
+		exec("delete from " + table + " where id = 11")
+		exec("delete from " + table + " where id = 10")
+	}
+	check(t, db.Close())
+	db = testReopen(t, path, JOURNAL_MODE_ROLLBACK)
+	defer func() { db.Close() }()
+
+	// 删除了最大的主键之后, 普通的表重新使用, AUTOINCREMENT的表从已经分配过的最大值继续
+	exec("insert into plain (v) values ('x')")
+	exec("insert into auto (v) values ('x')")
+	checkIds("plain", 1, 2, 3, 4)
+	checkIds("auto", 1, 2, 3, 12)
+
+	// 回滚的插入不会推进AUTOINCREMENT的序列
+	check(t, db.Begin())
+	exec("insert into auto (v) values ('x')")
+	check(t, db.Rollback())
+	exec("insert into auto (v) values ('x')")
+	checkIds("auto", 1, 2, 3, 12, 13)
+
+	// 最大的主键已经是MaxInt64时不能再分配
+	for _, table := range []string{"plain", "auto"} {
+		exec("insert into "+table+" values (?, 'x')", int64(math.MaxInt64))
+		if _, err := db.Exec("insert into " + table + " (v) values ('x')"); !errors.Is(err, ErrTableFull) {
+			t.Fatalf("%s: insert after MaxInt64: %v", table, err)
+		}
+		exec("delete from "+table+" where id = ?", int64(math.MaxInt64))
+	}
+	exec("insert into plain (v) values ('x')")
+	checkIds("plain", 1, 2, 3, 4, 5)
+	if _, err := db.Exec("insert into auto (v) values ('x')"); !errors.Is(err, ErrTableFull) {
+		t.Fatalf("auto: insert after deleting MaxInt64: %v", err)
+	}
+	checkIds("auto", 1, 2, 3, 12, 13)
+
+	// 记录AUTOINCREMENT序列的内部表不出现在Tables中
+	tables, err := db.Tables()
+	check(t, err)
+	if want := []string{"users", "plain", "auto"}; !reflect.DeepEqual(tables, want) {
+		t.Fatalf("tables %v, want %v", tables, want)
+	}
+}
@@ -0,0 +1,560 @@
+package renekton
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// 两种日志模式都需要测试
+var testJournalModes = []struct {
+	name string
+	mode JournalMode
+}{{"wal", JOURNAL_MODE_WAL}, {"rollback", JOURNAL_MODE_ROLLBACK}}
+
+const TEST_TABLE_SQL = "CREATE TABLE users (id INTEGER PRIMARY KEY, username TEXT(32), email TEXT)"
+
+// 在临时目录中创建数据库和users表, cacheSize为0时使用默认值. 返回数据库文件的路径用于重新打开
+func testOpen(t *testing.T, mode JournalMode, cacheSize uint32) (*DB, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, &Options{JournalMode: mode, CacheSize: cacheSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(TEST_TABLE_SQL); err != nil {
+		t.Fatal(err)
+	}
+	return db, path
+}
+
+func testReopen(t *testing.T, path string, mode JournalMode) *DB {
+	t.Helper()
+	db, err := Open(path, &Options{JournalMode: mode})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 每行几百字节, 一个叶子节点只能放下几行
+func testEmail(id uint32) string {
+	return fmt.Sprintf("user%d@%s.com", id, strings.Repeat("example", 80))
+}
+
+// users表中的一行
+func testRow(id uint32) []any {
+	return []any{int64(id), fmt.Sprint("user", id), testEmail(id)}
+}
+
+// 插入testRow(id)并记录到model(id -> email)中
+func testInsert(t *testing.T, db *DB, model map[uint32]string, id uint32) {
+	t.Helper()
+	if err := db.Insert("users", testRow(id)...); err != nil {
+		t.Fatalf("insert %d: %v", id, err)
+	}
+	model[id] = testEmail(id)
+}
+
+func testUpdate(t *testing.T, db *DB, model map[uint32]string, id uint32, email string) {
+	t.Helper()
+	if err := db.Update("users", map[string]any{"email": email}, int64(id)); err != nil {
+		t.Fatalf("update %d: %v", id, err)
+	}
+	model[id] = email
+}
+
+func testDelete(t *testing.T, db *DB, model map[uint32]string, id uint32) {
+	t.Helper()
+	if err := db.Delete("users", int64(id)); err != nil {
+		t.Fatalf("delete %d: %v", id, err)
+	}
+	delete(model, id)
+}
+
+func testTable(t *testing.T, db *DB, name string) *Table {
+	t.Helper()
+	if err := catalogLoad(db.database); err != nil {
+		t.Fatal(err)
+	}
+	table := catalogFindTable(db.database, name)
+	if table == nil {
+		t.Fatalf("no table %s", name)
+	}
+	return table
+}
+
+// 检查B+树的结构: 根节点标记, 父节点指针, 所有叶子节点的深度相同, 节点内的key有序,
+// 内部节点的key等于对应子树的最大key, 叶子节点链表按顺序连接所有叶子节点.
+// 返回按顺序的全部key和叶子节点的深度
+func checkBtree(t *testing.T, table *Table) ([][]byte, int) {
+	t.Helper()
+	leafDepth := -1
+	var leaves []uint32
+	var walk func(pageTh, parent uint32, depth int) []byte
+	walk = func(pageTh, parent uint32, depth int) []byte {
+		node, err := getNode(table.Pager, pageTh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		isRoot := pageTh == table.rootPageCTh
+		if isNodeRoot(node) != isRoot {
+			t.Fatalf("page %d: root flag %v", pageTh, isNodeRoot(node))
+		}
+		if !isRoot && node.LeafNodeGetParent() != parent {
+			t.Fatalf("page %d: parent %d, want %d", pageTh, node.LeafNodeGetParent(), parent)
+		}
+		if getNodeType(node) == NODE_LEAF {
+			if leafDepth >= 0 && depth != leafDepth {
+				t.Fatalf("page %d: leaf depth %d, want %d", pageTh, depth, leafDepth)
+			}
+			leafDepth = depth
+			leaves = append(leaves, pageTh)
+			count := node.LeafNodeGetCellsCount()
+			if count == 0 {
+				if !isRoot {
+					t.Fatalf("page %d: empty leaf", pageTh)
+				}
+				return nil
+			}
+			for i := uint32(1); i < count; i++ {
+				if bytes.Compare(node.LeafNodeGetKey(i-1), node.LeafNodeGetKey(i)) >= 0 {
+					t.Fatalf("page %d: key %d out of order", pageTh, i)
+				}
+			}
+			return append([]byte{}, node.LeafNodeGetKey(count-1)...)
+		}
+		if err := node.internalNodeCheckCells(); err != nil {
+			t.Fatal(err)
+		}
+		children, keys := node.internalNodeEntries()
+		var last []byte
+		for i, child := range children {
+			maxKey := walk(child, pageTh, depth+1)
+			if last != nil && bytes.Compare(maxKey, last) <= 0 {
+				t.Fatalf("page %d: child %d out of order", pageTh, i)
+			}
+			if i < len(keys) && !bytes.Equal(maxKey, keys[i]) {
+				t.Fatalf("page %d: key %d is %x, child max key is %x", pageTh, i, keys[i], maxKey)
+			}
+			last = maxKey
+		}
+		return last
+	}
+	walk(table.rootPageCTh, 0, 0)
+
+	var keys [][]byte
+	for i, pageTh := range leaves {
+		node, err := getNode(table.Pager, pageTh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		next := uint32(0)
+		if i+1 < len(leaves) {
+			next = leaves[i+1]
+		}
+		if node.LeafNodeGetNextLeaf() != next {
+			t.Fatalf("page %d: next leaf %d, want %d", pageTh, node.LeafNodeGetNextLeaf(), next)
+		}
+		for j := uint32(0); j < node.LeafNodeGetCellsCount(); j++ {
+			keys = append(keys, append([]byte{}, node.LeafNodeGetKey(j)...))
+		}
+	}
+	return keys, leafDepth
+}
+
+// 树的结构正确, 树中的key与model中的key相同, 按主键顺序遍历读到的行与model相同. 返回叶子节点的深度
+func checkRows(t *testing.T, db *DB, model map[uint32]string) int {
+	t.Helper()
+	keys, depth := checkBtree(t, testTable(t, db, "users"))
+	want := make([]uint32, 0, len(model))
+	for id := range model {
+		want = append(want, id)
+	}
+	sort.Slice(want, func(i, j int) bool { return want[i] < want[j] })
+	if len(keys) != len(want) {
+		t.Fatalf("%d keys, want %d", len(keys), len(want))
+	}
+	for i, key := range keys {
+		if !bytes.Equal(key, appendIntegerKey(nil, int64(want[i]))) {
+			t.Fatalf("key %d is %x, want %d", i, key, want[i])
+		}
+	}
+
+	i := 0
+	err := db.Scan("users", func(row *Row) bool {
+		id, email := row.Values[0].(int64), row.Values[2].(string)
+		if i >= len(want) || id != int64(want[i]) {
+			t.Fatalf("row %d has id %d", i, id)
+		}
+		if email != model[uint32(id)] || row.Values[1] != fmt.Sprint("user", id) {
+			t.Fatalf("row %d is %v, want email %q", id, row.Values, model[uint32(id)])
+		}
+		i++
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != len(want) {
+		t.Fatalf("scanned %d rows, want %d", i, len(want))
+	}
+	return depth
+}
+
+// 表上每个索引的key与表中的行一一对应
+func checkIndexes(t *testing.T, table *Table) {
+	t.Helper()
+	var want []string
+	for _, index := range table.indexes {
+		want = want[:0]
+		err := executeSelect(&Statement{SType: STATEMENT_SELECT}, table, func(row *Row) bool {
+			want = append(want, string(indexKey(index, table.schema, row)))
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(want)
+		keys, _ := checkBtree(t, index.btree)
+		if len(keys) != len(want) {
+			t.Fatalf("index %s: %d keys, want %d", index.Name, len(keys), len(want))
+		}
+		for i, key := range keys {
+			if string(key) != want[i] {
+				t.Fatalf("index %s: key %d is %x, want %x", index.Name, i, key, want[i])
+			}
+		}
+	}
+}
+
+// t表和它的索引的结构正确, 表中的行与model(id -> 其他列)相同. 返回表和索引中最大的深度
+func checkTable(t *testing.T, db *DB, model map[uint32][]any) int {
+	t.Helper()
+	table := testTable(t, db, "t")
+	_, depth := checkBtree(t, table)
+	checkIndexes(t, table)
+	for _, index := range table.indexes {
+		_, indexDepth := checkBtree(t, index.btree)
+		depth = max(depth, indexDepth)
+	}
+	count := 0
+	err := db.Scan("t", func(row *Row) bool {
+		id := uint32(row.Values[0].(int64))
+		if want, ok := model[id]; !ok || !reflect.DeepEqual(row.Values[1:], want) {
+			t.Fatalf("row %d is %v, want %v", id, row.Values, want)
+		}
+		count++
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(model) {
+		t.Fatalf("%d rows, want %d", count, len(model))
+	}
+	return depth
+}
+
+// 在t表上建立k列的索引, 索引的key为k的值加上主键
+func testOpenIndexed(t *testing.T, mode JournalMode) (*DB, string) {
+	t.Helper()
+	db, path := testOpen(t, mode, 30)
+	for _, sql := range []string{
+		"create table t (id integer primary key, k text, v text)",
+		"create index t_k on t (k)",
+	} {
+		if _, err := db.Exec(sql); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db, path
+}
+
+// 长度为1到240字节的k, 索引的内部节点中的key长度不同
+func randomIndexKey(rnd *rand.Rand) string {
+	return fmt.Sprintf("%0*d", 1+rnd.Intn(240), rnd.Intn(1000000))
+}
+
+// 长度为0到几百字节的值, 偶尔有需要溢出页面的几千字节的值
+func randomValue(rnd *rand.Rand) string {
+	return strings.Repeat("v", rnd.Intn([]int{40, 400, 5000}[rnd.Intn(3)]))
+}
+
+// 随机顺序插入长度随机的行, 表和索引的树都长到多层, 每次分割之后结构都正确, 重新打开之后不变
+func TestBtreeInsertSplits(t *testing.T) {
+	for _, journal := range testJournalModes {
+		t.Run(journal.name, func(t *testing.T) {
+			db, path := testOpenIndexed(t, journal.mode)
+			rnd := rand.New(rand.NewSource(1))
+			model := map[uint32][]any{}
+			ids := rnd.Perm(100000)[:2000]
+			// 每200行一个事务
+			check(t, db.Begin())
+			for i, id := range ids {
+				values := []any{randomIndexKey(rnd), randomValue(rnd)}
+				if err := db.Insert("t", append([]any{int64(id)}, values...)...); err != nil {
+					t.Fatal(i, err)
+				}
+				model[uint32(id)] = values
+				if i%200 == 199 {
+					check(t, db.Commit())
+					checkTable(t, db, model)
+					check(t, db.Begin())
+				}
+			}
+			check(t, db.Commit())
+			if depth := checkTable(t, db, model); depth < 2 {
+				t.Fatalf("depth %d, internal nodes never split", depth)
+			}
+			if err := db.Insert("t", int64(ids[0]), "k", "v"); !errors.Is(err, ErrDuplicateKey) {
+				t.Fatalf("duplicate insert: %v", err)
+			}
+			db.Close()
+
+			db = testReopen(t, path, journal.mode)
+			defer db.Close()
+			checkTable(t, db, model)
+			for id, values := range model {
+				row, err := db.Get("t", int64(id))
+				if err != nil || !reflect.DeepEqual(row.Values[1:], values) {
+					t.Fatalf("get %d: %v %v", id, row, err)
+				}
+			}
+		})
+	}
+}
+
+// 随机插入, 修改和删除, 删除时叶子节点和内部节点向兄弟节点借或者合并, 修改使行变长或变短时也保持平衡,
+// 最后删除所有行, 树缩回一个空的根节点
+func TestBtreeDeleteMerges(t *testing.T) {
+	for _, journal := range testJournalModes {
+		t.Run(journal.name, func(t *testing.T) {
+			db, _ := testOpenIndexed(t, journal.mode)
+			defer db.Close()
+			rnd := rand.New(rand.NewSource(2))
+			model := map[uint32][]any{}
+			check(t, db.Begin())
+			for op := 0; op < 4000; op++ {
+				id := uint32(rnd.Intn(2000))
+				values := []any{randomIndexKey(rnd), randomValue(rnd)}
+				_, exists := model[id]
+				switch {
+				case rnd.Intn(3) == 0:
+					err := db.Delete("t", int64(id))
+					if exists && err != nil || !exists && !errors.Is(err, ErrKeyNotFound) {
+						t.Fatalf("op %d: delete %d: %v", op, id, err)
+					}
+					delete(model, id)
+				case exists:
+					if err := db.Update("t", map[string]any{"k": values[0], "v": values[1]}, int64(id)); err != nil {
+						t.Fatal(op, err)
+					}
+					model[id] = values
+				default:
+					if err := db.Insert("t", append([]any{int64(id)}, values...)...); err != nil {
+						t.Fatal(op, err)
+					}
+					model[id] = values
+				}
+				if op%400 == 399 {
+					check(t, db.Commit())
+					checkTable(t, db, model)
+					check(t, db.Begin())
+				}
+			}
+			check(t, db.Commit())
+			for id := range model {
+				if err := db.Delete("t", int64(id)); err != nil {
+					t.Fatal(err)
+				}
+				delete(model, id)
+				if len(model)%100 == 0 {
+					checkTable(t, db, model)
+				}
+			}
+			table := testTable(t, db, "t")
+			if keys, depth := checkBtree(t, table); len(keys) != 0 || depth != 0 {
+				t.Fatalf("%d keys left, depth %d", len(keys), depth)
+			}
+			if keys, depth := checkBtree(t, table.indexes[0].btree); len(keys) != 0 || depth != 0 {
+				t.Fatalf("index: %d keys left, depth %d", len(keys), depth)
+			}
+		})
+	}
+}
+
+// 行变短之后叶子节点下溢, 与删除相同地借cell或合并: 叶子节点变少, 所有非根的叶子节点不低于LEAF_NODE_MIN_FILL
+func TestBtreeUpdateShrinks(t *testing.T) {
+	for _, journal := range testJournalModes {
+		t.Run(journal.name, func(t *testing.T) {
+			db, path := testOpen(t, journal.mode, 10)
+			// 从最左边的叶子节点沿链表遍历, 返回叶子节点的个数和非根叶子节点中最少的使用空间
+			leaves := func() (count int, minUsed uint32) {
+				t.Helper()
+				table := testTable(t, db, "users")
+				node, err := getNode(table.Pager, table.rootPageCTh)
+				check(t, err)
+				for getNodeType(node) == NODE_INTERNAL {
+					children, _ := node.internalNodeEntries()
+					node, err = getNode(table.Pager, children[0])
+					check(t, err)
+				}
+				minUsed = LEAF_NODE_SPACE_FOR_CELLS
+				for {
+					count++
+					if !isNodeRoot(node) {
+						minUsed = min(minUsed, node.leafNodeUsedSpace())
+					}
+					next := node.LeafNodeGetNextLeaf()
+					if next == 0 {
+						return count, minUsed
+					}
+					node, err = getNode(table.Pager, next)
+					check(t, err)
+				}
+			}
+
+			model := map[uint32]string{}
+			check(t, db.Begin())
+			for id := uint32(0); id < 300; id++ {
+				testInsert(t, db, model, id)
+			}
+			check(t, db.Commit())
+			checkRows(t, db, model)
+			before, _ := leaves()
+			for id := uint32(0); id < 300; id++ {
+				testUpdate(t, db, model, id, fmt.Sprint(id))
+			}
+			checkRows(t, db, model)
+			after, minUsed := leaves()
+			if after*4 > before {
+				t.Fatalf("%d leaves after shrinking rows, was %d", after, before)
+			}
+			if minUsed < LEAF_NODE_MIN_FILL {
+				t.Fatalf("leaf uses %d bytes, min fill %d", minUsed, LEAF_NODE_MIN_FILL)
+			}
+			db.Close()
+
+			db = testReopen(t, path, journal.mode)
+			defer db.Close()
+			checkRows(t, db, model)
+		})
+	}
+}
+
+// buffer pool只能放下两个页面: 分割, 合并时节点操作只pin住自己正在使用的页面, 其它页面随时被换出,
+// 语句结束之后没有被pin住的页面, buffer pool回到上限之内
+func TestBtreeTinyCache(t *testing.T) {
+	for _, journal := range testJournalModes {
+		t.Run(journal.name, func(t *testing.T) {
+			db, path := testOpenIndexed(t, journal.mode)
+			check(t, db.SetCacheSize(2))
+			pager := db.database.Pager
+			rnd := rand.New(rand.NewSource(3))
+			model := map[uint32][]any{}
+			check(t, db.Begin())
+			for op := 0; op < 2000; op++ {
+				id := uint32(rnd.Intn(600))
+				values := []any{randomIndexKey(rnd), randomValue(rnd)}
+				_, exists := model[id]
+				switch {
+				case exists && rnd.Intn(3) == 0:
+					check(t, db.Delete("t", int64(id)))
+					delete(model, id)
+				case exists:
+					check(t, db.Update("t", map[string]any{"k": values[0], "v": values[1]}, int64(id)))
+					model[id] = values
+				default:
+					check(t, db.Insert("t", append([]any{int64(id)}, values...)...))
+					model[id] = values
+				}
+				for pageTh, page := range pager.Pages {
+					if page.pinCount != 0 {
+						t.Fatalf("op %d: page %d pinned %d times after the statement", op, pageTh, page.pinCount)
+					}
+				}
+				if len(pager.Pages) > 2 {
+					t.Fatalf("op %d: %d pages cached", op, len(pager.Pages))
+				}
+				if op%500 == 499 {
+					check(t, db.Commit())
+					checkTable(t, db, model)
+					check(t, db.Begin())
+				}
+			}
+			check(t, db.Commit())
+			if depth := checkTable(t, db, model); depth < 2 {
+				t.Fatalf("depth %d", depth)
+			}
+			db.Close()
+
+			db = testReopen(t, path, journal.mode)
+			defer db.Close()
+			checkTable(t, db, model)
+		})
+	}
+}
+
+// DELETE和UPDATE按任意的WHERE条件修改所有满足条件的行, 按索引遍历时修改索引列也只修改每行一次
+func TestDeleteUpdateWhere(t *testing.T) {
+	db, _ := testOpen(t, JOURNAL_MODE_WAL, 0)
+	defer db.Close()
+	for _, sql := range []string{
+		"create table t (id integer primary key, n integer, s text)",
+		"create index t_n on t (n)",
+		"begin",
+	} {
+		if _, err := db.Exec(sql); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		if err := db.Insert("t", i, i%100, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec("commit"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		sql      string
+		affected int64
+		left     int
+	}{
+		{"update t set n = 1000 where n >= 10 and n < 20", 100, 1000},
+		{"update t set s = 'x' where n = 1000 or id < 5", 105, 1000},
+		{"delete from t where s is null and id >= 900", 90, 910},
+		{"delete from t where s = 'x' and n = 1000", 100, 810},
+		{"delete from t where id = 5000", 0, 810},
+		{"update t set s = 'y'", 810, 810},
+		{"delete from t", 810, 0},
+	}
+	for _, test := range tests {
+		result, err := db.Exec(test.sql)
+		if err != nil {
+			t.Fatalf("%s: %v", test.sql, err)
+		}
+		if result.RowsAffected != test.affected {
+			t.Fatalf("%s: affected %d rows, want %d", test.sql, result.RowsAffected, test.affected)
+		}
+		result, err = db.Exec("select id from t")
+		if err != nil || len(result.Rows) != test.left {
+			t.Fatalf("%s: %d rows left, want %d", test.sql, len(result.Rows), test.left)
+		}
+		checkIndexes(t, testTable(t, db, "t"))
+	}
+}
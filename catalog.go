@@ -0,0 +1,346 @@
+package renekton
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+系统表(catalog): 和sqlite_master一样本身也是一张表, B+树的根节点固定在ROOT_PAGE_TH.
+每一行记录一张表或者一个索引的名字, 根节点和建表(建索引)语句, 主键为根节点的页面序号.
+打开数据库或者文件头中的schema cookie改变之后重新读取
+*/
+
+const (
+	CATALOG_TYPE_TABLE = "table"
+	CATALOG_TYPE_INDEX = "index"
+
+	CATALOG_TABLE = "renekton_master"
+	CATALOG_SQL   = "CREATE TABLE renekton_master (rootpage INTEGER PRIMARY KEY, type TEXT, name TEXT, sql TEXT)"
+
+	// 内部使用的表和索引的名字前缀, 用户不能创建这样的表和索引
+	CATALOG_RESERVED_PREFIX = "renekton_"
+	// UNIQUE列自动创建的唯一索引的名字前缀, 这些索引不能直接删除
+	CATALOG_AUTOINDEX_PREFIX = "renekton_autoindex_"
+
+	// 每张AUTOINCREMENT的表一行, 保存已经分配过的最大主键. 第一次创建AUTOINCREMENT的表时创建
+	SEQUENCE_TABLE = "renekton_sequence"
+	SEQUENCE_SQL   = "CREATE TABLE renekton_sequence (name TEXT PRIMARY KEY, seq INTEGER)"
+)
+
+/*
+ * Catalog Row Layout
+ */
+const (
+	CATALOG_COLUMN_ROOT_PAGE = iota
+	CATALOG_COLUMN_TYPE
+	CATALOG_COLUMN_NAME
+	CATALOG_COLUMN_SQL
+)
+
+/*
+ * Sequence Row Layout
+ */
+const (
+	SEQUENCE_COLUMN_NAME = iota
+	SEQUENCE_COLUMN_SEQ
+)
+
+var (
+	catalogSchema  = mustParseSchema(CATALOG_SQL)
+	sequenceSchema = mustParseSchema(SEQUENCE_SQL)
+)
+
+// 内部的建表语句, 出错说明代码有问题
+func mustParseSchema(sql string) *Schema {
+	stmt, _, err := parse(sql)
+	if err != nil {
+		panic(err)
+	}
+	schema, err := schemaFromCreateTable(stmt.(*CreateTableStmt))
+	if err != nil {
+		panic(err)
+	}
+	return schema
+}
+
+// 文件头中的schema cookie与缓存的不一致时(建表, 回滚)重新读取系统表
+func catalogLoad(database *Database) error {
+	header, err := getPage(database.Pager, HEADER_PAGE_TH)
+	if err != nil {
+		return err
+	}
+	cookie := header.HeaderGetSchemaCookie()
+	if database.schemaLoaded && database.schemaCookie == cookie {
+		return nil
+	}
+
+	tables := make(map[string]*Table)
+	var indexRows []*Row
+	var loadErr error
+	err = executeSelect(&Statement{SType: STATEMENT_SELECT}, database.catalog, func(row *Row) bool {
+		if row.Values[CATALOG_COLUMN_TYPE] == CATALOG_TYPE_INDEX {
+			// 索引在所有的表读取完之后再处理
+			indexRows = append(indexRows, row)
+			return true
+		}
+		table, err := catalogReadTable(database.Pager, row)
+		if err != nil {
+			loadErr = err
+			return false
+		}
+		tables[strings.ToLower(table.schema.Name)] = table
+		return true
+	})
+	if err == nil {
+		err = loadErr
+	}
+	if err != nil {
+		return err
+	}
+	sequence := tables[SEQUENCE_TABLE]
+	for _, table := range tables {
+		if !table.schema.autoincrement() {
+			continue
+		}
+		if sequence == nil {
+			return corruptPageError(ROOT_PAGE_TH, fmt.Sprintf("table %s: missing %s", table.schema.Name, SEQUENCE_TABLE))
+		}
+		table.sequence = sequence
+	}
+	indexes := make(map[string]*Index)
+	for _, row := range indexRows {
+		if err := catalogReadIndex(database.Pager, tables, indexes, row); err != nil {
+			return err
+		}
+	}
+	database.tables = tables
+	database.indexes = indexes
+	database.schemaCookie = cookie
+	database.schemaLoaded = true
+	return nil
+}
+
+// 按系统表中的一行生成表, 建表语句不能解析时认为系统表损坏
+func catalogReadTable(pager *Pager, row *Row) (*Table, error) {
+	rootPageTh := uint32(row.Values[CATALOG_COLUMN_ROOT_PAGE].(int64))
+	sql := row.Values[CATALOG_COLUMN_SQL].(string)
+	if rootPageTh <= ROOT_PAGE_TH || rootPageTh >= pager.pagesCount {
+		return nil, corruptPageError(ROOT_PAGE_TH, fmt.Sprintf("table root page %d", rootPageTh))
+	}
+	stmt, _, err := parse(sql)
+	if err != nil {
+		return nil, corruptPageError(ROOT_PAGE_TH, fmt.Sprintf("invalid schema %q: %s", sql, err.Error()))
+	}
+	createTable, ok := stmt.(*CreateTableStmt)
+	if !ok {
+		return nil, corruptPageError(ROOT_PAGE_TH, fmt.Sprintf("invalid schema %q", sql))
+	}
+	schema, err := schemaFromCreateTable(createTable)
+	if err != nil {
+		return nil, corruptPageError(ROOT_PAGE_TH, fmt.Sprintf("invalid schema %q: %s", sql, err.Error()))
+	}
+	return &Table{rootPageCTh: rootPageTh, Pager: pager, schema: schema}, nil
+}
+
+// 按系统表中的一行生成索引, 加入它所在的表
+func catalogReadIndex(pager *Pager, tables map[string]*Table, indexes map[string]*Index, row *Row) error {
+	rootPageTh := uint32(row.Values[CATALOG_COLUMN_ROOT_PAGE].(int64))
+	sql := row.Values[CATALOG_COLUMN_SQL].(string)
+	if rootPageTh <= ROOT_PAGE_TH || rootPageTh >= pager.pagesCount {
+		return corruptPageError(ROOT_PAGE_TH, fmt.Sprintf("index root page %d", rootPageTh))
+	}
+	stmt, _, err := parse(sql)
+	if err != nil {
+		return corruptPageError(ROOT_PAGE_TH, fmt.Sprintf("invalid index %q: %s", sql, err.Error()))
+	}
+	createIndex, ok := stmt.(*CreateIndexStmt)
+	if !ok {
+		return corruptPageError(ROOT_PAGE_TH, fmt.Sprintf("invalid index %q", sql))
+	}
+	table := tables[strings.ToLower(createIndex.Table.Name)]
+	if table == nil {
+		return corruptPageError(ROOT_PAGE_TH, fmt.Sprintf("index %q on missing table", sql))
+	}
+	column := table.schema.columnIndex(createIndex.Column.Name)
+	if column < 0 {
+		return corruptPageError(ROOT_PAGE_TH, fmt.Sprintf("index %q on missing column", sql))
+	}
+	index := &Index{Name: createIndex.Name.Name, Column: column, Unique: createIndex.Unique, SQL: sql,
+		btree: &Table{rootPageCTh: rootPageTh, Pager: pager}}
+	table.indexes = append(table.indexes, index)
+	indexes[strings.ToLower(index.Name)] = index
+	return nil
+}
+
+// 按名字查找表, 不区分大小写. 调用之前需要catalogLoad
+func catalogFindTable(database *Database, name string) *Table {
+	if strings.EqualFold(name, CATALOG_TABLE) {
+		return database.catalog
+	}
+	return database.tables[strings.ToLower(name)]
+}
+
+// 表和索引的名字不能重复
+func catalogCheckName(database *Database, name string) error {
+	if catalogFindTable(database, name) != nil {
+		return fmt.Errorf("%w: %s", ErrTableExists, name)
+	}
+	if database.indexes[strings.ToLower(name)] != nil {
+		return fmt.Errorf("%w: %s", ErrIndexExists, name)
+	}
+	return nil
+}
+
+// 申请一个空的叶子节点作为新的B+树的根节点
+func catalogCreateRoot(pager *Pager) (uint32, error) {
+	rootPageTh, err := getUnusedPageTh(pager)
+	if err != nil {
+		return 0, err
+	}
+	root, err := getPage(pager, rootPageTh)
+	if err != nil {
+		return 0, err
+	}
+	root.initializeLeafNode()
+	setNodeRoot(root, true)
+	return rootPageTh, nil
+}
+
+// 为索引申请根节点, 在系统表中插入一行
+func catalogCreateIndex(database *Database, index *Index) error {
+	if err := catalogCheckName(database, index.Name); err != nil {
+		return err
+	}
+	rootPageTh, err := catalogCreateRoot(database.Pager)
+	if err != nil {
+		return err
+	}
+	row := Row{Values: []any{int64(rootPageTh), CATALOG_TYPE_INDEX, index.Name, index.SQL}}
+	if err := executeInsert(&Statement{SType: STATEMENT_INSERT, RowToInsert: row}, database.catalog); err != nil {
+		return err
+	}
+	index.btree = &Table{rootPageCTh: rootPageTh, Pager: database.Pager}
+	return nil
+}
+
+// 系统表修改之后递增schema cookie, 其它连接(和回滚之后)据此重新读取系统表
+func catalogChanged(pager *Pager) error {
+	header, err := getPage(pager, HEADER_PAGE_TH)
+	if err != nil {
+		return err
+	}
+	header.HeaderSetSchemaCookie(header.HeaderGetSchemaCookie() + 1)
+	return nil
+}
+
+// 在系统表中加入新表, schema cookie递增. 第一张AUTOINCREMENT的表同时创建SEQUENCE_TABLE
+func executeCreateTable(statement *Statement, database *Database) error {
+	schema := statement.SchemaToCreate
+	if err := catalogLoad(database); err != nil {
+		return err
+	}
+	if err := catalogCreateTable(database, schema); err != nil {
+		return err
+	}
+	if schema.autoincrement() && catalogFindTable(database, SEQUENCE_TABLE) == nil {
+		if err := catalogCreateTable(database, sequenceSchema); err != nil {
+			return err
+		}
+	}
+	return catalogChanged(database.Pager)
+}
+
+// 为新表申请一个空的根节点, 在系统表中插入一行. 每个UNIQUE列自动创建一个唯一索引
+func catalogCreateTable(database *Database, schema *Schema) error {
+	if err := catalogCheckName(database, schema.Name); err != nil {
+		return err
+	}
+	rootPageTh, err := catalogCreateRoot(database.Pager)
+	if err != nil {
+		return err
+	}
+
+	row := Row{Values: []any{int64(rootPageTh), CATALOG_TYPE_TABLE, schema.Name, schema.SQL}}
+	if err := executeInsert(&Statement{SType: STATEMENT_INSERT, RowToInsert: row}, database.catalog); err != nil {
+		return err
+	}
+	autoindexCount := 0
+	for th, column := range schema.Columns {
+		if !column.Unique {
+			continue
+		}
+		autoindexCount++
+		name := fmt.Sprintf("%s%s_%d", CATALOG_AUTOINDEX_PREFIX, schema.Name, autoindexCount)
+		index := &Index{Name: name, Column: th, Unique: true, SQL: fmt.Sprintf("CREATE UNIQUE INDEX %s ON %s (%s)", name, schema.Name, column.Name)}
+		if err := catalogCreateIndex(database, index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 为索引申请根节点, 在系统表中插入一行, 然后把表中已有的行加入索引
+func executeCreateIndex(statement *Statement, database *Database) error {
+	index := statement.IndexToCreate
+	if err := catalogLoad(database); err != nil {
+		return err
+	}
+	if err := catalogCreateIndex(database, index); err != nil {
+		return err
+	}
+
+	// 唯一索引中已有重复的值时创建失败
+	table := statement.Table
+	var insertErr error
+	err := executeSelect(&Statement{SType: STATEMENT_SELECT}, table, func(row *Row) bool {
+		insertErr = indexInsert(index, table, row)
+		return insertErr == nil
+	})
+	if err == nil {
+		err = insertErr
+	}
+	if err != nil {
+		return err
+	}
+	return catalogChanged(database.Pager)
+}
+
+// 删除系统表中索引的一行, 回收索引的全部页面
+func executeDropIndex(statement *Statement, database *Database) error {
+	index := statement.IndexToDrop
+	rootPageTh := index.btree.rootPageCTh
+	if err := tableDeleteRow(database.catalog, appendIntegerKey(nil, int64(rootPageTh))); err != nil {
+		return err
+	}
+	if err := btreeFree(database.Pager, rootPageTh); err != nil {
+		return err
+	}
+	return catalogChanged(database.Pager)
+}
+
+// AUTOINCREMENT的表已经分配过的最大主键, 没有记录时为0
+func sequenceGet(table *Table) (int64, error) {
+	row, err := tableGetRow(table.sequence, appendTextKey(nil, table.schema.Name))
+	if err != nil || row == nil {
+		return 0, err
+	}
+	return row.Values[SEQUENCE_COLUMN_SEQ].(int64), nil
+}
+
+// 插入的主键大于记录的最大值时更新记录
+func sequenceUpdate(table *Table, id int64) error {
+	key := appendTextKey(nil, table.schema.Name)
+	row, err := tableGetRow(table.sequence, key)
+	if err != nil {
+		return err
+	}
+	if row == nil {
+		row := Row{Values: []any{table.schema.Name, id}}
+		return executeInsert(&Statement{SType: STATEMENT_INSERT, RowToInsert: row}, table.sequence)
+	}
+	if row.Values[SEQUENCE_COLUMN_SEQ].(int64) >= id {
+		return nil
+	}
+	return tableUpdateRow(table.sequence, key, map[int]any{SEQUENCE_COLUMN_SEQ: id})
+}
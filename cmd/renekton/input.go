@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/yuhaoyuan/renekton"
+)
+
+type MetaCommandResult int
+
+const (
+	META_COMMAND_SUCCESS MetaCommandResult = iota
+	META_COMMAND_EXIT
+	META_COMMAND_UNRECOGNIZED_COMMAND
+)
+
+type InputBuffer struct {
+	buffer       string
+	bufferLength int
+	inputLength  int
+}
+
+func newInputBuffer() *InputBuffer {
+	return &InputBuffer{
+		"",
+		0,
+		0,
+	}
+}
+
+func printPrompt() {
+	fmt.Println("这是一段提示语")
+}
+
+// 所有输入共用一个reader, 否则管道输入中已经被读进缓冲区的行会丢失
+var stdinReader = bufio.NewReader(os.Stdin)
+
+func readInput(inputBuffer *InputBuffer) error {
+	input, err := stdinReader.ReadString('\n')
+	input = strings.TrimSpace(input)
+	if err != nil && len(input) == 0 {
+		return err
+	}
+	fmt.Println("收到的指令为： ", input)
+	if len(input) == 0 {
+		fmt.Println("未读到您输入的指令")
+		return errors.New("no input")
+	}
+	inputBuffer.inputLength = len(input) - 1
+	inputBuffer.buffer = input
+	return nil
+}
+
+func doMetaCommand(inputBuffer *InputBuffer, db *renekton.DB) MetaCommandResult {
+	if inputBuffer.buffer == ".exit" {
+		_ = db.Close()
+		return META_COMMAND_EXIT
+	} else if inputBuffer.buffer == ".constants" {
+		printConstants()
+		return META_COMMAND_SUCCESS
+	} else if inputBuffer.buffer == ".tables" {
+		tables, err := db.Tables()
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+		for _, table := range tables {
+			fmt.Println(table)
+		}
+		return META_COMMAND_SUCCESS
+	} else if strings.HasPrefix(inputBuffer.buffer, ".cache_size") {
+		// .cache_size <n>: 修改buffer pool最多缓存的页面数
+		args := strings.Split(inputBuffer.buffer, " ")
+		if len(args) != 2 {
+			return META_COMMAND_UNRECOGNIZED_COMMAND
+		}
+		cacheSize, err := strconv.Atoi(args[1])
+		if err != nil || cacheSize <= 0 {
+			return META_COMMAND_UNRECOGNIZED_COMMAND
+		}
+		if err := db.SetCacheSize(uint32(cacheSize)); err != nil {
+			fmt.Println(err.Error())
+		}
+		return META_COMMAND_SUCCESS
+	}
+	return META_COMMAND_UNRECOGNIZED_COMMAND
+}
+
+func printConstants() {
+	fmt.Println("COMMON_NODE_HEADER_SIZE: ", renekton.COMMON_NODE_HEADER_SIZE)
+	fmt.Println("LEAF_NODE_HEADER_SIZE: ", renekton.LEAF_NODE_HEADER_SIZE)
+	fmt.Println("LEAF_CELL_HEADER_SIZE: ", renekton.LEAF_CELL_HEADER_SIZE)
+	fmt.Println("LEAF_NODE_MAX_LOCAL: ", renekton.LEAF_NODE_MAX_LOCAL)
+	fmt.Println("OVERFLOW_DATA_SIZE: ", renekton.OVERFLOW_DATA_SIZE)
+	fmt.Println("LEAF_NODE_SPACE_FOR_CELLS: ", renekton.LEAF_NODE_SPACE_FOR_CELLS)
+	fmt.Println("LEAF_NODE_MIN_FILL: ", renekton.LEAF_NODE_MIN_FILL)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/yuhaoyuan/renekton"
+)
+
+func main() {
+	args := os.Args
+	if len(args) < 2 {
+		fmt.Println("Must supply a database filename")
+		os.Exit(1)
+	}
+	filename := args[1]
+	// 第二个参数为日志模式: wal(默认) 或 rollback
+	options := &renekton.Options{JournalMode: renekton.JOURNAL_MODE_WAL}
+	if len(args) > 2 {
+		switch args[2] {
+		case "wal":
+			options.JournalMode = renekton.JOURNAL_MODE_WAL
+		case "rollback":
+			options.JournalMode = renekton.JOURNAL_MODE_ROLLBACK
+		default:
+			fmt.Println(fmt.Sprintf("Unknown journal mode %s, must be wal or rollback", args[2]))
+			os.Exit(1)
+		}
+	}
+	db, err := renekton.Open(filename, options)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("Unable to open %s: %s", filename, err.Error()))
+		os.Exit(1)
+	}
+	inputBuffer := newInputBuffer()
+
+	for {
+		printPrompt()
+		err := readInput(inputBuffer)
+		if err == io.EOF {
+			_ = db.Close()
+			return
+		}
+		if err != nil {
+			fmt.Println("readInput failed, err = ", err)
+			continue
+		}
+		if inputBuffer.buffer[0] == '.' {
+			switch doMetaCommand(inputBuffer, db) {
+			case META_COMMAND_SUCCESS:
+				continue
+			case META_COMMAND_EXIT:
+				fmt.Println("exit command!")
+				return // 直接退出main
+			case META_COMMAND_UNRECOGNIZED_COMMAND:
+				fmt.Println(fmt.Sprintf("Unrecognized command %s", inputBuffer.buffer))
+				continue
+			}
+		}
+
+		result, err := db.Exec(inputBuffer.buffer)
+		var sqlErr *renekton.SQLError
+		if errors.As(err, &sqlErr) {
+			// 在出错的位置下面标出^
+			fmt.Println(inputBuffer.buffer)
+			fmt.Println(strings.Repeat(" ", sqlErr.Pos) + "^")
+		}
+		switch {
+		case err == nil:
+			for _, row := range result.Rows {
+				printRow(result.Columns, row)
+			}
+			fmt.Println("Executed.")
+		case errors.Is(err, renekton.ErrStringTooLong), errors.Is(err, renekton.ErrSyntax):
+			fmt.Println(fmt.Sprintf("Syntax error. %s.", err.Error()))
+		default:
+			fmt.Println(err.Error())
+		}
+	}
+}
+
+func printRow(columns []string, row *renekton.Row) {
+	values := make([]string, len(row.Values))
+	for i, value := range row.Values {
+		values[i] = formatValue(value)
+	}
+	fmt.Println("\n*********************************************")
+	fmt.Println(" th row = ", values)
+	for i, column := range columns {
+		fmt.Println(column, "= ", values[i])
+	}
+	fmt.Print("*********************************************\n\n")
+}
+
+// NULL和BLOB按SQL字面量的格式输出
+func formatValue(value any) string {
+	switch value := value.(type) {
+	case nil:
+		return "NULL"
+	case []byte:
+		return fmt.Sprintf("X'%x'", value)
+	}
+	return fmt.Sprint(value)
+}
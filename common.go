@@ -1,22 +1,8 @@
-package main
+package renekton
 
 import (
 	"fmt"
 	"math"
-	"os"
-)
-
-// 磁盘文件偏移量
-const (
-	ID_SIZE       = uint32(4)
-	USERNAME_SIZE = uint32(32)
-	EMAIL_SIZE    = uint32(255)
-
-	ID_OFFSET       = uint32(0)
-	USERNAME_OFFSET = ID_OFFSET + ID_SIZE
-	EMAIL_OFFSET    = USERNAME_OFFSET + USERNAME_SIZE
-
-	ROW_SIZE = ID_SIZE + USERNAME_SIZE + EMAIL_SIZE
 )
 
 const (
@@ -35,11 +21,6 @@ const (
 	COMMON_NODE_HEADER_SIZE = NODE_TYPE_SIZE + IS_ROOT_SIZE + PARENT_POINTER_SIZE
 )
 
-// 分割叶子节点常量
-const (
-	LEAF_NODE_SPLIT_FLAG = (LEAF_NODE_MAX_CELLS + 1) / 2
-)
-
 // 将一个正整数（32位）分解成内存切片
 func NumberToByte(n uint32) [4]byte {
 	nStr := [4]byte{}
@@ -64,6 +45,7 @@ func ByteToNumber(nStr []byte) uint32 {
 
 // 复制两个节点内容
 func pageCopy(destination *Page, source *Page) {
+	destination.markDirty()
 	copy((*destination.data)[:PAGE_SIZE], (*source.data)[:PAGE_SIZE])
 }
 
@@ -73,48 +55,129 @@ func getNodeType(page *Page) byte {
 }
 
 func setNodeType(page *Page, nodeType byte) {
+	page.markDirty()
 	(*page.data)[NODE_TYPE_OFFSET] = nodeType
 }
 
-func printConstants() {
-	fmt.Println("ROW_SIZE: ", ROW_SIZE)
-	fmt.Println("COMMON_NODE_HEADER_SIZE: ", COMMON_NODE_HEADER_SIZE)
-	fmt.Println("LEAF_NODE_HEADER_SIZE: ", LEAF_NODE_HEADER_SIZE)
-	fmt.Println("LEAF_NODE_CELL_SIZE: ", LEAF_NODE_CELL_SIZE)
-	fmt.Println("LEAF_NODE_SPACE_FOR_CELLS: ", LEAF_NODE_SPACE_FOR_CELLS)
-	fmt.Println("LEAF_NODE_MAX_CELLS: ", LEAF_NODE_MAX_CELLS)
+// 从磁盘读出的节点在使用之前检查类型和cell数量, 避免损坏的页面导致越界访问
+func checkNode(pager *Pager, node *Page) error {
+	switch getNodeType(node) {
+	case NODE_LEAF:
+		if node.LeafNodeGetCellsCount() > LEAF_NODE_SPACE_FOR_CELLS/LEAF_NODE_CELL_POINTER_SIZE {
+			return corruptPageError(node.pageTh, "leaf node cells count exceeds page")
+		}
+		if err := node.leafNodeCheckCells(); err != nil {
+			return err
+		}
+		if nextLeaf := node.LeafNodeGetNextLeaf(); nextLeaf >= pager.pagesCount {
+			return corruptPageError(node.pageTh, fmt.Sprintf("next leaf %d out of range", nextLeaf))
+		}
+	case NODE_INTERNAL:
+		if node.InternalNodeGetKeyCount() > INTERNAL_NODE_SPACE_FOR_CELLS/INTERNAL_NODE_CELL_POINTER_SIZE {
+			return corruptPageError(node.pageTh, "internal node keys count exceeds page")
+		}
+		if err := node.internalNodeCheckCells(); err != nil {
+			return err
+		}
+		children, _ := node.internalNodeEntries()
+		for _, childPageTh := range children {
+			if childPageTh == HEADER_PAGE_TH || childPageTh >= pager.pagesCount {
+				return corruptPageError(node.pageTh, fmt.Sprintf("child %d out of range", childPageTh))
+			}
+		}
+	default:
+		return corruptPageError(node.pageTh, fmt.Sprintf("unknown node type %d", getNodeType(node)))
+	}
+	return nil
 }
 
-func leafNodeInsert(cursor *Cursor, keyByte []byte, value *Row) {
-	page, err := getPage(cursor.Table.Pager, cursor.PageTh)
+// 获取一个B+树节点并检查它的格式
+func getNode(pager *Pager, pageTh uint32) (*Page, error) {
+	if pageTh == HEADER_PAGE_TH || pageTh >= pager.pagesCount {
+		return nil, fmt.Errorf("%w: node %d", ErrPageOutOfRange, pageTh)
+	}
+	node, err := getPage(pager, pageTh)
 	if err != nil {
-		fmt.Println("leafNodeInsert getPage failed. err = ", err)
-		os.Exit(0)
+		return nil, err
 	}
-	cellCount := page.LeafNodeGetCellsCount()
-	if cellCount+1 > LEAF_NODE_MAX_CELLS {
-		// 分割叶子节点
-		leafNodeSplitAndInsert(cursor, keyByte, value)
-		return
+	if err := checkNode(pager, node); err != nil {
+		return nil, err
 	}
+	return node, nil
+}
 
-	if cursor.CellTh < cellCount {
-		// 从第i位开始将cells整体往右移动一个单位
-		for i := cellCount; i > cursor.CellTh; i-- {
-			// 将i-1 复制给i
-			page.LeafNodeMoveCell(i, i-1)
-		}
+// 节点操作在使用一个页面的过程中还会加载其它页面时, 用getPinnedPage/getPinnedNode获取它, 返回前unpin.
+// 新加载的页面可能换出没有pin住的页面, 换出之后对旧的*Page的修改不会写回
+func getPinnedPage(pager *Pager, pageTh uint32) (*Page, error) {
+	page, err := getPage(pager, pageTh)
+	if err != nil {
+		return nil, err
 	}
-	page.LeafNodeAddCellsCount()
-	page.LeafNodeSetKey(cursor.CellTh, keyByte)
+	page.pin()
+	return page, nil
+}
 
-	// 是否需要更新父节点
-	serializeRow(value, page, cursor.CellTh)
+func getPinnedNode(pager *Pager, pageTh uint32) (*Page, error) {
+	node, err := getNode(pager, pageTh)
+	if err != nil {
+		return nil, err
+	}
+	node.pin()
+	return node, nil
+}
+
+func leafNodeInsert(cursor *Cursor, keyByte []byte, value []byte) error {
+	page, err := getPinnedPage(cursor.Table.Pager, cursor.PageTh)
+	if err != nil {
+		return err
+	}
+	defer page.unpin()
+	cell, err := newLeafCell(cursor.Table.Pager, keyByte, value)
+	if err != nil {
+		return err
+	}
+	cells := page.LeafNodeCells()
+	cells = append(cells[:cursor.CellTh], append([][]byte{cell}, cells[cursor.CellTh:]...)...)
+	if !leafNodeFits(cells) {
+		// 分割叶子节点
+		return leafNodeSplit(cursor.Table, cursor.PageTh, cells)
+	}
+	page.LeafNodeSetCells(cells)
+	return nil
+}
+
+// 替换光标指向的cell的payload, key不变. 新的cell放不下时分割叶子节点
+func leafNodeReplace(cursor *Cursor, value []byte) error {
+	page, err := getPinnedPage(cursor.Table.Pager, cursor.PageTh)
+	if err != nil {
+		return err
+	}
+	defer page.unpin()
+	cells := page.LeafNodeCells()
+	oldCell := cells[cursor.CellTh]
+	cell, err := newLeafCell(cursor.Table.Pager, leafCellKey(oldCell), value)
+	if err != nil {
+		return err
+	}
+	if err := leafCellFree(cursor.Table.Pager, oldCell); err != nil {
+		return err
+	}
+	cells[cursor.CellTh] = cell
+	if !leafNodeFits(cells) {
+		return leafNodeSplit(cursor.Table, cursor.PageTh, cells)
+	}
+	page.LeafNodeSetCells(cells)
+	// 新的行更短时节点可能下溢, 与删除相同地处理. key不变, 不需要更新祖先节点中的key
+	if !isNodeRoot(page) && page.leafNodeUsedSpace() < LEAF_NODE_MIN_FILL {
+		return leafNodeRebalance(cursor.Table, cursor.PageTh)
+	}
+	return nil
 }
 
 // 初始化内部节点
 func initializeInternalNode(node *Page) {
 	tempData := make([]byte, PAGE_SIZE)
+	node.markDirty()
 	*node.data = tempData
 	//node.pageLength = PAGE_SIZE
 
@@ -122,20 +185,25 @@ func initializeInternalNode(node *Page) {
 	setNodeType(node, NODE_INTERNAL)
 }
 
-// 叶子节点分割
-func leafNodeSplitAndInsert(cursor *Cursor, keyByte []byte, value *Row) {
-	oldNode, err := getPage(cursor.Table.Pager, cursor.PageTh)
+// 叶子节点分割: cells为插入(或替换)之后已经放不下的完整内容, 左边一部分留在原节点, 剩下的移动到新节点
+func leafNodeSplit(table *Table, pageTh uint32, cells [][]byte) error {
+	oldNode, err := getPinnedPage(table.Pager, pageTh)
 	if err != nil {
-		fmt.Println("leafNodeSplitAndInsert failed")
-		os.Exit(0)
+		return err
 	}
+	defer oldNode.unpin()
 
-	oldMaxKey := oldNode.GetNodeMaxKey()
-	newPageTh := getUnusedPageTh(cursor.Table.Pager)
-	newNode, err := getPage(cursor.Table.Pager, newPageTh)
+	splitTh, err := leafNodeSplitPoint(pageTh, cells)
+	if err != nil {
+		return err
+	}
+	newPageTh, err := getUnusedPageTh(table.Pager)
 	if err != nil {
-		fmt.Println("leafNodeSplitAndInsert get new Page failed")
-		os.Exit(0)
+		return err
+	}
+	newNode, err := getPage(table.Pager, newPageTh)
+	if err != nil {
+		return err
 	}
 	newNode.initializeLeafNode()
 
@@ -146,62 +214,55 @@ func leafNodeSplitAndInsert(cursor *Cursor, keyByte []byte, value *Row) {
 	newNode.LeafNodeSetNextLeaf(oldNode.LeafNodeGetNextLeaf())
 	oldNode.LeafNodeSetNextLeaf(newPageTh)
 
-	// 分割oldNode: flag右边cell移动到newNode，左边的cell保留. flag = 原长度+新节点(1) / 2
-	var desNode *Page
-	i := LEAF_NODE_MAX_CELLS
-	for { // 不是LEAF_NODE_MAX_CELLS是因为需要从最后一个开始移动
-		if i > LEAF_NODE_SPLIT_FLAG {
-			desNode = newNode
-		} else {
-			desNode = oldNode
-		}
-		desCellTh := i % (LEAF_NODE_SPLIT_FLAG + 1) // 分割后的cellTh
-
-		if i == cursor.CellTh {
-			// 新插入的cell应该写入第i个cell处
-			serializeRow(value, desNode, desCellTh)
-			desNode.LeafNodeSetKey(desCellTh, keyByte)
-			desNode.LeafNodeAddCellsCount()
-		} else if i > cursor.CellTh {
-			// 在新节点index后面的节点需要往后移动一个cell距离, 即 原来的第cellTh是现在的第cellTh+1
-			tempCell := oldNode.LeafNodeGetCell(i - 1)
-			desNode.LeafNodeSetCell(desCellTh, tempCell)
-			// 新节点count + 1
-			desNode.LeafNodeAddCellsCount()
-			oldNode.LeafNodeSubCellsCount()
-		} else {
-			//新节点前面的节点正常移动
-			tempCell := oldNode.LeafNodeGetCell(i)
-			desNode.LeafNodeSetCell(desCellTh, tempCell)
-		}
-		if i == 0 {
-			break
-		} else {
-			i--
-		}
-	}
+	oldNode.LeafNodeSetCells(cells[:splitTh])
+	newNode.LeafNodeSetCells(cells[splitTh:])
 
 	// 如果oldNode是根节点，则还需要创建新的根节点. 否则更新父节点即可.
 	if isNodeRoot(oldNode) {
-		createNewRoot(cursor.Table, newPageTh)
-	} else {
-		// update parent
-		parentPageTh := oldNode.LeafNodeGetParent()
-		newMaxKey := oldNode.GetNodeMaxKey()
+		return createNewRoot(table, newPageTh)
+	}
+	// update parent
+	newMaxKey, err := getNodeMaxKey(table.Pager, oldNode)
+	if err != nil {
+		return err
+	}
+	return internalNodeInsert(table, oldNode.LeafNodeGetParent(), pageTh, newMaxKey, newPageTh)
+}
 
-		parentNode, err := getPage(cursor.Table.Pager, parentPageTh)
-		if err != nil {
-			os.Exit(0)
+// 选择分割的位置: 两边都能放进一个节点, 并且两边的字节数尽量接近
+func leafNodeSplitPoint(pageTh uint32, cells [][]byte) (int, error) {
+	total := 0
+	for _, cell := range cells {
+		total += len(cell)
+	}
+	best, bestDiff := -1, 0
+	left := 0
+	for th := 1; th < len(cells); th++ {
+		left += len(cells[th-1])
+		if !leafNodeFits(cells[:th]) || !leafNodeFits(cells[th:]) {
+			continue
+		}
+		diff := max(left-(total-left), (total-left)-left)
+		if best < 0 || diff < bestDiff {
+			best, bestDiff = th, diff
 		}
-		parentNode.InternalNodeUpdateKey(oldMaxKey, newMaxKey)
-
-		internalNodeInsert(cursor.Table, parentPageTh, newPageTh)
 	}
+	if best < 0 {
+		return 0, corruptPageError(pageTh, fmt.Sprintf("%d cells do not fit in two leaf nodes", len(cells)))
+	}
+	return best, nil
 }
 
-// 引入删除之后需要做内存管理
-func getUnusedPageTh(pager *Pager) uint32 {
-	return pager.pagesCount
+// 优先复用空闲链表中的页面, 否则在文件末尾申请新的页面
+func getUnusedPageTh(pager *Pager) (uint32, error) {
+	pageTh, ok, err := freelistPop(pager)
+	if err != nil || ok {
+		return pageTh, err
+	}
+	if pager.pagesCount >= TABLE_MAX_PAGES {
+		return 0, ErrTableFull
+	}
+	return pager.pagesCount, nil
 }
 
 // 判断是否为root节点
@@ -218,10 +279,11 @@ func setNodeRoot(node *Page, flag bool) {
 	if flag {
 		value = uint8(1)
 	}
+	node.markDirty()
 	(*node.data)[IS_ROOT_OFFSET] = value
 }
 
-func createNewRoot(table *Table, rightChildPageTh uint32) {
+func createNewRoot(table *Table, rightChildPageTh uint32) error {
 	/*
 		处理分裂根:
 		1 旧根复制到新的页面，成为左子节点。
@@ -229,101 +291,408 @@ func createNewRoot(table *Table, rightChildPageTh uint32) {
 		3 重新初始化根页面以包含新的根节点。
 		4 新根节点指向两个子节点。
 	*/
-	root, err := getPage(table.Pager, table.rootPageCTh)
+	root, err := getPinnedPage(table.Pager, table.rootPageCTh)
 	if err != nil {
-		PrintError(fmt.Sprintf("createNewRoot failed, err=%s", err.Error()))
+		return err
 	}
+	defer root.unpin()
 
-	_, err = getPage(table.Pager, rightChildPageTh)
+	rightChildNode, err := getPinnedPage(table.Pager, rightChildPageTh)
 	if err != nil {
-		PrintError(fmt.Sprintf("create rightChildNode failed, err=%s", err.Error()))
+		return err
 	}
-	leftChildPageTh := getUnusedPageTh(table.Pager)
-	leftChildNode, err := getPage(table.Pager, leftChildPageTh)
+	defer rightChildNode.unpin()
+	leftChildPageTh, err := getUnusedPageTh(table.Pager)
 	if err != nil {
-		PrintError(fmt.Sprintf("create leftChildNode failed, err=%s", err.Error()))
-		os.Exit(0)
+		return err
 	}
+	leftChildNode, err := getPinnedPage(table.Pager, leftChildPageTh)
+	if err != nil {
+		return err
+	}
+	defer leftChildNode.unpin()
 	pageCopy(leftChildNode, root)
 	setNodeRoot(leftChildNode, false)
 
+	// 旧根是内部节点时，它的子节点都被搬到了左子节点上，需要更新父节点
+	if getNodeType(leftChildNode) == NODE_INTERNAL {
+		children, _ := leftChildNode.internalNodeEntries()
+		for _, childPageTh := range children {
+			childNode, err := getPage(table.Pager, childPageTh)
+			if err != nil {
+				return err
+			}
+			childNode.LeafNodeSetParent(leftChildPageTh)
+		}
+	}
+
 	// root 节点将变成一个新的root节点(1个key和两个子节点)
+	leftChildMaxKey, err := getNodeMaxKey(table.Pager, leftChildNode)
+	if err != nil {
+		return err
+	}
 	initializeInternalNode(root)
 	setNodeRoot(root, true)
-	root.InternalNodeSetKeyCount(1)
-	root.InternalNodeSetChild(0, leftChildPageTh)
+	root.internalNodeSetEntries([]uint32{leftChildPageTh, rightChildPageTh}, [][]byte{leftChildMaxKey})
 
-	leftChildMaxKey := leftChildNode.GetNodeMaxKey()
-	root.InternalNodeSetKey(0, leftChildMaxKey)
-	root.InternalNodeSetRightChild(rightChildPageTh)
+	leftChildNode.LeafNodeSetParent(table.rootPageCTh)
+	rightChildNode.LeafNodeSetParent(table.rootPageCTh)
+	if getNodeType(leftChildNode) == NODE_LEAF {
+		leftChildNode.LeafNodeSetNextLeaf(rightChildPageTh)
+	}
+	return nil
+}
 
-	leftChildNode.LeafNodeSetNextLeaf(rightChildPageTh)
+// 子节点leftPageTh分割之后向父节点添加新的子节点newPageTh: 新节点接管原来的位置和key,
+// leftPageTh插在它前面, key为分割之后的最大key leftMaxKey
+func internalNodeInsert(table *Table, parentPageTh, leftPageTh uint32, leftMaxKey []byte, newPageTh uint32) error {
+	parentNode, err := getPinnedNode(table.Pager, parentPageTh)
+	if err != nil {
+		return err
+	}
+	defer parentNode.unpin()
+	newNode, err := getPage(table.Pager, newPageTh)
+	if err != nil {
+		return err
+	}
+	newNode.LeafNodeSetParent(parentPageTh)
+
+	index := parentNode.internalNodeChildIndex(leftPageTh)
+	children, keys := parentNode.internalNodeEntries()
+	keys = append(keys[:index], append([][]byte{leftMaxKey}, keys[index:]...)...)
+	children = append(children[:index+1], append([]uint32{newPageTh}, children[index+1:]...)...)
+	if !internalNodeFits(keys) {
+		// 分割内部节点
+		return internalNodeSplit(table, parentPageTh, children, keys)
+	}
+	parentNode.internalNodeSetEntries(children, keys)
+	return nil
 }
 
-//func printTree(){
-//	for {
-//		if getNodeType(page) == NODE_LEAF{
-//			break
-//		}
-//		leftChildPageTh := page.InternalNodeGetChild(0)
-//		page = cursor.Table.Pager.Pages[leftChildPageTh]
-//	}
-//	// page 已经是最左边的节点
-//}
+// 替换内部节点的第keyTh个key. key变长之后放不下时分割节点
+func internalNodeReplaceKey(table *Table, pageTh uint32, keyTh uint32, key []byte) error {
+	node, err := getPage(table.Pager, pageTh)
+	if err != nil {
+		return err
+	}
+	children, keys := node.internalNodeEntries()
+	keys[keyTh] = key
+	if !internalNodeFits(keys) {
+		return internalNodeSplit(table, pageTh, children, keys)
+	}
+	node.internalNodeSetEntries(children, keys)
+	return nil
+}
 
-func internalNodeInsert(table *Table, parentPageTh, childPageTh uint32) {
-	// 向父节点添加一个新的子节点指针和key
-	parentNode, err := getPage(table.Pager, parentPageTh)
+// 内部节点分割: children/keys 为修改之后(已超出容量)的完整内容
+func internalNodeSplit(table *Table, pageTh uint32, children []uint32, keys [][]byte) error {
+	oldNode, err := getPinnedPage(table.Pager, pageTh)
+	if err != nil {
+		return err
+	}
+	defer oldNode.unpin()
+	splitTh, err := internalNodeSplitPoint(pageTh, keys)
 	if err != nil {
-		os.Exit(0)
+		return err
 	}
+	newPageTh, err := getUnusedPageTh(table.Pager)
+	if err != nil {
+		return err
+	}
+	newNode, err := getPage(table.Pager, newPageTh)
+	if err != nil {
+		return err
+	}
+	initializeInternalNode(newNode)
+	newNode.LeafNodeSetParent(oldNode.LeafNodeGetParent())
 
-	childNode, err := getPage(table.Pager, childPageTh)
+	// 第splitTh个key上移到父节点, 它左边的留在oldNode, 右边的移动到newNode
+	leftMaxKey := keys[splitTh]
+	oldNode.internalNodeSetEntries(children[:splitTh+1], keys[:splitTh])
+	newNode.internalNodeSetEntries(children[splitTh+1:], keys[splitTh+1:])
+	if err := setChildrenParent(table, children[splitTh+1:], newPageTh); err != nil {
+		return err
+	}
+
+	// 与叶子节点相同: 根节点分割需要创建新的根节点, 否则更新父节点
+	if isNodeRoot(oldNode) {
+		return createNewRoot(table, newPageTh)
+	}
+	return internalNodeInsert(table, oldNode.LeafNodeGetParent(), pageTh, leftMaxKey, newPageTh)
+}
+
+// 选择上移到父节点的key: 两边都能放进一个节点, 并且两边的字节数尽量接近
+func internalNodeSplitPoint(pageTh uint32, keys [][]byte) (int, error) {
+	total := int(internalCellsSize(keys))
+	best, bestDiff := -1, 0
+	for th := range keys {
+		left, right := keys[:th], keys[th+1:]
+		if !internalNodeFits(left) || !internalNodeFits(right) {
+			continue
+		}
+		leftSize := int(internalCellsSize(left))
+		rightSize := total - leftSize - int(internalCellsSize(keys[th:th+1]))
+		diff := max(leftSize-rightSize, rightSize-leftSize)
+		if best < 0 || diff < bestDiff {
+			best, bestDiff = th, diff
+		}
+	}
+	if best < 0 {
+		return 0, corruptPageError(pageTh, fmt.Sprintf("%d keys do not fit in two internal nodes", len(keys)))
+	}
+	return best, nil
+}
+
+// 修改子节点的父节点
+func setChildrenParent(table *Table, children []uint32, parentPageTh uint32) error {
+	for _, childPageTh := range children {
+		childNode, err := getPage(table.Pager, childPageTh)
+		if err != nil {
+			return err
+		}
+		childNode.LeafNodeSetParent(parentPageTh)
+	}
+	return nil
+}
+
+// 节点(子树)中的最大key(副本): 内部节点的最大key位于最右子节点中
+func getNodeMaxKey(pager *Pager, node *Page) ([]byte, error) {
+	for getNodeType(node) == NODE_INTERNAL {
+		var err error
+		node, err = getNode(pager, node.InternalNodeGetRightChild())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return append([]byte{}, node.LeafNodeGetKey(node.LeafNodeGetCellsCount()-1)...), nil
+}
+
+// 删除光标指向的cell, 叶子节点下溢时向兄弟节点借cell或与兄弟节点合并
+func leafNodeDelete(cursor *Cursor) error {
+	table := cursor.Table
+	node, err := getPinnedPage(table.Pager, cursor.PageTh)
 	if err != nil {
-		os.Exit(0)
+		return err
 	}
-	childMaxKey := childNode.GetNodeMaxKey()
+	defer node.unpin()
+	cells := node.LeafNodeCells()
+	if err := leafCellFree(table.Pager, cells[cursor.CellTh]); err != nil {
+		return err
+	}
+	node.LeafNodeSetCells(append(cells[:cursor.CellTh], cells[cursor.CellTh+1:]...))
 
-	// 新cell添加到第index个
-	index := parentNode.internalNodeFindChild(childMaxKey)
+	if isNodeRoot(node) {
+		return nil
+	}
+	if node.leafNodeUsedSpace() < LEAF_NODE_MIN_FILL {
+		return leafNodeRebalance(table, cursor.PageTh)
+	}
+	// 删除的可能是最大的key, 需要更新祖先节点中的key
+	return updateAncestorKeys(table, cursor.PageTh)
+}
 
-	originalKeyCount := parentNode.InternalNodeGetKeyCount()
-	parentNode.InternalNodeSetKeyCount(originalKeyCount + 1)
-	if originalKeyCount >= INTERNAL_NODE_MAX_CELLS {
-		// todo: 分割内部节点
-		fmt.Println("Need to implement splitting internal node")
-		os.Exit(0)
+// 子树的最大key改变之后, 向上更新对应的key. 作为最右子节点时key在更上层的祖先节点中
+func updateAncestorKeys(table *Table, pageTh uint32) error {
+	node, err := getPinnedPage(table.Pager, pageTh)
+	if err != nil {
+		return err
+	}
+	defer node.unpin()
+	maxKey, err := getNodeMaxKey(table.Pager, node)
+	if err != nil {
+		return err
+	}
+	for !isNodeRoot(node) {
+		parentPageTh := node.LeafNodeGetParent()
+		parentNode, err := getNode(table.Pager, parentPageTh)
+		if err != nil {
+			return err
+		}
+		index := parentNode.internalNodeChildIndex(pageTh)
+		if index < parentNode.InternalNodeGetKeyCount() {
+			return internalNodeReplaceKey(table, parentPageTh, index, maxKey)
+		}
+		pageTh, node = parentPageTh, parentNode
 	}
+	return nil
+}
 
-	// 正常添加
+// 选出节点在父节点中相邻的兄弟节点, 优先选择左兄弟. 返回的leftIndex为两者中靠左的节点序号
+func siblingOf(parentNode *Page, pageTh uint32) (siblingPageTh uint32, leftIndex uint32, siblingIsLeft bool) {
+	children, _ := parentNode.internalNodeEntries()
+	index := parentNode.internalNodeChildIndex(pageTh)
+	if index > 0 {
+		return children[index-1], index - 1, true
+	}
+	return children[index+1], index, false
+}
+
+// 从父节点中删除第leftIndex+1个子节点(已被合并进第leftIndex个子节点)
+func internalNodeRemoveMerged(parentNode *Page, leftIndex uint32) {
+	children, keys := parentNode.internalNodeEntries()
+	children = append(children[:leftIndex+1], children[leftIndex+2:]...)
+	keys = append(keys[:leftIndex], keys[leftIndex+1:]...)
+	parentNode.internalNodeSetEntries(children, keys)
+}
 
-	rightChildPageTh := parentNode.InternalNodeGetRightChild()
-	rightChildNode, err := getPage(table.Pager, rightChildPageTh)
+// 叶子节点下溢: 两个节点的cell能放进一个节点时合并, 否则在两个节点之间重新分配
+func leafNodeRebalance(table *Table, pageTh uint32) error {
+	node, err := getPinnedPage(table.Pager, pageTh)
 	if err != nil {
-		os.Exit(0)
+		return err
 	}
+	defer node.unpin()
+	parentPageTh := node.LeafNodeGetParent()
+	parentNode, err := getPinnedNode(table.Pager, parentPageTh)
+	if err != nil {
+		return err
+	}
+	defer parentNode.unpin()
+	siblingPageTh, leftIndex, siblingIsLeft := siblingOf(parentNode, pageTh)
+	sibling, err := getPinnedNode(table.Pager, siblingPageTh)
+	if err != nil {
+		return err
+	}
+	defer sibling.unpin()
 
-	if childMaxKey > rightChildNode.GetNodeMaxKey() {
-		// 如果需要放在最右边
-		parentNode.InternalNodeSetChild(originalKeyCount, rightChildPageTh) // 将原来放在头部的最右子节点移下来
-		parentNode.InternalNodeSetKey(originalKeyCount, rightChildNode.GetNodeMaxKey())
-		parentNode.InternalNodeSetRightChild(childPageTh) // 将新的子节点移动至头部
+	leftNode, rightNode := sibling, node
+	leftPageTh, rightPageTh := siblingPageTh, pageTh
+	if !siblingIsLeft {
+		leftNode, rightNode = node, sibling
+		leftPageTh, rightPageTh = pageTh, siblingPageTh
+	}
+	cells := append(leftNode.LeafNodeCells(), rightNode.LeafNodeCells()...)
 
-	} else {
-		// 需要创建一个新的cell(key+ptr)
-		for i := originalKeyCount; i > index; i-- {
-			// 向右平移
-			destination := parentNode.InternalNodeGetCell(i)
-			source := parentNode.InternalNodeGetCell(i - 1)
-			parentNode.InternalNodeMove(destination, source)
-			// 防止uint32溢出
-			if i == 0 {
-				break
-			}
+	if !leafNodeFits(cells) {
+		// 向兄弟节点借cell: 按字节数重新分配两个节点的cell, 父节点中左边节点的key随之改变
+		splitTh, err := leafNodeSplitPoint(pageTh, cells)
+		if err != nil {
+			return err
+		}
+		leftNode.LeafNodeSetCells(cells[:splitTh])
+		rightNode.LeafNodeSetCells(cells[splitTh:])
+		leftMaxKey, err := getNodeMaxKey(table.Pager, leftNode)
+		if err != nil {
+			return err
+		}
+		if err := internalNodeReplaceKey(table, parentPageTh, leftIndex, leftMaxKey); err != nil {
+			return err
+		}
+		return updateAncestorKeys(table, rightPageTh)
+	}
+
+	// 右边的节点合并进左边的节点
+	leftNode.LeafNodeSetCells(cells)
+	leftNode.LeafNodeSetNextLeaf(rightNode.LeafNodeGetNextLeaf())
+
+	internalNodeRemoveMerged(parentNode, leftIndex)
+	if err := freePage(table.Pager, rightPageTh); err != nil {
+		return err
+	}
+	if leftNode.LeafNodeGetCellsCount() > 0 {
+		if err := updateAncestorKeys(table, leftPageTh); err != nil {
+			return err
+		}
+	}
+	return internalNodeRebalance(table, parentPageTh)
+}
+
+// 内部节点下溢: 与叶子节点相同, 两个节点能放进一个节点时合并, 否则按字节数重新分配. 根节点只剩一个子节点时降低树高
+func internalNodeRebalance(table *Table, pageTh uint32) error {
+	node, err := getPinnedPage(table.Pager, pageTh)
+	if err != nil {
+		return err
+	}
+	defer node.unpin()
+	if isNodeRoot(node) {
+		if node.InternalNodeGetKeyCount() == 0 {
+			return collapseRoot(table)
+		}
+		return nil
+	}
+	if node.internalNodeUsedSpace() >= INTERNAL_NODE_MIN_FILL {
+		return nil
+	}
+
+	parentPageTh := node.LeafNodeGetParent()
+	parentNode, err := getPinnedNode(table.Pager, parentPageTh)
+	if err != nil {
+		return err
+	}
+	defer parentNode.unpin()
+	siblingPageTh, leftIndex, siblingIsLeft := siblingOf(parentNode, pageTh)
+	sibling, err := getPinnedNode(table.Pager, siblingPageTh)
+	if err != nil {
+		return err
+	}
+	defer sibling.unpin()
+
+	leftNode, rightNode := sibling, node
+	leftPageTh, rightPageTh := siblingPageTh, pageTh
+	if !siblingIsLeft {
+		leftNode, rightNode = node, sibling
+		leftPageTh, rightPageTh = pageTh, siblingPageTh
+	}
+	// 父节点中的key就是左边节点的最大key, 下移到两者之间
+	leftChildren, leftKeys := leftNode.internalNodeEntries()
+	rightChildren, rightKeys := rightNode.internalNodeEntries()
+	separatorKey := append([]byte{}, parentNode.InternalNodeGetKey(leftIndex)...)
+	children := append(leftChildren, rightChildren...)
+	keys := append(append(leftKeys, separatorKey), rightKeys...)
+
+	if !internalNodeFits(keys) {
+		// 重新分配两个节点的子节点, 中间的key上移到父节点
+		splitTh, err := internalNodeSplitPoint(pageTh, keys)
+		if err != nil {
+			return err
 		}
-		// 在第index位置插入新的cell
-		parentNode.InternalNodeSetChild(index, childPageTh)
-		parentNode.InternalNodeSetKey(index, childMaxKey)
+		leftNode.internalNodeSetEntries(children[:splitTh+1], keys[:splitTh])
+		rightNode.internalNodeSetEntries(children[splitTh+1:], keys[splitTh+1:])
+		if err := setChildrenParent(table, children[:splitTh+1], leftPageTh); err != nil {
+			return err
+		}
+		if err := setChildrenParent(table, children[splitTh+1:], rightPageTh); err != nil {
+			return err
+		}
+		return internalNodeReplaceKey(table, parentPageTh, leftIndex, keys[splitTh])
+	}
 
+	// 右边的节点合并进左边的节点
+	leftNode.internalNodeSetEntries(children, keys)
+	if err := setChildrenParent(table, rightChildren, leftPageTh); err != nil {
+		return err
+	}
+	internalNodeRemoveMerged(parentNode, leftIndex)
+	if err := freePage(table.Pager, rightPageTh); err != nil {
+		return err
+	}
+	return internalNodeRebalance(table, parentPageTh)
+}
+
+// 根节点只剩下一个子节点: 子节点复制到根节点所在的页面, 树高减一
+func collapseRoot(table *Table) error {
+	root, err := getPinnedPage(table.Pager, table.rootPageCTh)
+	if err != nil {
+		return err
+	}
+	defer root.unpin()
+	childPageTh := root.InternalNodeGetRightChild()
+	child, err := getNode(table.Pager, childPageTh)
+	if err != nil {
+		return err
+	}
+	pageCopy(root, child)
+	setNodeRoot(root, true)
+
+	if getNodeType(root) == NODE_INTERNAL {
+		children, _ := root.internalNodeEntries()
+		for _, childPageTh := range children {
+			childNode, err := getPage(table.Pager, childPageTh)
+			if err != nil {
+				return err
+			}
+			childNode.LeafNodeSetParent(table.rootPageCTh)
+		}
 	}
+	return freePage(table.Pager, childPageTh)
 }
@@ -0,0 +1,285 @@
+package renekton
+
+import (
+	"fmt"
+	"sort"
+)
+
+/*
+对外的数据库API. 一个DB对应一个数据库文件, 文件中可以有多张表, DB不是并发安全的.
+按主键访问的方法中key为主键各列的值, 按主键中列的顺序, 个数不对时返回ErrPrimaryKeyArity.
+主键各列编码之后最多PRIMARY_KEY_MAX_SIZE字节(单列的TEXT主键最多约250字节), 超过时插入返回ErrKeyTooLong
+*/
+
+type Options struct {
+	JournalMode JournalMode // 默认为WAL
+	CacheSize   uint32      // buffer pool最多缓存的页面数, 0表示使用PAGER_MAX_CACHED_PAGES
+}
+
+type DB struct {
+	database *Database
+}
+
+// 打开数据库文件, 文件不存在时创建. opts为nil时全部使用默认值
+func Open(path string, opts *Options) (*DB, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if opts.JournalMode != JOURNAL_MODE_WAL && opts.JournalMode != JOURNAL_MODE_ROLLBACK {
+		return nil, ErrInvalidJournalMode
+	}
+	database, err := dbOpen(path, opts.JournalMode)
+	if err != nil {
+		return nil, err
+	}
+	if opts.CacheSize > 0 {
+		database.Pager.maxCachedPages = opts.CacheSize
+	}
+	return &DB{database: database}, nil
+}
+
+// 关闭数据库: 还没有COMMIT的事务被回滚, 已提交的内容写回数据库文件
+func (db *DB) Close() error {
+	return dbClose(db.database)
+}
+
+// 插入一行, values按表结构中列的顺序
+func (db *DB) Insert(table string, values ...any) error {
+	stmt := &InsertStmt{Table: &Identifier{Name: table}}
+	for i := range values {
+		stmt.Values = append(stmt.Values, &Placeholder{Th: i})
+	}
+	_, err := db.compileAndExec(stmt, len(values), values)
+	return err
+}
+
+// 按主键查找一行, 不存在时返回ErrKeyNotFound
+func (db *DB) Get(table string, key ...any) (*Row, error) {
+	where, err := db.primaryKeyWhere(table, 0, len(key))
+	if err != nil {
+		return nil, err
+	}
+	statement, err := db.compileAndExec(&SelectStmt{Table: &Identifier{Name: table}, Where: where}, len(key), key)
+	if err != nil {
+		return nil, err
+	}
+	if len(statement.Result) == 0 {
+		return nil, ErrKeyNotFound
+	}
+	return statement.Result[0], nil
+}
+
+// 按主键修改一行, values为列名 -> 新值, 没有给出的列不修改. 行不存在时返回ErrKeyNotFound
+func (db *DB) Update(table string, values map[string]any, key ...any) error {
+	stmt := &UpdateStmt{Table: &Identifier{Name: table}}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var args []any
+	for _, name := range names {
+		stmt.Assignments = append(stmt.Assignments, &Assignment{Column: &Identifier{Name: name}, Value: &Placeholder{Th: len(args)}})
+		args = append(args, values[name])
+	}
+	where, err := db.primaryKeyWhere(table, len(args), len(key))
+	if err != nil {
+		return err
+	}
+	stmt.Where = where
+	return db.execByKey(stmt, len(args)+len(key), append(args, key...))
+}
+
+// 按主键删除一行, 行不存在时返回ErrKeyNotFound
+func (db *DB) Delete(table string, key ...any) error {
+	where, err := db.primaryKeyWhere(table, 0, len(key))
+	if err != nil {
+		return err
+	}
+	return db.execByKey(&DeleteStmt{Table: &Identifier{Name: table}, Where: where}, len(key), key)
+}
+
+// 按主键顺序遍历所有行, fn返回false时停止. fn中不能修改数据库
+func (db *DB) Scan(table string, fn func(row *Row) bool) error {
+	statement := &Statement{}
+	if err := compileStatement(&SelectStmt{Table: &Identifier{Name: table}}, 0, nil, db.database, statement); err != nil {
+		return err
+	}
+	return executeSelect(statement, statement.Table, fn)
+}
+
+// 按主键顺序遍历主键在[low, high)之间的行, low和high为主键各列的值, 多列时按第一列, 第二列...的顺序比较.
+// fn返回false时停止. 从low所在的叶子节点开始沿着叶子节点链表读取, 超过high时停止, 只访问范围内的页面.
+// fn中不能修改数据库
+func (db *DB) ScanRange(table string, low, high []any, fn func(row *Row) bool) error {
+	columns, err := db.primaryKey(table, len(low))
+	if err != nil {
+		return err
+	}
+	if len(high) != len(columns) {
+		return primaryKeyArityError(table, len(columns), len(high))
+	}
+	where := Expr(&BinaryExpr{Op: "AND", Left: keyCompare(columns, 0, ">="), Right: keyCompare(columns, len(columns), "<")})
+	if len(columns) > 1 {
+		// 按多列比较的条件不能用来确定扫描的范围, 加上第一列上的条件
+		first := &BetweenExpr{Operand: columns[0], Low: &Placeholder{Th: 0}, High: &Placeholder{Th: len(columns)}}
+		where = &BinaryExpr{Op: "AND", Left: first, Right: where}
+	}
+	statement := &Statement{}
+	if err := compileStatement(&SelectStmt{Table: &Identifier{Name: table}, Where: where}, 2*len(columns), append(append([]any{}, low...), high...), db.database, statement); err != nil {
+		return err
+	}
+	return executeSelect(statement, statement.Table, fn)
+}
+
+func (db *DB) Begin() error {
+	return db.exec(&Statement{SType: STATEMENT_BEGIN})
+}
+
+func (db *DB) Commit() error {
+	return db.exec(&Statement{SType: STATEMENT_COMMIT})
+}
+
+func (db *DB) Rollback() error {
+	return db.exec(&Statement{SType: STATEMENT_ROLLBACK})
+}
+
+func (db *DB) Savepoint(name string) error {
+	return db.exec(&Statement{SType: STATEMENT_SAVEPOINT, SavepointName: name})
+}
+
+func (db *DB) Release(name string) error {
+	return db.exec(&Statement{SType: STATEMENT_RELEASE, SavepointName: name})
+}
+
+func (db *DB) RollbackTo(name string) error {
+	return db.exec(&Statement{SType: STATEMENT_ROLLBACK_TO, SavepointName: name})
+}
+
+// 修改buffer pool最多缓存的页面数
+func (db *DB) SetCacheSize(cacheSize uint32) error {
+	if cacheSize == 0 {
+		return nil
+	}
+	db.database.Pager.maxCachedPages = cacheSize
+	return pagerEvict(db.database.Pager)
+}
+
+// 语句执行的结果: select语句的Rows中的值与Columns一一对应, 写语句的RowsAffected为修改的行数
+type Result struct {
+	Columns      []string
+	Rows         []*Row
+	RowsAffected int64
+}
+
+// 数据库中所有用户创建的表的名字, 不包括内部使用的表
+func (db *DB) Tables() ([]string, error) {
+	var names []string
+	err := executeSelect(&Statement{SType: STATEMENT_SELECT}, db.database.catalog, func(row *Row) bool {
+		name := row.Values[CATALOG_COLUMN_NAME].(string)
+		if row.Values[CATALOG_COLUMN_TYPE] == CATALOG_TYPE_TABLE && !isReservedName(name) {
+			names = append(names, name)
+		}
+		return true
+	})
+	return names, err
+}
+
+// 执行一条SQL语句, args按顺序绑定到语句中的?. select语句返回查询到的行
+func (db *DB) Exec(input string, args ...any) (*Result, error) {
+	statement := &Statement{}
+	if err := prepareStatement(input, db.database, statement, args...); err != nil {
+		return nil, err
+	}
+	if err := db.exec(statement); err != nil {
+		return nil, err
+	}
+	return &Result{Columns: statement.Columns, Rows: statement.Result, RowsAffected: statement.RowsAffected}, nil
+}
+
+func (db *DB) exec(statement *Statement) error {
+	return executeStatement(statement, db.database)
+}
+
+func (db *DB) compileAndExec(stmt Stmt, placeholders int, args []any) (*Statement, error) {
+	statement := &Statement{}
+	if err := compileStatement(stmt, placeholders, args, db.database, statement); err != nil {
+		return nil, err
+	}
+	if err := db.exec(statement); err != nil {
+		return nil, err
+	}
+	return statement, nil
+}
+
+// 执行按主键修改一行的语句, 没有修改任何行时返回ErrKeyNotFound
+func (db *DB) execByKey(stmt Stmt, placeholders int, args []any) error {
+	statement, err := db.compileAndExec(stmt, placeholders, args)
+	if err != nil {
+		return err
+	}
+	if statement.RowsAffected == 0 {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+// WHERE <主键第一列> = ? AND <主键第二列> = ? ..., ?从第th个参数开始, count为调用方给出的值的个数
+func (db *DB) primaryKeyWhere(table string, th int, count int) (Expr, error) {
+	columns, err := db.primaryKey(table, count)
+	if err != nil {
+		return nil, err
+	}
+	var where Expr
+	for i, column := range columns {
+		equal := &BinaryExpr{Op: "=", Left: column, Right: &Placeholder{Th: th + i}}
+		if where == nil {
+			where = equal
+		} else {
+			where = &BinaryExpr{Op: "AND", Left: where, Right: equal}
+		}
+	}
+	return where, nil
+}
+
+// 主键各列与从第th个参数开始的值按顺序比较, op为">="或者"<":
+// (c1 > ? OR c1 = ? AND (c2 > ? OR c2 = ? AND ... cn >= ?))
+func keyCompare(columns []*ColumnRef, th int, op string) Expr {
+	last := len(columns) - 1
+	expr := Expr(&BinaryExpr{Op: op, Left: columns[last], Right: &Placeholder{Th: th + last}})
+	strict := op[:1]
+	for i := last - 1; i >= 0; i-- {
+		expr = &BinaryExpr{Op: "OR",
+			Left: &BinaryExpr{Op: strict, Left: columns[i], Right: &Placeholder{Th: th + i}},
+			Right: &BinaryExpr{Op: "AND",
+				Left:  &BinaryExpr{Op: "=", Left: columns[i], Right: &Placeholder{Th: th + i}},
+				Right: expr,
+			},
+		}
+	}
+	return expr
+}
+
+// 表的主键各列, count与列数不同时返回ErrPrimaryKeyArity
+func (db *DB) primaryKey(table string, count int) ([]*ColumnRef, error) {
+	if err := catalogLoad(db.database); err != nil {
+		return nil, err
+	}
+	found := catalogFindTable(db.database, table)
+	if found == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoSuchTable, table)
+	}
+	schema := found.schema
+	if count != len(schema.PrimaryKey) {
+		return nil, primaryKeyArityError(table, len(schema.PrimaryKey), count)
+	}
+	columns := make([]*ColumnRef, 0, count)
+	for _, th := range schema.PrimaryKey {
+		columns = append(columns, &ColumnRef{Name: schema.Columns[th].Name})
+	}
+	return columns, nil
+}
+
+func primaryKeyArityError(table string, want, got int) error {
+	return fmt.Errorf("%w: table %s has %d primary key columns, got %d values", ErrPrimaryKeyArity, table, want, got)
+}
@@ -0,0 +1,368 @@
+package renekton
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+database/sql驱动, 注册名为"renekton":
+
+	db, err := sql.Open("renekton", "file.db?journal_mode=rollback&cache_size=100")
+
+语句中的?按顺序绑定参数, 参数可以是nil(NULL), 整数, 浮点数, bool, 字符串或[]byte.
+查询结果中NULL为nil, 其它值的类型见value.go.
+同一个数据库文件的所有连接共用一个DB, 同一时间只有一个连接在执行语句;
+事务从Begin开始独占数据库, 直到Commit/Rollback, 其他连接的语句在此期间等待.
+*/
+
+func init() {
+	sql.Register("renekton", &Driver{})
+}
+
+var errDriverTransactionStatement = errors.New("use sql.DB.Begin, Tx.Commit and Tx.Rollback for transactions")
+
+type Driver struct{}
+
+// 同一个数据库文件的所有连接共用的DB, 最后一个连接关闭时关闭DB
+type driverDB struct {
+	db    *DB
+	path  string
+	conns int
+	mu    sync.Mutex // 执行语句或者事务期间持有
+}
+
+var (
+	driverDBsMu sync.Mutex
+	driverDBs   = make(map[string]*driverDB)
+)
+
+// name为数据库文件路径, 可以带参数journal_mode(wal/rollback)和cache_size.
+// 参数只在第一次打开这个文件时生效
+func (d *Driver) Open(name string) (driver.Conn, error) {
+	path, opts, err := parseDSN(name)
+	if err != nil {
+		return nil, err
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	driverDBsMu.Lock()
+	defer driverDBsMu.Unlock()
+	shared, ok := driverDBs[absPath]
+	if !ok {
+		db, err := Open(path, opts)
+		if err != nil {
+			return nil, err
+		}
+		shared = &driverDB{db: db, path: absPath}
+		driverDBs[absPath] = shared
+	}
+	shared.conns++
+	return &conn{shared: shared}, nil
+}
+
+func parseDSN(name string) (string, *Options, error) {
+	path, query, _ := strings.Cut(name, "?")
+	opts := &Options{}
+	if query == "" {
+		return path, opts, nil
+	}
+	for _, param := range strings.Split(query, "&") {
+		key, value, _ := strings.Cut(param, "=")
+		switch key {
+		case "journal_mode":
+			switch value {
+			case "wal":
+				opts.JournalMode = JOURNAL_MODE_WAL
+			case "rollback":
+				opts.JournalMode = JOURNAL_MODE_ROLLBACK
+			default:
+				return "", nil, ErrInvalidJournalMode
+			}
+		case "cache_size":
+			cacheSize, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid cache_size %q: %w", value, err)
+			}
+			opts.CacheSize = uint32(cacheSize)
+		default:
+			return "", nil, fmt.Errorf("unknown parameter %q", key)
+		}
+	}
+	return path, opts, nil
+}
+
+type conn struct {
+	shared *driverDB
+	tx     *tx // 不为nil时这个连接持有shared.mu
+	closed bool
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if c.closed {
+		return nil, driver.ErrBadConn
+	}
+	ast, placeholders, err := parse(query)
+	if err != nil {
+		return nil, err
+	}
+	return &stmt{conn: c, ast: ast, placeholders: placeholders}, nil
+}
+
+// 关闭连接时回滚还没有结束的事务
+func (c *conn) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	var err error
+	if c.tx != nil {
+		err = c.tx.Rollback()
+	}
+
+	driverDBsMu.Lock()
+	defer driverDBsMu.Unlock()
+	c.shared.conns--
+	if c.shared.conns == 0 {
+		delete(driverDBs, c.shared.path)
+		if closeErr := c.shared.db.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if c.closed {
+		return nil, driver.ErrBadConn
+	}
+	if c.tx != nil {
+		return nil, ErrTransactionActive
+	}
+	if opts.ReadOnly || sql.IsolationLevel(opts.Isolation) != sql.LevelDefault {
+		return nil, errors.New("renekton only supports default read-write transactions")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	c.shared.mu.Lock()
+	if err := c.shared.db.Begin(); err != nil {
+		c.shared.mu.Unlock()
+		return nil, err
+	}
+	c.tx = &tx{conn: c}
+	return c.tx, nil
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	ast, placeholders, err := parse(query)
+	if err != nil {
+		return nil, err
+	}
+	statement, err := c.exec(ctx, ast, placeholders, args)
+	if err != nil {
+		return nil, err
+	}
+	return newResult(statement), nil
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	ast, placeholders, err := parse(query)
+	if err != nil {
+		return nil, err
+	}
+	statement, err := c.exec(ctx, ast, placeholders, args)
+	if err != nil {
+		return nil, err
+	}
+	return &rows{columns: statement.Columns, rows: statement.Result}, nil
+}
+
+// 绑定参数并执行一条语句. 事务之外的语句执行期间持有shared.mu
+func (c *conn) exec(ctx context.Context, ast Stmt, placeholders int, args []driver.NamedValue) (*Statement, error) {
+	if c.closed {
+		return nil, driver.ErrBadConn
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	values := make([]any, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, fmt.Errorf("named argument %s is not supported", arg.Name)
+		}
+		values[i] = arg.Value
+	}
+	switch ast := ast.(type) {
+	case *BeginStmt, *CommitStmt:
+		return nil, errDriverTransactionStatement
+	case *RollbackStmt:
+		if ast.Savepoint == nil {
+			return nil, errDriverTransactionStatement
+		}
+	}
+
+	// 编译时需要读取表结构, 同样要持有shared.mu
+	if c.tx == nil {
+		c.shared.mu.Lock()
+		defer c.shared.mu.Unlock()
+	}
+	statement := &Statement{}
+	if err := compileStatement(ast, placeholders, values, c.shared.db.database, statement); err != nil {
+		return nil, err
+	}
+	if err := c.shared.db.exec(statement); err != nil {
+		return nil, err
+	}
+	return statement, nil
+}
+
+type stmt struct {
+	conn         *conn
+	ast          Stmt
+	placeholders int
+}
+
+func (s *stmt) Close() error {
+	return nil
+}
+
+func (s *stmt) NumInput() int {
+	return s.placeholders
+}
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(args))
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(args))
+}
+
+func (s *stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	statement, err := s.conn.exec(ctx, s.ast, s.placeholders, args)
+	if err != nil {
+		return nil, err
+	}
+	return newResult(statement), nil
+}
+
+func (s *stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	statement, err := s.conn.exec(ctx, s.ast, s.placeholders, args)
+	if err != nil {
+		return nil, err
+	}
+	return &rows{columns: statement.Columns, rows: statement.Result}, nil
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return named
+}
+
+// 写语句影响的行数, insert语句的LastInsertId为插入的INTEGER主键
+type result struct {
+	lastInsertId int64
+	rowsAffected int64
+}
+
+func newResult(statement *Statement) *result {
+	switch statement.SType {
+	case STATEMENT_INSERT:
+		schema := statement.Table.schema
+		id, _ := statement.RowToInsert.Values[schema.PrimaryKey[0]].(int64)
+		return &result{lastInsertId: id, rowsAffected: statement.RowsAffected}
+	}
+	return &result{rowsAffected: statement.RowsAffected}
+}
+
+func (r *result) LastInsertId() (int64, error) {
+	return r.lastInsertId, nil
+}
+
+func (r *result) RowsAffected() (int64, error) {
+	return r.rowsAffected, nil
+}
+
+// select的结果在语句执行时全部读出, 遍历期间不持有shared.mu, 其他语句可以修改数据库
+type rows struct {
+	columns []string
+	rows    []*Row
+	th      int
+}
+
+func (r *rows) Columns() []string {
+	return r.columns
+}
+
+func (r *rows) Close() error {
+	r.rows = nil
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if r.th >= len(r.rows) {
+		return io.EOF
+	}
+	row := r.rows[r.th]
+	r.th++
+	for i, value := range row.Values {
+		dest[i] = value
+	}
+	return nil
+}
+
+type tx struct {
+	conn *conn
+}
+
+// 提交失败时回滚, database/sql认为Commit之后事务已经结束
+func (t *tx) Commit() error {
+	if t.conn.tx != t {
+		return ErrNoTransaction
+	}
+	defer t.end()
+	err := t.conn.shared.db.Commit()
+	if err != nil {
+		if rollbackErr := t.conn.shared.db.Rollback(); rollbackErr != nil {
+			err = errors.Join(err, rollbackErr)
+		}
+	}
+	return err
+}
+
+func (t *tx) Rollback() error {
+	if t.conn.tx != t {
+		return ErrNoTransaction
+	}
+	defer t.end()
+	return t.conn.shared.db.Rollback()
+}
+
+func (t *tx) end() {
+	t.conn.tx = nil
+	t.conn.shared.mu.Unlock()
+}
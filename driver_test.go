@@ -0,0 +1,187 @@
+package renekton
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+func testSQLOpen(t *testing.T, dsn string) *sql.DB {
+	t.Helper()
+	sqlDB, err := sql.Open("renekton", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sqlDB
+}
+
+// *sql.DB或者*sql.Tx
+type sqlQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// 用database/sql查询所有行, 返回id -> email
+func querySQLRows(t *testing.T, ctx context.Context, q sqlQueryer) map[uint32]string {
+	t.Helper()
+	rows, err := q.QueryContext(ctx, "select * from users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	got := map[uint32]string{}
+	for rows.Next() {
+		var id int64
+		var userName, email string
+		if err := rows.Scan(&id, &userName, &email); err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprint("user", id); userName != want {
+			t.Fatalf("row %d has username %q, want %q", id, userName, want)
+		}
+		got[uint32(id)] = email
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func checkSQLRows(t *testing.T, ctx context.Context, q sqlQueryer, want map[uint32]string) {
+	t.Helper()
+	got := querySQLRows(t, ctx, q)
+	if len(got) != len(want) {
+		t.Fatalf("%d rows, want %d", len(got), len(want))
+	}
+	for id, email := range want {
+		if got[id] != email {
+			t.Fatalf("row %d has email %q, want %q", id, got[id], email)
+		}
+	}
+}
+
+func checkSQLResult(t *testing.T, result sql.Result, lastInsertId, rowsAffected int64) {
+	t.Helper()
+	if id, err := result.LastInsertId(); err != nil || id != lastInsertId {
+		t.Fatalf("last insert id %d %v, want %d", id, err, lastInsertId)
+	}
+	if n, err := result.RowsAffected(); err != nil || n != rowsAffected {
+		t.Fatalf("rows affected %d %v, want %d", n, err, rowsAffected)
+	}
+}
+
+// ?参数, 写语句的结果, 查询, 事务提交和回滚; 关闭之后重新打开数据不变
+func TestDriver(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test.db")
+	sqlDB := testSQLOpen(t, path+"?journal_mode=rollback&cache_size=10")
+	if _, err := sqlDB.ExecContext(ctx, TEST_TABLE_SQL); err != nil {
+		t.Fatal(err)
+	}
+	want := map[uint32]string{}
+	for id := uint32(1); id <= 30; id++ {
+		result, err := sqlDB.ExecContext(ctx, "insert into users values (?, ?, ?)", testRow(id)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSQLResult(t, result, int64(id), 1)
+		want[id] = testEmail(id)
+	}
+	if _, err := sqlDB.ExecContext(ctx, "insert into users values (?, ?, ?)", 1, "user1", "user1@example.com"); !errors.Is(err, ErrDuplicateKey) {
+		t.Fatalf("duplicate insert: %v", err)
+	}
+	if _, err := sqlDB.ExecContext(ctx, "insert into users values (?, ?, ?)", 31, "user31"); err == nil {
+		t.Fatal("insert with a missing argument succeeded")
+	}
+	// NaN参数是错误, 不会被当作NULL
+	for _, query := range []string{"insert into users values (31, 'user31', ?)", "select id from users where email = ?"} {
+		if _, err := sqlDB.ExecContext(ctx, query, math.NaN()); !errors.Is(err, ErrSyntax) {
+			t.Fatalf("%s with NaN: %v", query, err)
+		}
+	}
+
+	result, err := sqlDB.ExecContext(ctx, "update users set email = ? where id = ?", "two@example.com", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSQLResult(t, result, 0, 1)
+	want[2] = "two@example.com"
+	result, err = sqlDB.ExecContext(ctx, "delete from users where id = ?", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSQLResult(t, result, 0, 1)
+	delete(want, 3)
+	// 不存在的行不是错误, 修改的行数为0
+	for _, query := range []string{"delete from users where id = ?", "update users set email = 'x' where id = ?"} {
+		result, err = sqlDB.ExecContext(ctx, query, 3)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		checkSQLResult(t, result, 0, 0)
+	}
+	checkSQLRows(t, ctx, sqlDB, want)
+
+	// 回滚的事务没有任何效果, 提交的事务对其他连接可见
+	tx, err := sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.ExecContext(ctx, "insert into users values (?, ?, ?)", 40, "user40", "user40@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.ExecContext(ctx, "delete from users where id = ?", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	checkSQLRows(t, ctx, sqlDB, want)
+
+	tx, err = sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.ExecContext(ctx, "insert into users values (?, ?, ?)", 40, "user40", "user40@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	want[40] = "user40@example.com"
+	if _, err := tx.ExecContext(ctx, "delete from users where id = ?", 1); err != nil {
+		t.Fatal(err)
+	}
+	delete(want, 1)
+	checkSQLRows(t, ctx, tx, want)
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); !errors.Is(err, sql.ErrTxDone) {
+		t.Fatalf("second commit: %v", err)
+	}
+	checkSQLRows(t, ctx, sqlDB, want)
+
+	// NULL列: 没有给出的列和nil参数都是NULL, Scan到sql.NullString
+	if _, err := sqlDB.ExecContext(ctx, "insert into users (id, username) values (?, ?)", 50, nil); err != nil {
+		t.Fatal(err)
+	}
+	var userName, email sql.NullString
+	var id int64
+	if err := sqlDB.QueryRowContext(ctx, "select id, username, email from users where email is null").Scan(&id, &userName, &email); err != nil {
+		t.Fatal(err)
+	}
+	if id != 50 || userName.Valid || email.Valid {
+		t.Fatalf("row %d has username %v, email %v, want NULL", id, userName, email)
+	}
+	if _, err := sqlDB.ExecContext(ctx, "delete from users where id = ?", 50); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlDB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sqlDB = testSQLOpen(t, path)
+	defer sqlDB.Close()
+	checkSQLRows(t, ctx, sqlDB, want)
+}
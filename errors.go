@@ -0,0 +1,70 @@
+package renekton
+
+import (
+	"errors"
+	"fmt"
+)
+
+// 对外返回的错误, 调用方可以用errors.Is判断
+var (
+	// 存储层的错误, 具体原因包装在其中
+	ErrPageOutOfRange = errors.New("page number out of range")
+	ErrCorruptPage    = errors.New("corrupt page")
+	ErrIO             = errors.New("i/o error")
+
+	ErrStringTooLong = errors.New("string is too long for the column")
+	ErrNotNull       = errors.New("NOT NULL constraint failed")
+	ErrSyntax        = errors.New("could not parse statement")
+	ErrNoSuchTable   = errors.New("no such table")
+	ErrNoSuchColumn  = errors.New("no such column")
+	ErrTableExists   = errors.New("table already exists")
+	ErrIndexExists   = errors.New("index already exists")
+	ErrNoSuchIndex   = errors.New("no such index")
+
+	ErrTableFull          = errors.New("table full")
+	ErrDuplicateKey       = errors.New("duplicate key")
+	ErrUniqueViolation    = errors.New("UNIQUE constraint failed")
+	ErrKeyNotFound        = errors.New("key not found")
+	ErrKeyTooLong         = errors.New("key is too long")
+	ErrPrimaryKeyArity    = errors.New("wrong number of primary key values")
+	ErrTransactionActive  = errors.New("cannot begin a transaction within a transaction")
+	ErrNoTransaction      = errors.New("no transaction is active")
+	ErrNoSuchSavepoint    = errors.New("no such savepoint")
+	ErrExecuteFailed      = errors.New("execute failed")
+	ErrInvalidJournalMode = errors.New("journal mode must be wal or rollback")
+)
+
+// 解析或者语义检查时出错, Pos为出错的token在输入中的字节偏移.
+// Err为具体的错误类型(ErrSyntax, ErrNoSuchTable...), 调用方可以用errors.Is判断
+type SQLError struct {
+	Err  error
+	Pos  int
+	Near string
+	Msg  string
+}
+
+func (e *SQLError) Error() string {
+	message := e.Err.Error()
+	if e.Msg != "" {
+		message += ": " + e.Msg
+	}
+	message += fmt.Sprintf(" at position %d", e.Pos+1)
+	if e.Near != "" {
+		message += fmt.Sprintf(" near %q", e.Near)
+	}
+	return message
+}
+
+func (e *SQLError) Unwrap() error {
+	return e.Err
+}
+
+// 读写文件失败
+func ioError(op string, err error) error {
+	return fmt.Errorf("%w: %s: %w", ErrIO, op, err)
+}
+
+// 页面内容与预期的格式不符
+func corruptPageError(pageTh uint32, reason string) error {
+	return fmt.Errorf("%w: page %d: %s", ErrCorruptPage, pageTh, reason)
+}
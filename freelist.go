@@ -0,0 +1,141 @@
+package renekton
+
+import "fmt"
+
+/*
+空闲页面链表:
+文件头记录第一个trunk页面, 每个trunk页面保存下一个trunk页面的序号以及若干空闲页面的序号.
+删除/合并节点时回收的页面加入链表, 申请新页面时优先从链表中取.
+*/
+
+/*
+ * Freelist Trunk Layout
+ */
+const (
+	FREELIST_TRUNK_NEXT_SIZE   = uint32(4)
+	FREELIST_TRUNK_NEXT_OFFSET = uint32(0)
+
+	FREELIST_TRUNK_COUNT_SIZE   = uint32(4)
+	FREELIST_TRUNK_COUNT_OFFSET = FREELIST_TRUNK_NEXT_OFFSET + FREELIST_TRUNK_NEXT_SIZE
+
+	FREELIST_TRUNK_HEADER_SIZE = FREELIST_TRUNK_NEXT_SIZE + FREELIST_TRUNK_COUNT_SIZE
+
+	FREELIST_TRUNK_ENTRY_SIZE  = uint32(4)
+	FREELIST_TRUNK_MAX_ENTRIES = (PAGE_SIZE - FREELIST_TRUNK_HEADER_SIZE) / FREELIST_TRUNK_ENTRY_SIZE
+)
+
+func (p *Page) FreelistTrunkGetNext() uint32 {
+	offset := FREELIST_TRUNK_NEXT_OFFSET
+	return ByteToNumber((*p.data)[offset : offset+FREELIST_TRUNK_NEXT_SIZE])
+}
+
+func (p *Page) FreelistTrunkSetNext(pageTh uint32) {
+	offset := FREELIST_TRUNK_NEXT_OFFSET
+	pageThByte := NumberToByte(pageTh)
+	p.markDirty()
+	copy((*p.data)[offset:offset+FREELIST_TRUNK_NEXT_SIZE], pageThByte[:])
+}
+
+func (p *Page) FreelistTrunkGetCount() uint32 {
+	offset := FREELIST_TRUNK_COUNT_OFFSET
+	return ByteToNumber((*p.data)[offset : offset+FREELIST_TRUNK_COUNT_SIZE])
+}
+
+func (p *Page) FreelistTrunkSetCount(count uint32) {
+	offset := FREELIST_TRUNK_COUNT_OFFSET
+	countByte := NumberToByte(count)
+	p.markDirty()
+	copy((*p.data)[offset:offset+FREELIST_TRUNK_COUNT_SIZE], countByte[:])
+}
+
+func (p *Page) FreelistTrunkGetEntry(entryTh uint32) uint32 {
+	offset := FREELIST_TRUNK_HEADER_SIZE + entryTh*FREELIST_TRUNK_ENTRY_SIZE
+	return ByteToNumber((*p.data)[offset : offset+FREELIST_TRUNK_ENTRY_SIZE])
+}
+
+func (p *Page) FreelistTrunkSetEntry(entryTh uint32, pageTh uint32) {
+	offset := FREELIST_TRUNK_HEADER_SIZE + entryTh*FREELIST_TRUNK_ENTRY_SIZE
+	pageThByte := NumberToByte(pageTh)
+	p.markDirty()
+	copy((*p.data)[offset:offset+FREELIST_TRUNK_ENTRY_SIZE], pageThByte[:])
+}
+
+// 回收页面: 放入当前trunk页面, trunk已满(或没有trunk)时该页面成为新的trunk
+func freePage(pager *Pager, pageTh uint32) error {
+	header, err := getPinnedPage(pager, HEADER_PAGE_TH)
+	if err != nil {
+		return err
+	}
+	defer header.unpin()
+	header.HeaderSetFreePagesCount(header.HeaderGetFreePagesCount() + 1)
+
+	trunkPageTh := header.HeaderGetFreelistTrunk()
+	if trunkPageTh != 0 {
+		trunk, err := getPage(pager, trunkPageTh)
+		if err != nil {
+			return err
+		}
+		entryCount := trunk.FreelistTrunkGetCount()
+		if entryCount < FREELIST_TRUNK_MAX_ENTRIES {
+			trunk.FreelistTrunkSetEntry(entryCount, pageTh)
+			trunk.FreelistTrunkSetCount(entryCount + 1)
+			return nil
+		}
+	}
+
+	page, err := getPage(pager, pageTh)
+	if err != nil {
+		return err
+	}
+	page.markDirty()
+	*page.data = make([]byte, PAGE_SIZE)
+	page.FreelistTrunkSetNext(trunkPageTh)
+	page.FreelistTrunkSetCount(0)
+	header.HeaderSetFreelistTrunk(pageTh)
+	return nil
+}
+
+// 从空闲链表中取出一个页面, 取出的页面内容被清零. 链表为空时返回false
+func freelistPop(pager *Pager) (uint32, bool, error) {
+	header, err := getPinnedPage(pager, HEADER_PAGE_TH)
+	if err != nil {
+		return 0, false, err
+	}
+	defer header.unpin()
+	trunkPageTh := header.HeaderGetFreelistTrunk()
+	if trunkPageTh == 0 {
+		return 0, false, nil
+	}
+	if trunkPageTh >= pager.pagesCount {
+		return 0, false, corruptPageError(HEADER_PAGE_TH, fmt.Sprintf("freelist trunk %d out of range", trunkPageTh))
+	}
+	trunk, err := getPage(pager, trunkPageTh)
+	if err != nil {
+		return 0, false, err
+	}
+
+	pageTh := trunkPageTh
+	entryCount := trunk.FreelistTrunkGetCount()
+	if entryCount > FREELIST_TRUNK_MAX_ENTRIES {
+		return 0, false, corruptPageError(trunkPageTh, "freelist trunk count exceeds max")
+	}
+	if entryCount > 0 {
+		pageTh = trunk.FreelistTrunkGetEntry(entryCount - 1)
+		if pageTh == HEADER_PAGE_TH || pageTh >= pager.pagesCount {
+			return 0, false, corruptPageError(trunkPageTh, fmt.Sprintf("free page %d out of range", pageTh))
+		}
+		trunk.FreelistTrunkSetCount(entryCount - 1)
+	} else {
+		// trunk中没有空闲页面了, trunk页面本身被取出
+		header.HeaderSetFreelistTrunk(trunk.FreelistTrunkGetNext())
+	}
+	header.HeaderSetFreePagesCount(header.HeaderGetFreePagesCount() - 1)
+
+	page, err := getPage(pager, pageTh)
+	if err != nil {
+		return 0, false, err
+	}
+	page.markDirty()
+	*page.data = make([]byte, PAGE_SIZE)
+	return pageTh, true, nil
+}
@@ -0,0 +1,164 @@
+package renekton
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+// 文件的长度, 不存在时为0
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+// 文件头中记录的空闲页面数
+func freePagesCount(t *testing.T, db *DB) uint32 {
+	t.Helper()
+	header, err := getPage(db.database.Pager, HEADER_PAGE_TH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return header.HeaderGetFreePagesCount()
+}
+
+// 反复插入再全部删除: 删除时回收的页面都在空闲链表中, 再次插入时被重新使用, 页面数和文件长度不变
+func TestFreelistChurn(t *testing.T) {
+	db, path := testOpen(t, JOURNAL_MODE_WAL, 0)
+	ids := rand.New(rand.NewSource(3)).Perm(50)
+	// 空表使用的页面: 文件头, 根节点等
+	used := db.database.Pager.pagesCount - freePagesCount(t, db)
+	churn := func() {
+		t.Helper()
+		model := map[uint32]string{}
+		for _, id := range ids {
+			testInsert(t, db, model, uint32(id))
+		}
+		checkRows(t, db, model)
+		for _, id := range ids {
+			testDelete(t, db, model, uint32(id))
+		}
+		checkRows(t, db, model)
+		// 除了空表使用的页面, 所有页面都是空闲的
+		if free := freePagesCount(t, db); free != db.database.Pager.pagesCount-used {
+			t.Fatalf("%d free pages of %d", free, db.database.Pager.pagesCount)
+		}
+	}
+
+	churn()
+	pagesCount := db.database.Pager.pagesCount
+	for round := 0; round < 3; round++ {
+		churn()
+		if db.database.Pager.pagesCount != pagesCount {
+			t.Fatalf("round %d: %d pages, want %d", round, db.database.Pager.pagesCount, pagesCount)
+		}
+	}
+	db.Close()
+	size := fileSize(t, path)
+	if size != int64(pagesCount*PAGE_SIZE) {
+		t.Fatalf("file size %d, want %d", size, pagesCount*PAGE_SIZE)
+	}
+
+	// 空闲链表保存在文件中, 重新打开之后仍然被使用
+	db = testReopen(t, path, JOURNAL_MODE_WAL)
+	churn()
+	if db.database.Pager.pagesCount != pagesCount {
+		t.Fatalf("after reopen: %d pages, want %d", db.database.Pager.pagesCount, pagesCount)
+	}
+	db.Close()
+	if got := fileSize(t, path); got != size {
+		t.Fatalf("after reopen: file size %d, want %d", got, size)
+	}
+}
+
+// 长行的溢出页面在删除行或者行变短时回收, 再次插入长行时被重新使用
+func TestFreelistOverflow(t *testing.T) {
+	db, _ := testOpen(t, JOURNAL_MODE_WAL, 0)
+	defer db.Close()
+	pager := db.database.Pager
+	used := pager.pagesCount - freePagesCount(t, db)
+	long := strings.Repeat("x", int(OVERFLOW_DATA_SIZE)*4)
+	model := map[uint32]string{}
+	insertLong := func() {
+		t.Helper()
+		for id := uint32(0); id < 20; id++ {
+			if err := db.Insert("users", int64(id), fmt.Sprint("user", id), long); err != nil {
+				t.Fatal(err)
+			}
+			model[id] = long
+		}
+		checkRows(t, db, model)
+	}
+
+	insertLong()
+	pagesCount := pager.pagesCount
+	if pagesCount < used+20*4 {
+		t.Fatalf("%d pages, rows are not stored in overflow pages", pagesCount)
+	}
+	// 每行变短之后至少回收4个溢出页面
+	for id := uint32(0); id < 20; id += 2 {
+		testUpdate(t, db, model, id, "short")
+	}
+	if free := freePagesCount(t, db); free < 10*4 {
+		t.Fatalf("%d free pages after shortening rows", free)
+	}
+	for id := uint32(0); id < 20; id++ {
+		testDelete(t, db, model, id)
+	}
+	checkRows(t, db, model)
+	if free := freePagesCount(t, db); free != pager.pagesCount-used {
+		t.Fatalf("%d free pages of %d", free, pager.pagesCount)
+	}
+
+	insertLong()
+	if pager.pagesCount != pagesCount {
+		t.Fatalf("%d pages after reinserting, want %d", pager.pagesCount, pagesCount)
+	}
+}
+
+// DROP INDEX回收索引的B+树的所有页面, 再次建立索引时被重新使用
+func TestFreelistDropIndex(t *testing.T) {
+	db, _ := testOpenIndexed(t, JOURNAL_MODE_WAL)
+	defer db.Close()
+	pager := db.database.Pager
+	check(t, db.Begin())
+	for id := 0; id < 500; id++ {
+		check(t, db.Insert("t", int64(id), fmt.Sprintf("%0200d", id), "v"))
+	}
+	check(t, db.Commit())
+	_, depth := checkBtree(t, testTable(t, db, "t").indexes[0].btree)
+	if depth < 1 {
+		t.Fatalf("index depth %d", depth)
+	}
+
+	_, err := db.Exec("drop index t_k")
+	check(t, err)
+	pagesCount, free := pager.pagesCount, freePagesCount(t, db)
+	_, err = db.Exec("create index t_k on t (k)")
+	check(t, err)
+	checkIndexes(t, testTable(t, db, "t"))
+	if pager.pagesCount != pagesCount {
+		t.Fatalf("%d pages after creating the index again, want %d", pager.pagesCount, pagesCount)
+	}
+	// 500个200字节的key至少需要20多个页面
+	indexPages := free - freePagesCount(t, db)
+	if indexPages < 20 {
+		t.Fatalf("index uses %d pages", indexPages)
+	}
+	_, err = db.Exec("drop index t_k")
+	check(t, err)
+	if got := freePagesCount(t, db); got != free {
+		t.Fatalf("%d free pages after drop, want %d (index used %d pages)", got, free, indexPages)
+	}
+}
@@ -1,122 +1,408 @@
-package main
+package renekton
 
-import "C"
 import (
-	"bufio"
-	"errors"
 	"fmt"
-	"os"
-	"strconv"
+	"math"
 	"strings"
 )
 
-const (
-	COLUMN_USERNAME_SIZE = 32
-	COLUMN_EMAIL_SIZE    = 255
-)
-
-type MetaCommandResult int
-type PrepareResult int
 type StatementType int
 
-const (
-	META_COMMAND_SUCCESS MetaCommandResult = iota
-	META_COMMAND_EXIT
-	META_COMMAND_UNRECOGNIZED_COMMAND
-)
-const (
-	PREPARE_SUCCESS PrepareResult = iota
-	PREPARE_NEGATIVE_ID
-	PREPARE_STRING_TOO_LONG
-	PREPARE_UNRECOGNIZED_STATEMENT
-	PREPARE_SYNTAX_ERROR
-)
 const (
 	STATEMENT_INSERT StatementType = iota
 	STATEMENT_SELECT
+	STATEMENT_DELETE
+	STATEMENT_UPDATE
+	STATEMENT_BEGIN
+	STATEMENT_COMMIT
+	STATEMENT_ROLLBACK
+	STATEMENT_SAVEPOINT
+	STATEMENT_RELEASE
+	STATEMENT_ROLLBACK_TO
+	STATEMENT_CREATE_TABLE
+	STATEMENT_CREATE_INDEX
+	STATEMENT_DROP_INDEX
 )
 
+// 一行数据, Values按表结构中列的顺序, 值的表示见value.go
 type Row struct {
-	Id       uint32
-	UserName []byte
-	Email    []byte
-}
-
-func printRow(row *Row) {
-	fmt.Println(row.Id)
-	fmt.Println(row.UserName)
-	fmt.Println(row.Email)
+	Values []Value
 }
 
 type Statement struct {
-	SType       StatementType
-	RowToInsert Row // 仅适用于insert语句
-}
+	SType          StatementType
+	Table          *Table              // 语句访问的表
+	SchemaToCreate *Schema             // 仅适用于create table语句
+	IndexToCreate  *Index              // 仅适用于create index语句
+	IndexToDrop    *Index              // 仅适用于drop index语句
+	RowToInsert    Row                 // 仅适用于insert语句
+	AssignRowId    bool                // 仅适用于insert语句, 没有给出INTEGER主键, 执行时分配
+	Assignments    map[int]any         // 仅适用于update语句, 列序号 -> 新值
+	Where          func(row *Row) bool // 仅适用于select/update/delete语句, nil表示所有行
+	KeyRange       *KeyRange           // 仅适用于select/update/delete语句, 从WHERE中提取的主键或者索引的范围, nil表示从头遍历
+	ResultColumns  []int               // 仅适用于select语句, 查询的列序号
+
+	SavepointName string // 仅适用于savepoint/release/rollback to语句
 
-type InputBuffer struct {
-	buffer       string
-	bufferLength int
-	inputLength  int
+	Columns      []string // select语句结果的列名
+	Result       []*Row   // select语句查询到的行, 只包含ResultColumns中的列
+	RowsAffected int64    // insert/update/delete语句修改的行数
 }
 
-func newInputBuffer() *InputBuffer {
-	return &InputBuffer{
-		"",
-		0,
-		0,
+// 解析一条语句并生成Statement, args按顺序绑定到语句中的?, 可以是整数, string或[]byte
+func prepareStatement(input string, database *Database, statement *Statement, args ...any) error {
+	stmt, placeholders, err := parse(input)
+	if err != nil {
+		return err
 	}
+	return compileStatement(stmt, placeholders, args, database, statement)
 }
-func prepareStatement(inputBuffer *InputBuffer, statement *Statement) PrepareResult {
-	if strings.Contains(inputBuffer.buffer, "insert") {
+
+// 检查语法树的语义(表名, 列名, 类型)并生成Statement, 表结构从系统表中读取
+func compileStatement(stmt Stmt, placeholders int, args []any, database *Database, statement *Statement) error {
+	if len(args) != placeholders {
+		return fmt.Errorf("%w: %d arguments for %d placeholders", ErrSyntax, len(args), placeholders)
+	}
+	if err := catalogLoad(database); err != nil {
+		return err
+	}
+	compiler := &Compiler{args: args, database: database}
+	switch stmt := stmt.(type) {
+	case *CreateTableStmt:
+		statement.SType = STATEMENT_CREATE_TABLE
+		// 已经存在的内部表在执行时报告ErrTableExists
+		if isReservedName(stmt.Name.Name) && catalogFindTable(database, stmt.Name.Name) == nil {
+			return &SQLError{Err: ErrSyntax, Pos: stmt.Name.Pos, Near: stmt.Name.Name, Msg: "table name is reserved"}
+		}
+		schema, err := schemaFromCreateTable(stmt)
+		if err != nil {
+			return err
+		}
+		statement.SchemaToCreate = schema
+	case *CreateIndexStmt:
+		statement.SType = STATEMENT_CREATE_INDEX
+		return compiler.compileCreateIndex(stmt, statement)
+	case *DropIndexStmt:
+		statement.SType = STATEMENT_DROP_INDEX
+		index := database.indexes[strings.ToLower(stmt.Name.Name)]
+		if index == nil {
+			return &SQLError{Err: ErrNoSuchIndex, Pos: stmt.Name.Pos, Near: stmt.Name.Name}
+		}
+		if isAutoindex(index.Name) {
+			return &SQLError{Err: ErrSyntax, Pos: stmt.Name.Pos, Near: stmt.Name.Name, Msg: "index associated with UNIQUE constraint cannot be dropped"}
+		}
+		statement.IndexToDrop = index
+	case *InsertStmt:
 		statement.SType = STATEMENT_INSERT
-		args := strings.Split(inputBuffer.buffer, " ")
-		if len(args) !=  4 {
-			return PREPARE_SYNTAX_ERROR
-		}
-		defer func() {
-			if err := recover(); err != nil {
-			}
-		}()
-		idInt32, err := strconv.Atoi(args[1])
+		return compiler.compileInsert(stmt, statement)
+	case *SelectStmt:
+		statement.SType = STATEMENT_SELECT
+		return compiler.compileSelect(stmt, statement)
+	case *UpdateStmt:
+		statement.SType = STATEMENT_UPDATE
+		return compiler.compileUpdate(stmt, statement)
+	case *DeleteStmt:
+		statement.SType = STATEMENT_DELETE
+		return compiler.compileDelete(stmt, statement)
+	case *BeginStmt:
+		statement.SType = STATEMENT_BEGIN
+	case *CommitStmt:
+		statement.SType = STATEMENT_COMMIT
+	case *RollbackStmt:
+		statement.SType = STATEMENT_ROLLBACK
+		if stmt.Savepoint != nil {
+			statement.SType = STATEMENT_ROLLBACK_TO
+			statement.SavepointName = stmt.Savepoint.Name
+		}
+	case *SavepointStmt:
+		statement.SType = STATEMENT_SAVEPOINT
+		statement.SavepointName = stmt.Name.Name
+	case *ReleaseStmt:
+		statement.SType = STATEMENT_RELEASE
+		statement.SavepointName = stmt.Name.Name
+	default:
+		return fmt.Errorf("%w: unsupported statement %T", ErrSyntax, stmt)
+	}
+	return nil
+}
+
+type Compiler struct {
+	args     []any
+	database *Database
+	schema   *Schema // 语句访问的表的结构
+}
+
+func (c *Compiler) compileInsert(stmt *InsertStmt, statement *Statement) error {
+	schema, err := c.checkTable(stmt.Table, true, statement)
+	if err != nil {
+		return err
+	}
+	columns := stmt.Columns
+	if len(columns) == 0 {
+		for _, column := range schema.Columns {
+			columns = append(columns, &Identifier{Name: column.Name, Pos: stmt.Table.Pos})
+		}
+	}
+	if len(columns) != len(stmt.Values) {
+		return &SQLError{Err: ErrSyntax, Pos: stmt.Values[0].Position(),
+			Msg: fmt.Sprintf("%d values for %d columns", len(stmt.Values), len(columns))}
+	}
+
+	// 没有给出的列为NULL
+	row := &statement.RowToInsert
+	row.Values = make([]Value, len(schema.Columns))
+	seen := make([]bool, len(schema.Columns))
+	for i, identifier := range columns {
+		th, err := c.column(identifier)
 		if err != nil {
-			fmt.Println("strconv id error ", err)
-			return PREPARE_SYNTAX_ERROR
+			return err
+		}
+		if seen[th] {
+			return &SQLError{Err: ErrSyntax, Pos: identifier.Pos, Near: identifier.Name, Msg: "duplicate column"}
 		}
-		if idInt32 < 0 {
-			return PREPARE_NEGATIVE_ID
+		seen[th] = true
+		value, err := c.columnValue(stmt.Values[i], th)
+		if err != nil {
+			return err
 		}
-		if len(args[2]) > COLUMN_USERNAME_SIZE {
-			return PREPARE_STRING_TOO_LONG
+		row.Values[th] = value
+	}
+	for _, th := range schema.PrimaryKey {
+		if !seen[th] && th == schema.rowIdColumn() {
+			statement.AssignRowId = true
+		} else if !seen[th] {
+			return &SQLError{Err: ErrSyntax, Pos: stmt.Table.Pos, Near: stmt.Table.Name,
+				Msg: fmt.Sprintf("primary key %s is required", schema.Columns[th].Name)}
 		}
-		if len(args[3]) > COLUMN_EMAIL_SIZE {
-			return PREPARE_STRING_TOO_LONG
+	}
+	for th, column := range schema.Columns {
+		if !seen[th] && column.NotNull && !column.PrimaryKey {
+			return &SQLError{Err: ErrNotNull, Pos: stmt.Table.Pos, Near: stmt.Table.Name, Msg: schema.Name + "." + column.Name}
 		}
+	}
+	return nil
+}
 
-		statement.RowToInsert.Id = uint32(idInt32)
-		statement.RowToInsert.UserName = []byte(args[2])
-		statement.RowToInsert.Email = []byte(args[3])
-		return PREPARE_SUCCESS
-	} else if strings.Contains(inputBuffer.buffer, "select") {
-		statement.SType = STATEMENT_SELECT
-		return PREPARE_SUCCESS
+func (c *Compiler) compileSelect(stmt *SelectStmt, statement *Statement) error {
+	schema, err := c.checkTable(stmt.Table, false, statement)
+	if err != nil {
+		return err
+	}
+	if len(stmt.Columns) == 0 {
+		for th, column := range schema.Columns {
+			statement.ResultColumns = append(statement.ResultColumns, th)
+			statement.Columns = append(statement.Columns, column.Name)
+		}
 	}
-	return PREPARE_UNRECOGNIZED_STATEMENT
+	for _, identifier := range stmt.Columns {
+		th, err := c.column(identifier)
+		if err != nil {
+			return err
+		}
+		statement.ResultColumns = append(statement.ResultColumns, th)
+		statement.Columns = append(statement.Columns, schema.Columns[th].Name)
+	}
+	return c.compileFilter(stmt.Where, statement)
 }
 
-func printPrompt() {
-	fmt.Println("这是一段提示语")
+// select/update/delete语句的WHERE条件和key的范围, 没有WHERE时访问所有行
+func (c *Compiler) compileFilter(where Expr, statement *Statement) error {
+	if where == nil {
+		return nil
+	}
+	var err error
+	if statement.Where, err = c.compileWhere(where); err != nil {
+		return err
+	}
+	statement.KeyRange = c.keyRange(where, statement.Table.indexes)
+	return nil
 }
 
-func readInput(inputBuffer *InputBuffer) error {
-	reader := bufio.NewReader(os.Stdin)
-	input, _ := reader.ReadString('\n')
-	input = strings.TrimSpace(input)
-	fmt.Println("收到的指令为： ", input)
-	if len(input) == 0 {
-		fmt.Println("未读到您输入的指令")
-		return errors.New("no input")
+func (c *Compiler) compileCreateIndex(stmt *CreateIndexStmt, statement *Statement) error {
+	if _, err := c.checkTable(stmt.Table, true, statement); err != nil {
+		return err
 	}
-	inputBuffer.inputLength = len(input) - 1
-	inputBuffer.buffer = input
+	th, err := c.column(stmt.Column)
+	if err != nil {
+		return err
+	}
+	if isReservedName(stmt.Name.Name) {
+		return &SQLError{Err: ErrSyntax, Pos: stmt.Name.Pos, Near: stmt.Name.Name, Msg: "index name is reserved"}
+	}
+	statement.IndexToCreate = &Index{Name: stmt.Name.Name, Column: th, Unique: stmt.Unique, SQL: stmt.SQL}
 	return nil
 }
+
+// UNIQUE列自动创建的索引
+func isAutoindex(name string) bool {
+	return strings.HasPrefix(strings.ToLower(name), CATALOG_AUTOINDEX_PREFIX)
+}
+
+// 内部使用的表和索引
+func isReservedName(name string) bool {
+	return strings.HasPrefix(strings.ToLower(name), CATALOG_RESERVED_PREFIX)
+}
+
+func (c *Compiler) compileUpdate(stmt *UpdateStmt, statement *Statement) error {
+	schema, err := c.checkTable(stmt.Table, true, statement)
+	if err != nil {
+		return err
+	}
+	statement.Assignments = make(map[int]Value)
+	for _, assignment := range stmt.Assignments {
+		identifier := assignment.Column
+		th, err := c.column(identifier)
+		if err != nil {
+			return err
+		}
+		if schema.Columns[th].PrimaryKey {
+			return &SQLError{Err: ErrSyntax, Pos: identifier.Pos, Near: identifier.Name, Msg: "cannot update the primary key"}
+		}
+		if _, ok := statement.Assignments[th]; ok {
+			return &SQLError{Err: ErrSyntax, Pos: identifier.Pos, Near: identifier.Name, Msg: "duplicate column"}
+		}
+		value, err := c.columnValue(assignment.Value, th)
+		if err != nil {
+			return err
+		}
+		statement.Assignments[th] = value
+	}
+	return c.compileFilter(stmt.Where, statement)
+}
+
+func (c *Compiler) compileDelete(stmt *DeleteStmt, statement *Statement) error {
+	if _, err := c.checkTable(stmt.Table, true, statement); err != nil {
+		return err
+	}
+	return c.compileFilter(stmt.Where, statement)
+}
+
+// 按表名找到语句访问的表, 系统表只能查询
+func (c *Compiler) checkTable(identifier *Identifier, write bool, statement *Statement) (*Schema, error) {
+	table := catalogFindTable(c.database, identifier.Name)
+	if table == nil {
+		return nil, &SQLError{Err: ErrNoSuchTable, Pos: identifier.Pos, Near: identifier.Name}
+	}
+	if write && table == c.database.catalog {
+		return nil, &SQLError{Err: ErrSyntax, Pos: identifier.Pos, Near: identifier.Name, Msg: "table may not be modified"}
+	}
+	statement.Table = table
+	c.schema = table.schema
+	return c.schema, nil
+}
+
+// 列名对应的列序号
+func (c *Compiler) column(identifier *Identifier) (int, error) {
+	th := c.schema.columnIndex(identifier.Name)
+	if th < 0 {
+		return 0, &SQLError{Err: ErrNoSuchColumn, Pos: identifier.Pos, Near: identifier.Name}
+	}
+	return th, nil
+}
+
+// 字面量或者?绑定的值
+func (c *Compiler) value(expr Expr) (Value, error) {
+	switch expr := expr.(type) {
+	case *NullLiteral:
+		return nil, nil
+	case *IntegerLiteral:
+		return expr.Value, nil
+	case *RealLiteral:
+		return expr.Value, nil
+	case *StringLiteral:
+		return expr.Value, nil
+	case *BlobLiteral:
+		return expr.Value, nil
+	case *Placeholder:
+		value, err := bindValue(c.args[expr.Th])
+		if err != nil {
+			return nil, &SQLError{Err: ErrSyntax, Pos: expr.Pos, Near: "?", Msg: err.Error()}
+		}
+		return value, nil
+	}
+	return nil, &SQLError{Err: ErrSyntax, Pos: expr.Position(), Msg: "expected a literal value"}
+}
+
+// 检查值是否符合第th列并转换成列的类型: REAL列接受整数, TEXT和BLOB列可以互相转换
+func (c *Compiler) columnValue(expr Expr, th int) (Value, error) {
+	value, err := c.value(expr)
+	if err != nil {
+		return nil, err
+	}
+	column := c.schema.Columns[th]
+	if value == nil {
+		if column.NotNull {
+			return nil, &SQLError{Err: ErrNotNull, Pos: expr.Position(), Msg: c.schema.Name + "." + column.Name}
+		}
+		return nil, nil
+	}
+	switch v := value.(type) {
+	case int64:
+		if column.Type == COLUMN_TYPE_REAL {
+			value = float64(v)
+		}
+	case string:
+		if column.Type == COLUMN_TYPE_BLOB {
+			value = []byte(v)
+		}
+	case []byte:
+		if column.Type == COLUMN_TYPE_TEXT {
+			value = string(v)
+		}
+	}
+	if valueType(value) != column.Type.valueType() {
+		return nil, &SQLError{Err: ErrSyntax, Pos: expr.Position(), Msg: fmt.Sprintf("%s must be %s", column.Name, column.Type.valueType())}
+	}
+	if text, ok := value.(string); ok && column.Size > 0 && uint32(len(text)) > column.Size {
+		return nil, &SQLError{Err: ErrStringTooLong, Pos: expr.Position(), Msg: fmt.Sprintf("%s longer than %d bytes", column.Name, column.Size)}
+	}
+	return value, nil
+}
+
+// ?绑定的参数, nil为NULL, bool转为0或1. NaN不能比较也不能作为key, 不接受
+func bindValue(arg any) (Value, error) {
+	switch arg := arg.(type) {
+	case nil:
+		return nil, nil
+	case bool:
+		if arg {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case int:
+		return int64(arg), nil
+	case int8:
+		return int64(arg), nil
+	case int16:
+		return int64(arg), nil
+	case int32:
+		return int64(arg), nil
+	case int64:
+		return arg, nil
+	case uint:
+		return bindValue(uint64(arg))
+	case uint8:
+		return int64(arg), nil
+	case uint16:
+		return int64(arg), nil
+	case uint32:
+		return int64(arg), nil
+	case uint64:
+		if arg > math.MaxInt64 {
+			return nil, fmt.Errorf("argument %d out of range", arg)
+		}
+		return int64(arg), nil
+	case float32:
+		return bindValue(float64(arg))
+	case float64:
+		if math.IsNaN(arg) {
+			return nil, fmt.Errorf("argument NaN is not a number")
+		}
+		return arg, nil
+	case string:
+		return arg, nil
+	case []byte:
+		return append([]byte{}, arg...), nil
+	}
+	return nil, fmt.Errorf("unsupported argument type %T", arg)
+}
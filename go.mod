@@ -0,0 +1,3 @@
+module github.com/yuhaoyuan/renekton
+
+go 1.27
@@ -0,0 +1,134 @@
+package renekton
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+/*
+文件头api: 第0页保存整个数据库文件的元信息, 系统表(catalog)B+树的根节点位于第1页
+*/
+
+const (
+	HEADER_PAGE_TH = uint32(0)
+	ROOT_PAGE_TH   = HEADER_PAGE_TH + 1
+
+	HEADER_MAGIC   = "renekton format\x00"
+	FORMAT_VERSION = uint32(8) // 文件格式改变时递增, 不认识的版本拒绝打开
+
+	/*
+	 * Header Layout
+	 */
+	HEADER_MAGIC_SIZE   = uint32(len(HEADER_MAGIC))
+	HEADER_MAGIC_OFFSET = uint32(0)
+
+	HEADER_FORMAT_VERSION_SIZE   = uint32(4)
+	HEADER_FORMAT_VERSION_OFFSET = HEADER_MAGIC_OFFSET + HEADER_MAGIC_SIZE
+
+	HEADER_PAGE_SIZE_SIZE   = uint32(4)
+	HEADER_PAGE_SIZE_OFFSET = HEADER_FORMAT_VERSION_OFFSET + HEADER_FORMAT_VERSION_SIZE
+
+	HEADER_PAGES_COUNT_SIZE   = uint32(4)
+	HEADER_PAGES_COUNT_OFFSET = HEADER_PAGE_SIZE_OFFSET + HEADER_PAGE_SIZE_SIZE
+
+	HEADER_ROOT_PAGE_SIZE   = uint32(4)
+	HEADER_ROOT_PAGE_OFFSET = HEADER_PAGES_COUNT_OFFSET + HEADER_PAGES_COUNT_SIZE
+
+	HEADER_FREELIST_TRUNK_SIZE   = uint32(4)
+	HEADER_FREELIST_TRUNK_OFFSET = HEADER_ROOT_PAGE_OFFSET + HEADER_ROOT_PAGE_SIZE
+
+	HEADER_FREE_PAGES_COUNT_SIZE   = uint32(4)
+	HEADER_FREE_PAGES_COUNT_OFFSET = HEADER_FREELIST_TRUNK_OFFSET + HEADER_FREELIST_TRUNK_SIZE
+
+	HEADER_SCHEMA_COOKIE_SIZE   = uint32(4)
+	HEADER_SCHEMA_COOKIE_OFFSET = HEADER_FREE_PAGES_COUNT_OFFSET + HEADER_FREE_PAGES_COUNT_SIZE
+
+	HEADER_SIZE = HEADER_SCHEMA_COOKIE_OFFSET + HEADER_SCHEMA_COOKIE_SIZE
+)
+
+// 初始化文件头
+func (p *Page) initializeHeader() {
+	p.markDirty()
+	copy((*p.data)[HEADER_MAGIC_OFFSET:HEADER_MAGIC_OFFSET+HEADER_MAGIC_SIZE], HEADER_MAGIC)
+	p.setHeaderField(HEADER_FORMAT_VERSION_OFFSET, FORMAT_VERSION)
+	p.setHeaderField(HEADER_PAGE_SIZE_OFFSET, PAGE_SIZE)
+	p.HeaderSetPagesCount(ROOT_PAGE_TH + 1)
+	p.HeaderSetRootPage(ROOT_PAGE_TH)
+	p.HeaderSetFreelistTrunk(0)
+	p.HeaderSetFreePagesCount(0)
+	p.HeaderSetSchemaCookie(0)
+}
+
+// 打开已有文件时检查文件头, 不是renekton文件或者格式版本不认识时返回错误
+func (p *Page) validateHeader() error {
+	magic := (*p.data)[HEADER_MAGIC_OFFSET : HEADER_MAGIC_OFFSET+HEADER_MAGIC_SIZE]
+	if !bytes.Equal(magic, []byte(HEADER_MAGIC)) {
+		return errors.New("file is not a renekton database")
+	}
+	version := p.getHeaderField(HEADER_FORMAT_VERSION_OFFSET)
+	if version != FORMAT_VERSION {
+		return fmt.Errorf("unsupported file format version %d (this build reads version %d)", version, FORMAT_VERSION)
+	}
+	pageSize := p.getHeaderField(HEADER_PAGE_SIZE_OFFSET)
+	if pageSize != PAGE_SIZE {
+		return fmt.Errorf("file page size %d does not match page size %d", pageSize, PAGE_SIZE)
+	}
+	return nil
+}
+
+// 文件头中的字段都是uint32
+func (p *Page) getHeaderField(offset uint32) uint32 {
+	return ByteToNumber((*p.data)[offset : offset+4])
+}
+
+func (p *Page) setHeaderField(offset uint32, value uint32) {
+	valueByte := NumberToByte(value)
+	p.markDirty()
+	copy((*p.data)[offset:offset+4], valueByte[:])
+}
+
+// 文件中的页面总数(包括文件头)
+func (p *Page) HeaderGetPagesCount() uint32 {
+	return p.getHeaderField(HEADER_PAGES_COUNT_OFFSET)
+}
+
+func (p *Page) HeaderSetPagesCount(count uint32) {
+	p.setHeaderField(HEADER_PAGES_COUNT_OFFSET, count)
+}
+
+// 系统表B+树根节点所在的页面
+func (p *Page) HeaderGetRootPage() uint32 {
+	return p.getHeaderField(HEADER_ROOT_PAGE_OFFSET)
+}
+
+func (p *Page) HeaderSetRootPage(pageTh uint32) {
+	p.setHeaderField(HEADER_ROOT_PAGE_OFFSET, pageTh)
+}
+
+// 第一个空闲链表trunk页面, 0表示没有空闲页面
+func (p *Page) HeaderGetFreelistTrunk() uint32 {
+	return p.getHeaderField(HEADER_FREELIST_TRUNK_OFFSET)
+}
+
+func (p *Page) HeaderSetFreelistTrunk(pageTh uint32) {
+	p.setHeaderField(HEADER_FREELIST_TRUNK_OFFSET, pageTh)
+}
+
+// 空闲页面总数(包括trunk页面本身)
+func (p *Page) HeaderGetFreePagesCount() uint32 {
+	return p.getHeaderField(HEADER_FREE_PAGES_COUNT_OFFSET)
+}
+
+func (p *Page) HeaderSetFreePagesCount(count uint32) {
+	p.setHeaderField(HEADER_FREE_PAGES_COUNT_OFFSET, count)
+}
+
+// schema每次改变时递增, 用来判断缓存的schema是否过期
+func (p *Page) HeaderGetSchemaCookie() uint32 {
+	return p.getHeaderField(HEADER_SCHEMA_COOKIE_OFFSET)
+}
+
+func (p *Page) HeaderSetSchemaCookie(cookie uint32) {
+	p.setHeaderField(HEADER_SCHEMA_COOKIE_OFFSET, cookie)
+}
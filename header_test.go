@@ -0,0 +1,63 @@
+package renekton
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 不是renekton文件, 文件头不完整, 版本或页面大小不认识时拒绝打开
+func TestHeaderValidate(t *testing.T) {
+	db, path := testOpen(t, JOURNAL_MODE_WAL, 0)
+	if err := db.Insert("users", testRow(1)...); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	valid, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testReopen(t, path, JOURNAL_MODE_WAL).Close()
+
+	garbage := make([]byte, PAGE_SIZE)
+	rand.New(rand.NewSource(4)).Read(garbage)
+	withField := func(offset, value uint32) []byte {
+		data := append([]byte{}, valid...)
+		valueByte := NumberToByte(value)
+		copy(data[offset:], valueByte[:])
+		return data
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"garbage", garbage, "not a renekton database"},
+		{"truncated", valid[:HEADER_MAGIC_SIZE/2], "not a renekton database"},
+		{"version", withField(HEADER_FORMAT_VERSION_OFFSET, FORMAT_VERSION+1), "unsupported file format version"},
+		{"page size", withField(HEADER_PAGE_SIZE_OFFSET, PAGE_SIZE*2), "page size"},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), test.name+".db")
+		if err := os.WriteFile(path, test.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		db, err := Open(path, nil)
+		if err == nil {
+			db.Close()
+		}
+		if !errors.Is(err, ErrCorruptPage) || !strings.Contains(err.Error(), test.want) {
+			t.Fatalf("%s: got %v, want ErrCorruptPage %q", test.name, err, test.want)
+		}
+		// 打开失败时文件不能被修改
+		if data, err := os.ReadFile(path); err != nil || !bytes.Equal(data, test.data) {
+			t.Fatalf("%s: file changed by open: %v", test.name, err)
+		}
+	}
+}
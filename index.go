@@ -0,0 +1,153 @@
+package renekton
+
+import (
+	"bytes"
+	"fmt"
+)
+
+/*
+二级索引: 每个索引是一棵单独的B+树, 和表使用相同的节点格式.
+key为索引列的值加上行在表中的key(见key.go), payload为空, 表的行增删改时同步修改.
+唯一索引的key格式相同, 插入之前检查是否已经有相同的值
+*/
+
+/*
+ * Index Key Layout
+ * 列的值的编码(最多INDEX_MAX_VALUE_KEY_SIZE字节) | 行在表中的key
+ * 超过INDEX_MAX_VALUE_KEY_SIZE字节的编码(只有TEXT和BLOB)只保存前缀, 前缀相同的值之间按表的key排列.
+ * 截断的前缀中没有结束标记, 行在表中的key从第INDEX_MAX_VALUE_KEY_SIZE个字节开始.
+ * 按值查找时也使用截断的前缀, 得到的行需要再和表中的值比较
+ */
+
+// 值在索引中的编码, 超长时截断
+func indexValueKey(key []byte) []byte {
+	return key[:min(len(key), int(INDEX_MAX_VALUE_KEY_SIZE))]
+}
+
+// 行在索引中的key
+func indexKey(index *Index, schema *Schema, row *Row) []byte {
+	key := indexValueKey(appendValueKey(nil, row.Values[index.Column]))
+	return append(key, schema.rowKey(row)...)
+}
+
+// 索引的key中行在表中的key, truncated表示值的编码被截断
+func indexRowKey(key []byte) (rowKey []byte, truncated bool, ok bool) {
+	valueKey := indexValueKey(key)
+	if rest, ok := skipValueKey(valueKey); ok {
+		return key[len(valueKey)-len(rest):], false, true
+	}
+	if len(valueKey) < int(INDEX_MAX_VALUE_KEY_SIZE) || (key[0] != KEY_TAG_TEXT && key[0] != KEY_TAG_BLOB) {
+		return nil, false, false
+	}
+	return key[INDEX_MAX_VALUE_KEY_SIZE:], true, true
+}
+
+func indexInsert(index *Index, table *Table, row *Row) error {
+	key := indexKey(index, table.schema, row)
+	if index.Unique && row.Values[index.Column] != nil {
+		if err := indexCheckUnique(index, table, row); err != nil {
+			return err
+		}
+	}
+	curSor, err := tableFind(index.btree, key)
+	if err != nil {
+		return err
+	}
+	defer curSor.close()
+	return leafNodeInsert(curSor, key, nil)
+}
+
+// 唯一索引中已经有相同的值时返回ErrUniqueViolation, NULL不和任何值相同, 不需要检查.
+// 值的编码不是其它值的编码的前缀, 所以以完整的编码开头的key一定是同一个值; 截断的前缀相同时需要比较表中的行
+func indexCheckUnique(index *Index, table *Table, row *Row) error {
+	value := row.Values[index.Column]
+	prefix := indexValueKey(appendValueKey(nil, value))
+	curSor, err := tableSeek(index.btree, prefix)
+	if err != nil {
+		return err
+	}
+	defer curSor.close()
+	for !curSor.EndOfTable {
+		key, err := cursorKey(curSor)
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(key, prefix) {
+			return nil
+		}
+		rowKey, truncated, ok := indexRowKey(key)
+		if !ok {
+			return corruptPageError(curSor.PageTh, fmt.Sprintf("index %s: invalid key in cell %d", index.Name, curSor.CellTh))
+		}
+		if !truncated {
+			return uniqueViolation(table.schema, index)
+		}
+		other, err := tableGetRow(table, rowKey)
+		if err != nil {
+			return err
+		}
+		if other != nil && compareValues(other.Values[index.Column], value) == 0 {
+			return uniqueViolation(table.schema, index)
+		}
+		if err := curSor.advance(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func uniqueViolation(schema *Schema, index *Index) error {
+	return fmt.Errorf("%w: %s.%s", ErrUniqueViolation, schema.Name, schema.Columns[index.Column].Name)
+}
+
+func indexDelete(index *Index, schema *Schema, row *Row) error {
+	key := indexKey(index, schema, row)
+	curSor, err := tableFind(index.btree, key)
+	if err != nil {
+		return err
+	}
+	defer curSor.close()
+
+	page, err := getPage(index.btree.Pager, curSor.PageTh)
+	if err != nil {
+		return err
+	}
+	if !page.leafNodeHasKey(curSor.CellTh, key) {
+		// 表中的行在索引中没有对应的key
+		return corruptPageError(curSor.PageTh, fmt.Sprintf("index %s: missing key for row %v", index.Name, row.Values))
+	}
+	return leafNodeDelete(curSor)
+}
+
+// 行插入表之后加入表上的所有索引
+func indexesInsert(table *Table, row *Row) error {
+	for _, index := range table.indexes {
+		if err := indexInsert(index, table, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 回收一棵B+树的全部页面(包括溢出页面)
+func btreeFree(pager *Pager, pageTh uint32) error {
+	node, err := getNode(pager, pageTh)
+	if err != nil {
+		return err
+	}
+	if getNodeType(node) == NODE_LEAF {
+		for _, cell := range node.LeafNodeCells() {
+			if err := leafCellFree(pager, cell); err != nil {
+				return err
+			}
+		}
+	} else {
+		children, _ := node.internalNodeEntries()
+		for _, childTh := range children {
+			if err := btreeFree(pager, childTh); err != nil {
+				return err
+			}
+		}
+	}
+	return freePage(pager, pageTh)
+}
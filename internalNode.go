@@ -1,8 +1,8 @@
-package main
+package renekton
 
 import (
+	"bytes"
 	"fmt"
-	"os"
 )
 
 /*
@@ -23,12 +23,17 @@ const (
 
 	/*
 		Internal Node Body Layout
+		与叶子节点相同, header之后是cell指针数组, cell按key排序, 内容从页面末尾开始往前存放.
+		每个cell为 child | key长度 | key, 长度可变
 	*/
-	INTERNAL_NODE_KEY_SIZE   = 4 // size of uint32
-	INTERNAL_NODE_CHILD_SIZE = 4
-	INTERNAL_NODE_CELL_SIZE  = INTERNAL_NODE_CHILD_SIZE + INTERNAL_NODE_KEY_SIZE
+	INTERNAL_NODE_CELL_POINTER_SIZE = 4
+	INTERNAL_NODE_CHILD_SIZE        = 4
+	INTERNAL_NODE_KEY_SIZE_SIZE     = 4
+	INTERNAL_CELL_HEADER_SIZE       = INTERNAL_NODE_CHILD_SIZE + INTERNAL_NODE_KEY_SIZE_SIZE
 
-	INTERNAL_NODE_MAX_CELLS = 3 // debug用
+	INTERNAL_NODE_SPACE_FOR_CELLS = PAGE_SIZE - INTERNAL_NODE_HEADER_SIZE
+
+	INTERNAL_NODE_MIN_FILL = INTERNAL_NODE_SPACE_FOR_CELLS / 4 // 已用空间少于这个字节数需要向兄弟节点借或合并
 )
 
 // 获得
@@ -41,6 +46,7 @@ func (p *Page) InternalNodeSetKeyCount(keyCount uint32) {
 	keyByte := NumberToByte(keyCount)
 
 	offset := INTERNAL_NODE_NUM_KEYS_OFFSET
+	p.markDirty()
 	copy((*p.data)[offset:offset+INTERNAL_NODE_NUM_KEYS_SIZE], keyByte[:])
 }
 
@@ -54,60 +60,104 @@ func (p *Page) InternalNodeGetRightChild() uint32 {
 func (p *Page) InternalNodeSetRightChild(childTh uint32) {
 	offset := INTERNAL_NODE_RIGHT_CHILD_OFFSET
 	childThByte := NumberToByte(childTh)
+	p.markDirty()
 	copy((*p.data)[offset:offset+INTERNAL_NODE_RIGHT_CHILD_SIZE], childThByte[:])
 }
 
+// 第cellTh个cell在页面中的偏移
+func (p *Page) internalNodeCellOffset(cellTh uint32) uint32 {
+	offset := INTERNAL_NODE_HEADER_SIZE + cellTh*INTERNAL_NODE_CELL_POINTER_SIZE
+	return ByteToNumber((*p.data)[offset : offset+INTERNAL_NODE_CELL_POINTER_SIZE])
+}
+
 // 返回指定page(节点)中的指定cell值 child序号
 func (p *Page) InternalNodeGetCell(cellTh uint32) uint32 {
-	offset := INTERNAL_NODE_HEADER_SIZE + cellTh*INTERNAL_NODE_CELL_SIZE
+	offset := p.internalNodeCellOffset(cellTh)
 	return ByteToNumber((*p.data)[offset : offset+INTERNAL_NODE_CHILD_SIZE])
 }
 
-func (p *Page) InternalNodeGetKey(keyTh uint32) uint32 {
-	offset := INTERNAL_NODE_HEADER_SIZE + keyTh*INTERNAL_NODE_CELL_SIZE + INTERNAL_NODE_CHILD_SIZE
-	return ByteToNumber((*p.data)[offset : offset+INTERNAL_NODE_KEY_SIZE])
+func (p *Page) InternalNodeSetCell(cellTh uint32, childTh uint32) {
+	offset := p.internalNodeCellOffset(cellTh)
+	childThByte := NumberToByte(childTh)
+	p.markDirty()
+	copy((*p.data)[offset:offset+INTERNAL_NODE_CHILD_SIZE], childThByte[:])
+}
+
+func (p *Page) internalNodeGetKeySize(keyTh uint32) uint32 {
+	offset := p.internalNodeCellOffset(keyTh) + INTERNAL_NODE_CHILD_SIZE
+	return ByteToNumber((*p.data)[offset : offset+INTERNAL_NODE_KEY_SIZE_SIZE])
 }
 
-func (p *Page) InternalNodeSetKey(keyTh uint32, key uint32) {
-	offset := INTERNAL_NODE_HEADER_SIZE + keyTh*INTERNAL_NODE_CELL_SIZE + INTERNAL_NODE_CHILD_SIZE
+// 返回的切片引用页面中的数据
+func (p *Page) InternalNodeGetKey(keyTh uint32) []byte {
+	offset := p.internalNodeCellOffset(keyTh) + INTERNAL_CELL_HEADER_SIZE
+	return (*p.data)[offset : offset+p.internalNodeGetKeySize(keyTh)]
+}
 
-	keyByte := NumberToByte(key)
-	copy((*p.data)[offset:offset+INTERNAL_NODE_KEY_SIZE], keyByte[:])
+// 替换第keyTh个key, 整个节点重写. 调用前需要用internalNodeFits检查, 见internalNodeReplaceKey
+func (p *Page) InternalNodeSetKey(keyTh uint32, key []byte) {
+	children, keys := p.internalNodeEntries()
+	keys[keyTh] = key
+	p.internalNodeSetEntries(children, keys)
+}
+
+// 检查cell指针和key长度都在页面之内
+func (p *Page) internalNodeCheckCells() error {
+	keyCount := p.InternalNodeGetKeyCount()
+	contentStart := INTERNAL_NODE_HEADER_SIZE + keyCount*INTERNAL_NODE_CELL_POINTER_SIZE
+	for i := uint32(0); i < keyCount; i++ {
+		offset := p.internalNodeCellOffset(i)
+		if offset < contentStart || offset+INTERNAL_CELL_HEADER_SIZE > PAGE_SIZE {
+			return corruptPageError(p.pageTh, fmt.Sprintf("cell %d offset %d out of range", i, offset))
+		}
+		keySize := p.internalNodeGetKeySize(i)
+		if keySize > BTREE_MAX_KEY_SIZE || offset+INTERNAL_CELL_HEADER_SIZE+keySize > PAGE_SIZE {
+			return corruptPageError(p.pageTh, fmt.Sprintf("key %d size %d out of range", i, keySize))
+		}
+	}
+	return nil
+}
+
+// 这些key的cell占用的空间, 包括cell指针
+func internalCellsSize(keys [][]byte) uint32 {
+	size := uint32(0)
+	for _, key := range keys {
+		size += INTERNAL_NODE_CELL_POINTER_SIZE + INTERNAL_CELL_HEADER_SIZE + uint32(len(key))
+	}
+	return size
+}
+
+// 这些key能否放进一个内部节点
+func internalNodeFits(keys [][]byte) bool {
+	return internalCellsSize(keys) <= INTERNAL_NODE_SPACE_FOR_CELLS
 }
 
 // 获得内部节点的第cellTh个儿子
-func (p *Page) InternalNodeGetChild(childTh uint32) uint32 {
+func (p *Page) InternalNodeGetChild(childTh uint32) (uint32, error) {
 	keyCount := p.InternalNodeGetKeyCount()
 
 	if childTh > keyCount {
-		fmt.Println("Tried to access child_th > keyCount")
-		os.Exit(0)
+		return 0, corruptPageError(p.pageTh, fmt.Sprintf("child %d > keyCount %d", childTh, keyCount))
 	} else if childTh == keyCount {
-		return p.InternalNodeGetRightChild()
-	} else {
-		return p.InternalNodeGetCell(childTh)
+		return p.InternalNodeGetRightChild(), nil
 	}
-	return 0
+	return p.InternalNodeGetCell(childTh), nil
 }
 
-func (p *Page) InternalNodeSetChild(childTh uint32, nodeTh uint32) {
-	nodeThByte := NumberToByte(nodeTh)
-
+func (p *Page) InternalNodeSetChild(childTh uint32, nodeTh uint32) error {
 	keyCount := p.InternalNodeGetKeyCount()
 	if childTh > keyCount {
-		fmt.Println("Tried to access child_th > keyCount")
-		os.Exit(0)
+		return corruptPageError(p.pageTh, fmt.Sprintf("child %d > keyCount %d", childTh, keyCount))
 	} else if childTh == keyCount {
-		offset := INTERNAL_NODE_RIGHT_CHILD_OFFSET
-		copy((*p.data)[offset:offset+INTERNAL_NODE_RIGHT_CHILD_SIZE], nodeThByte[:])
+		p.InternalNodeSetRightChild(nodeTh)
 	} else {
-		offset := INTERNAL_NODE_HEADER_SIZE + childTh*INTERNAL_NODE_CELL_SIZE
-		copy((*p.data)[offset:offset+INTERNAL_NODE_CHILD_SIZE], nodeThByte[:])
+		p.InternalNodeSetCell(childTh, nodeTh)
 	}
+	return nil
 }
 
-// 通过内部节点时，通过key找到想要的下一个节点子节点
-func (p *Page) internalNodeFindChild(key uint32) uint32 {
+// 通过内部节点时，通过key找到想要的下一个节点子节点的序号, 等于keyCount时表示最右子节点
+func (p *Page) internalNodeFindChild(key []byte) uint32 {
 
 	keyCount := p.InternalNodeGetKeyCount()
 
@@ -117,49 +167,85 @@ func (p *Page) internalNodeFindChild(key uint32) uint32 {
 	for l < r {
 		mid := (l + r) / 2
 		rightKey := p.InternalNodeGetKey(mid) // 第mid个key
-		if rightKey >= key {
+		if bytes.Compare(rightKey, key) >= 0 {
 			r = mid
 		} else {
 			l = mid + 1
 		}
 	}
-	if p.InternalNodeGetKey(l) < key { // 返回最右边的子节点
-		l = p.InternalNodeGetRightChild()
-	}
 
 	return l
 }
 
-func InternalNodeFind(table *Table, pageTh uint32, key uint32) *Cursor {
-	node, err := getPage(table.Pager, pageTh)
-	if err != nil {
-		os.Exit(0)
+// 返回子节点childPageTh在内部节点中的序号, 等于keyCount时表示最右子节点
+func (p *Page) internalNodeChildIndex(childPageTh uint32) uint32 {
+	keyCount := p.InternalNodeGetKeyCount()
+	for i := uint32(0); i < keyCount; i++ {
+		if p.InternalNodeGetCell(i) == childPageTh {
+			return i
+		}
 	}
+	return keyCount
+}
 
-	// 内部节点的子节点可能仍然是内部节点
-	childIndex := node.internalNodeFindChild(key)
-	childTh :=  node.InternalNodeGetChild(childIndex)
-	child, err := getPage(table.Pager, childTh)
-	if err != nil {
-		PrintError("internalNodeFind get child page failed")
+// 以切片的形式返回内部节点的全部子节点和key(副本), children比keys多一个(最右子节点)
+func (p *Page) internalNodeEntries() ([]uint32, [][]byte) {
+	keyCount := p.InternalNodeGetKeyCount()
+	children := make([]uint32, 0, keyCount+1)
+	keys := make([][]byte, 0, keyCount)
+	for i := uint32(0); i < keyCount; i++ {
+		children = append(children, p.InternalNodeGetCell(i))
+		keys = append(keys, append([]byte{}, p.InternalNodeGetKey(i)...))
 	}
-	switch getNodeType(child) {
-	case NODE_LEAF:
-		return leafNodeFind(table, childTh, key)
-	case NODE_INTERNAL:
-		return InternalNodeFind(table, childTh, key)
+	children = append(children, p.InternalNodeGetRightChild())
+	return children, keys
+}
+
+// 用children和keys重写内部节点, 最后一个child作为最右子节点, cell内容从页面末尾开始紧凑存放.
+// 调用前需要用internalNodeFits检查
+func (p *Page) internalNodeSetEntries(children []uint32, keys [][]byte) {
+	keyCount := uint32(len(keys))
+	p.markDirty()
+	clear((*p.data)[INTERNAL_NODE_HEADER_SIZE:])
+	p.InternalNodeSetKeyCount(keyCount)
+	contentOffset := PAGE_SIZE
+	for i := uint32(0); i < keyCount; i++ {
+		contentOffset -= INTERNAL_CELL_HEADER_SIZE + uint32(len(keys[i]))
+		childByte, keySizeByte := NumberToByte(children[i]), NumberToByte(uint32(len(keys[i])))
+		copy((*p.data)[contentOffset:], childByte[:])
+		copy((*p.data)[contentOffset+INTERNAL_NODE_CHILD_SIZE:], keySizeByte[:])
+		copy((*p.data)[contentOffset+INTERNAL_CELL_HEADER_SIZE:], keys[i])
+		pointer := NumberToByte(contentOffset)
+		offset := INTERNAL_NODE_HEADER_SIZE + i*INTERNAL_NODE_CELL_POINTER_SIZE
+		copy((*p.data)[offset:offset+INTERNAL_NODE_CELL_POINTER_SIZE], pointer[:])
 	}
-	return nil
+	p.InternalNodeSetRightChild(children[keyCount])
 }
 
-func (p *Page) InternalNodeUpdateKey(oldMaxKey uint32, newMaxKey uint32) {
-	oldChildIndex := p.internalNodeFindChild(oldMaxKey)
-	p.InternalNodeSetKey(oldChildIndex, newMaxKey)
+// 节点已用的空间
+func (p *Page) internalNodeUsedSpace() uint32 {
+	_, keys := p.internalNodeEntries()
+	return internalCellsSize(keys)
 }
 
-func (p *Page) InternalNodeMove(sourceTh, desTh uint32) {
-	sourceOffset := INTERNAL_NODE_HEADER_SIZE + sourceTh*INTERNAL_NODE_CELL_SIZE
-	destinationOffset := INTERNAL_NODE_HEADER_SIZE + desTh*INTERNAL_NODE_CELL_SIZE
+func InternalNodeFind(table *Table, pageTh uint32, key []byte) (*Cursor, error) {
+	node, err := getNode(table.Pager, pageTh)
+	if err != nil {
+		return nil, err
+	}
 
-	copy((*p.data)[destinationOffset:destinationOffset+INTERNAL_NODE_CELL_SIZE], (*p.data)[sourceOffset:sourceOffset+INTERNAL_NODE_CELL_SIZE])
+	// 内部节点的子节点可能仍然是内部节点
+	childIndex := node.internalNodeFindChild(key)
+	childTh, err := node.InternalNodeGetChild(childIndex)
+	if err != nil {
+		return nil, err
+	}
+	child, err := getNode(table.Pager, childTh)
+	if err != nil {
+		return nil, err
+	}
+	if getNodeType(child) == NODE_LEAF {
+		return leafNodeFind(table, childTh, key)
+	}
+	return InternalNodeFind(table, childTh, key)
 }
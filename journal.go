@@ -0,0 +1,222 @@
+package renekton
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+/*
+回滚日志(rollback journal), WAL之外的另一种日志模式:
+事务中的页面第一次被写入数据库文件之前, 先把它原来的内容保存到 <数据库文件>-journal 中并fsync.
+提交时数据库文件fsync之后删除journal, 删除journal即为提交点;
+打开数据库时如果发现journal(hot journal), 说明上次的事务没有完成, 用其中的原始页面回滚数据库文件.
+*/
+
+type JournalMode int
+
+const (
+	JOURNAL_MODE_WAL JournalMode = iota
+	JOURNAL_MODE_ROLLBACK
+)
+
+const (
+	JOURNAL_MAGIC = "rnktjrnl"
+
+	/*
+	 * Journal Header Layout
+	 */
+	JOURNAL_HEADER_MAGIC_SIZE   = uint32(len(JOURNAL_MAGIC))
+	JOURNAL_HEADER_MAGIC_OFFSET = uint32(0)
+
+	JOURNAL_HEADER_PAGE_SIZE_SIZE   = uint32(4)
+	JOURNAL_HEADER_PAGE_SIZE_OFFSET = JOURNAL_HEADER_MAGIC_OFFSET + JOURNAL_HEADER_MAGIC_SIZE
+
+	JOURNAL_HEADER_FILE_LENGTH_SIZE   = uint32(8) // 事务开始前数据库文件的长度, 回滚时截断到这个长度
+	JOURNAL_HEADER_FILE_LENGTH_OFFSET = JOURNAL_HEADER_PAGE_SIZE_OFFSET + JOURNAL_HEADER_PAGE_SIZE_SIZE
+
+	JOURNAL_HEADER_SIZE = JOURNAL_HEADER_FILE_LENGTH_OFFSET + JOURNAL_HEADER_FILE_LENGTH_SIZE
+
+	/*
+	 * Journal Record Layout
+	 */
+	JOURNAL_RECORD_PAGE_TH_SIZE   = uint32(4)
+	JOURNAL_RECORD_PAGE_TH_OFFSET = uint32(0)
+
+	JOURNAL_RECORD_CHECKSUM_SIZE   = uint32(4) // 页面序号+页面数据的crc32
+	JOURNAL_RECORD_CHECKSUM_OFFSET = JOURNAL_RECORD_PAGE_TH_OFFSET + JOURNAL_RECORD_PAGE_TH_SIZE
+
+	JOURNAL_RECORD_HEADER_SIZE = JOURNAL_RECORD_CHECKSUM_OFFSET + JOURNAL_RECORD_CHECKSUM_SIZE
+	JOURNAL_RECORD_SIZE        = JOURNAL_RECORD_HEADER_SIZE + PAGE_SIZE
+)
+
+type Journal struct {
+	filePath       string
+	fileDescriptor *os.File        // 当前事务还没有写过数据库文件时为nil
+	journaled      map[uint32]bool // 当前事务中已经保存过原始内容的页面
+}
+
+func newJournal(filePath string) *Journal {
+	return &Journal{
+		filePath:  filePath,
+		journaled: make(map[uint32]bool),
+	}
+}
+
+// 在页面写入数据库文件之前调用: 保存这些页面在数据库文件中的原始内容, fsync之后才能写数据库文件
+func journalSavePages(pager *Pager, pages []*Page) error {
+	journal := pager.journal
+	saved := journal.fileDescriptor == nil // 新建的journal头也需要fsync
+	if journal.fileDescriptor == nil {
+		file, err := os.OpenFile(journal.filePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+		if err != nil {
+			return ioError("open journal file", err)
+		}
+		header := make([]byte, JOURNAL_HEADER_SIZE)
+		copy(header[JOURNAL_HEADER_MAGIC_OFFSET:], JOURNAL_MAGIC)
+		putNumber(header[JOURNAL_HEADER_PAGE_SIZE_OFFSET:], PAGE_SIZE)
+		putNumber(header[JOURNAL_HEADER_FILE_LENGTH_OFFSET:], uint32(pager.fileLength>>32))
+		putNumber(header[JOURNAL_HEADER_FILE_LENGTH_OFFSET+4:], uint32(pager.fileLength))
+		if _, err := file.WriteAt(header, 0); err != nil {
+			_ = file.Close()
+			_ = os.Remove(journal.filePath)
+			return ioError("write journal header", err)
+		}
+		journal.fileDescriptor = file
+	}
+
+	record := make([]byte, JOURNAL_RECORD_SIZE)
+	for _, page := range pages {
+		if journal.journaled[page.pageTh] {
+			continue
+		}
+
+		offset := int64(page.pageTh) * int64(PAGE_SIZE)
+		if offset >= pager.fileLength {
+			// 事务中新增的页面, 回滚时直接截断
+			journal.journaled[page.pageTh] = true
+			continue
+		}
+		original := record[JOURNAL_RECORD_HEADER_SIZE:]
+		for i := range original {
+			original[i] = 0
+		}
+		if _, err := pager.fileDescriptor.ReadAt(original, offset); err != nil && err != io.EOF {
+			return ioError(fmt.Sprintf("read original page %d", page.pageTh), err)
+		}
+		putNumber(record[JOURNAL_RECORD_PAGE_TH_OFFSET:], page.pageTh)
+		putNumber(record[JOURNAL_RECORD_CHECKSUM_OFFSET:], journalRecordChecksum(record))
+
+		info, err := journal.fileDescriptor.Stat()
+		if err == nil {
+			_, err = journal.fileDescriptor.WriteAt(record, info.Size())
+		}
+		if err != nil {
+			return ioError(fmt.Sprintf("write journal record for page %d", page.pageTh), err)
+		}
+		journal.journaled[page.pageTh] = true
+		saved = true
+	}
+
+	if saved {
+		if err := journal.fileDescriptor.Sync(); err != nil {
+			return ioError("sync journal file", err)
+		}
+	}
+	return nil
+}
+
+func journalRecordChecksum(record []byte) uint32 {
+	checksum := crc32.NewIEEE()
+	checksum.Write(record[:JOURNAL_RECORD_CHECKSUM_OFFSET])
+	checksum.Write(record[JOURNAL_RECORD_HEADER_SIZE:JOURNAL_RECORD_SIZE])
+	return checksum.Sum32()
+}
+
+// 数据库文件已经fsync, 删除journal完成提交
+func journalCommit(pager *Pager) error {
+	journal := pager.journal
+	if journal.fileDescriptor == nil {
+		journal.journaled = make(map[uint32]bool)
+		return nil
+	}
+	if err := os.Remove(journal.filePath); err != nil {
+		return ioError("remove journal file", err)
+	}
+	_ = journal.fileDescriptor.Close()
+	journal.fileDescriptor = nil
+	journal.journaled = make(map[uint32]bool)
+	return nil
+}
+
+// 回滚当前事务: 已经写入数据库文件的页面用journal中的原始内容恢复
+func journalRollback(pager *Pager) error {
+	journal := pager.journal
+	journal.journaled = make(map[uint32]bool)
+	if journal.fileDescriptor == nil {
+		return nil
+	}
+	// 恢复失败时journal保持打开, 不能被下一个事务覆盖
+	if err := journalRecover(pager, journal.filePath); err != nil {
+		return err
+	}
+	_ = journal.fileDescriptor.Close()
+	journal.fileDescriptor = nil
+	return nil
+}
+
+// 打开数据库时检查hot journal: 把其中保存的原始页面写回数据库文件并截断到事务开始前的长度.
+// 恢复失败时保留journal, 下次打开时重新恢复
+func journalRecover(pager *Pager, filePath string) error {
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return ioError("open journal file", err)
+	}
+	defer file.Close()
+
+	header := make([]byte, JOURNAL_HEADER_SIZE)
+	if _, err := file.ReadAt(header, 0); err != nil ||
+		!bytes.Equal(header[JOURNAL_HEADER_MAGIC_OFFSET:JOURNAL_HEADER_MAGIC_OFFSET+JOURNAL_HEADER_MAGIC_SIZE], []byte(JOURNAL_MAGIC)) ||
+		ByteToNumber(header[JOURNAL_HEADER_PAGE_SIZE_OFFSET:]) != PAGE_SIZE {
+		// journal头都没有写完, 数据库文件还没有被修改过
+		return journalRemove(filePath)
+	}
+	originalFileLength := int64(ByteToNumber(header[JOURNAL_HEADER_FILE_LENGTH_OFFSET:]))<<32 |
+		int64(ByteToNumber(header[JOURNAL_HEADER_FILE_LENGTH_OFFSET+4:]))
+
+	// checksum不对的记录是写journal时崩溃留下的, 对应的页面还没有写入数据库文件
+	record := make([]byte, JOURNAL_RECORD_SIZE)
+	for offset := int64(JOURNAL_HEADER_SIZE); ; offset += int64(JOURNAL_RECORD_SIZE) {
+		if _, err := file.ReadAt(record, offset); err != nil {
+			break
+		}
+		if ByteToNumber(record[JOURNAL_RECORD_CHECKSUM_OFFSET:]) != journalRecordChecksum(record) {
+			break
+		}
+		pageTh := ByteToNumber(record[JOURNAL_RECORD_PAGE_TH_OFFSET:])
+		if err := pagerWrite(pager, pageTh, record[JOURNAL_RECORD_HEADER_SIZE:]); err != nil {
+			return err
+		}
+	}
+
+	if err := pager.fileDescriptor.Truncate(originalFileLength); err != nil {
+		return ioError("truncate database file", err)
+	}
+	pager.fileLength = originalFileLength
+	if err := pager.fileDescriptor.Sync(); err != nil {
+		return ioError("sync database file", err)
+	}
+	return journalRemove(filePath)
+}
+
+func journalRemove(filePath string) error {
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		return ioError("remove journal file", err)
+	}
+	return nil
+}
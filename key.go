@@ -0,0 +1,123 @@
+package renekton
+
+import (
+	"bytes"
+	"math"
+)
+
+/*
+B+树的key是可以直接按字节比较的字节串, 长度不超过BTREE_MAX_KEY_SIZE.
+表的key为主键各列的值依次编码; 索引的key为列的值加上表的key. 值编码之后的字节序与compareValues的顺序一致:
+每个值以类型标记开头, NULL只有标记. 整数为8字节大端并翻转符号位; 浮点数为8字节大端,
+负数翻转所有位, 其它翻转符号位; 字符串和BLOB中的0编码成00 FF, 以00 01结束.
+一个值的编码不会是另一个值的编码的前缀, 所以多个值拼接之后仍然按第一个值, 第二个值...的顺序排列.
+索引中一列的值只有NULL和列的类型两种, 所以INTEGER和REAL不需要按数值交错排列
+*/
+
+/*
+ * Key Tag Layout
+ */
+const (
+	KEY_TAG_NULL    = byte(0x00)
+	KEY_TAG_INTEGER = byte(0x01)
+	KEY_TAG_REAL    = byte(0x02)
+	KEY_TAG_TEXT    = byte(0x03)
+	KEY_TAG_BLOB    = byte(0x04)
+)
+
+const (
+	BTREE_MAX_KEY_SIZE = uint32(512)
+	INTEGER_KEY_SIZE   = 9 // 类型标记和8字节的整数
+
+	// 表的key(主键各列的编码)的最大长度, 单列的TEXT主键最多约250字节. 索引的key中值的编码
+	// 超长时截断(见index.go), 加上表的key不超过BTREE_MAX_KEY_SIZE
+	PRIMARY_KEY_MAX_SIZE     = uint32(256)
+	INDEX_MAX_VALUE_KEY_SIZE = BTREE_MAX_KEY_SIZE - PRIMARY_KEY_MAX_SIZE
+)
+
+func appendUint64Key(key []byte, u uint64) []byte {
+	high, low := NumberToByte(uint32(u>>32)), NumberToByte(uint32(u))
+	return append(append(key, high[:]...), low[:]...)
+}
+
+func appendIntegerKey(key []byte, n int64) []byte {
+	return appendUint64Key(append(key, KEY_TAG_INTEGER), uint64(n)^(1<<63))
+}
+
+// appendIntegerKey的逆运算, key至少有INTEGER_KEY_SIZE字节
+func integerKeyValue(key []byte) int64 {
+	u := uint64(ByteToNumber(key[1:5]))<<32 | uint64(ByteToNumber(key[5:INTEGER_KEY_SIZE]))
+	return int64(u ^ (1 << 63))
+}
+
+func appendRealKey(key []byte, f float64) []byte {
+	u := math.Float64bits(f)
+	if u&(1<<63) != 0 {
+		u = ^u
+	} else {
+		u ^= 1 << 63
+	}
+	return appendUint64Key(append(key, KEY_TAG_REAL), u)
+}
+
+func appendTextKey(key []byte, s string) []byte {
+	return appendEscapedKey(append(key, KEY_TAG_TEXT), s)
+}
+
+func appendEscapedKey[T string | []byte](key []byte, s T) []byte {
+	for i := 0; i < len(s); i++ {
+		key = append(key, s[i])
+		if s[i] == 0 {
+			key = append(key, 0xff)
+		}
+	}
+	return append(key, 0x00, 0x01)
+}
+
+// 按值的类型编码
+func appendValueKey(key []byte, value Value) []byte {
+	switch value := value.(type) {
+	case nil:
+		return append(key, KEY_TAG_NULL)
+	case int64:
+		return appendIntegerKey(key, value)
+	case float64:
+		return appendRealKey(key, value)
+	case string:
+		return appendTextKey(key, value)
+	case []byte:
+		return appendEscapedKey(append(key, KEY_TAG_BLOB), value)
+	}
+	panic("unsupported key value")
+}
+
+// 跳过key开头的一个值, 返回剩下的部分. 格式不对时返回false
+func skipValueKey(key []byte) ([]byte, bool) {
+	if len(key) == 0 {
+		return nil, false
+	}
+	switch key[0] {
+	case KEY_TAG_NULL:
+		return key[1:], true
+	case KEY_TAG_INTEGER, KEY_TAG_REAL:
+		if len(key) < INTEGER_KEY_SIZE {
+			return nil, false
+		}
+		return key[INTEGER_KEY_SIZE:], true
+	case KEY_TAG_TEXT, KEY_TAG_BLOB:
+		for i := 1; i+1 < len(key); i++ {
+			if key[i] == 0 {
+				if key[i+1] == 0x01 {
+					return key[i+2:], true
+				}
+				i++ // 转义的0
+			}
+		}
+	}
+	return nil, false
+}
+
+// key是否超过了范围的上界high: 只比较key中与high等长的前缀, 以high开头的key仍在范围内
+func keyBeyond(key []byte, high []byte) bool {
+	return bytes.Compare(key[:min(len(key), len(high))], high) > 0
+}
@@ -0,0 +1,236 @@
+package renekton
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// 按列依次比较, 与key的字节序应当一致
+func compareKeyValues(a, b []any) int {
+	for i := range a {
+		if c := compareValues(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func valuesKey(values []any) []byte {
+	var key []byte
+	for _, value := range values {
+		key = appendValueKey(key, value)
+	}
+	return key
+}
+
+// 编码之后按字节比较的结果与按值比较相同
+func TestKeyOrder(t *testing.T) {
+	integers := []any{int64(math.MinInt64), int64(math.MinInt64 + 1), int64(-256), int64(-1), int64(0), int64(1), int64(255), int64(256), int64(math.MaxInt64)}
+	texts := []any{"", "\x00", "\x00\x00", "\x00a", "a", "a\x00", "a\x00b", "a\x01", "ab", "b", "\xff"}
+	reals := []any{math.Inf(-1), -1e300, -1.5, -math.SmallestNonzeroFloat64, 0.0, math.SmallestNonzeroFloat64, 0.5, 1e300, math.Inf(1)}
+	blobs := []any{[]byte{}, []byte{0}, []byte{0, 0}, []byte{0, 1}, []byte{1}, []byte{0xff}}
+	cases := map[string][][]any{}
+	// 一列中只有NULL和列的类型两种值, NULL排在最前面
+	for name, column := range map[string][]any{"integer": integers, "text": texts, "real": reals, "blob": blobs} {
+		for _, value := range append([]any{nil}, column...) {
+			cases[name] = append(cases[name], []any{value})
+		}
+	}
+	// 多列: 第一列的编码不会是另一个值的前缀, 所以先按第一列排序
+	for _, s := range texts {
+		for _, n := range integers {
+			cases["text, integer"] = append(cases["text, integer"], []any{s, n})
+		}
+	}
+	for _, n := range integers[:4] {
+		for _, s := range texts {
+			for _, m := range integers[:4] {
+				cases["integer, text, integer"] = append(cases["integer, text, integer"], []any{n, s, m})
+			}
+		}
+	}
+
+	for name, values := range cases {
+		for _, a := range values {
+			for _, b := range values {
+				want := compareKeyValues(a, b)
+				if got := bytes.Compare(valuesKey(a), valuesKey(b)); got != want {
+					t.Fatalf("%s: compare %q %q = %d, want %d", name, a, b, got, want)
+				}
+			}
+		}
+	}
+}
+
+// 组合主键和TEXT主键的表按主键的值排序, 主键相同的行不能插入
+func TestPrimaryKeyTypes(t *testing.T) {
+	db, path := testOpen(t, JOURNAL_MODE_WAL, 10)
+	for _, sql := range []string{
+		"create table p (a integer, b text, v text, primary key (a, b))",
+		"create table s (name text primary key, n integer)",
+	} {
+		if _, err := db.Exec(sql); err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+	}
+
+	random := rand.New(rand.NewSource(1))
+	var pRows, sRows [][]any
+	seen := map[string]bool{}
+	for len(pRows) < 600 {
+		a, b := int64(random.Intn(40)), fmt.Sprintf("b%d\x00%d", random.Intn(30), random.Intn(3))
+		if seen[fmt.Sprint(a, b)] {
+			continue
+		}
+		seen[fmt.Sprint(a, b)] = true
+		row := []any{a, b, strings.Repeat("v", random.Intn(500))}
+		check(t, db.Insert("p", row...))
+		pRows = append(pRows, row)
+	}
+	for i, name := range []string{"", "a", "a\x00", "a\x00\x00", "ab", "b", strings.Repeat("z", 200)} {
+		row := []any{name, int64(i)}
+		check(t, db.Insert("s", row...))
+		sRows = append(sRows, row)
+	}
+	if err := db.Insert("p", pRows[0]...); !errors.Is(err, ErrDuplicateKey) {
+		t.Fatalf("duplicate composite key: %v", err)
+	}
+	if err := db.Insert("s", "a\x00", int64(100)); !errors.Is(err, ErrDuplicateKey) {
+		t.Fatalf("duplicate text key: %v", err)
+	}
+
+	sortRows := func(rows [][]any, columns int) {
+		sort.Slice(rows, func(i, j int) bool { return compareKeyValues(rows[i][:columns], rows[j][:columns]) < 0 })
+	}
+	sortRows(pRows, 2)
+	sortRows(sRows, 1)
+	checkQuery := func(sql string, want [][]any, args ...any) {
+		t.Helper()
+		result, err := db.Exec(sql, args...)
+		if err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+		got := [][]any{}
+		for _, row := range result.Rows {
+			got = append(got, row.Values)
+		}
+		if want == nil {
+			want = [][]any{}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: got %d rows, want %d", sql, len(got), len(want))
+		}
+	}
+	checkAll := func() {
+		t.Helper()
+		checkQuery("select * from p", pRows)
+		checkQuery("select * from s", sRows)
+		checkQuery("select * from p where a = ? and b = ?", pRows[7:8], pRows[7][0], pRows[7][1])
+		checkQuery("select * from s where name = ?", sRows[3:4], sRows[3][0])
+
+		var between [][]any
+		for _, row := range pRows {
+			if a := row[0].(int64); a >= 17 && a <= 22 {
+				between = append(between, row)
+			}
+		}
+		checkQuery("select * from p where a between 17 and 22", between)
+		checkQuery("select * from s where name >= 'a' and name < 'b'", sRows[1:5])
+	}
+	checkAll()
+
+	check(t, db.Close())
+	db = testReopen(t, path, JOURNAL_MODE_WAL)
+	defer db.Close()
+	checkAll()
+	checkBtree(t, testTable(t, db, "p"))
+	checkBtree(t, testTable(t, db, "s"))
+
+	// 编码之后超过PRIMARY_KEY_MAX_SIZE的主键
+	long := strings.Repeat("x", int(PRIMARY_KEY_MAX_SIZE))
+	if err := db.Insert("s", long, int64(0)); !errors.Is(err, ErrKeyTooLong) || !strings.Contains(err.Error(), "primary key of s") {
+		t.Fatalf("long text key: %v", err)
+	}
+	fit := int(PRIMARY_KEY_MAX_SIZE) - len(appendIntegerKey(nil, 0)) - len(appendTextKey(nil, ""))
+	if err := db.Insert("p", int64(0), long[:fit+1], ""); !errors.Is(err, ErrKeyTooLong) {
+		t.Fatalf("long composite key: %v", err)
+	}
+	check(t, db.Insert("p", int64(0), long[:fit], ""))
+}
+
+// DB的按主键访问的方法按主键中列的顺序给出每一列的值
+func TestPrimaryKeyAPI(t *testing.T) {
+	db, _ := testOpen(t, JOURNAL_MODE_WAL, 0)
+	defer db.Close()
+	for _, sql := range []string{
+		"create table p (a integer, b text, v text, primary key (a, b))",
+		"create table s (name text primary key, n integer)",
+	} {
+		if _, err := db.Exec(sql); err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+	}
+	check(t, db.Insert("p", int64(1), "x", "1x"))
+	check(t, db.Insert("p", int64(1), "y", "1y"))
+	check(t, db.Insert("p", int64(2), "x", "2x"))
+	check(t, db.Insert("s", "a\x00b", int64(1)))
+
+	checkGet := func(table string, want []any, key ...any) {
+		t.Helper()
+		row, err := db.Get(table, key...)
+		if want == nil {
+			if !errors.Is(err, ErrKeyNotFound) {
+				t.Fatalf("Get %s %v: %v, want ErrKeyNotFound", table, key, err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("Get %s %v: %v", table, key, err)
+		}
+		if !reflect.DeepEqual(row.Values, want) {
+			t.Fatalf("Get %s %v: %v, want %v", table, key, row.Values, want)
+		}
+	}
+	checkGet("p", []any{int64(1), "y", "1y"}, int64(1), "y")
+	checkGet("p", nil, int64(2), "y")
+	checkGet("s", []any{"a\x00b", int64(1)}, "a\x00b")
+	checkGet("s", nil, "a")
+
+	check(t, db.Update("p", map[string]any{"v": "new"}, int64(1), "x"))
+	checkGet("p", []any{int64(1), "x", "new"}, int64(1), "x")
+	checkGet("p", []any{int64(1), "y", "1y"}, int64(1), "y")
+	check(t, db.Update("s", map[string]any{"n": int64(2)}, "a\x00b"))
+	checkGet("s", []any{"a\x00b", int64(2)}, "a\x00b")
+	check(t, db.Delete("p", int64(1), "y"))
+	checkGet("p", nil, int64(1), "y")
+	checkGet("p", []any{int64(2), "x", "2x"}, int64(2), "x")
+	if err := db.Delete("p", int64(1), "y"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("delete of a missing row: %v", err)
+	}
+	if err := db.Update("p", map[string]any{"v": "v"}, int64(1), "y"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("update of a missing row: %v", err)
+	}
+
+	// 值的个数与主键的列数不同
+	arity := []error{
+		func() error { _, err := db.Get("p", int64(1)); return err }(),
+		func() error { _, err := db.Get("s"); return err }(),
+		db.Update("p", map[string]any{"v": "v"}, int64(1), "x", "z"),
+		db.Delete("users"),
+		db.ScanRange("p", []any{int64(1)}, []any{int64(2), "x"}, func(*Row) bool { return true }),
+		db.ScanRange("p", []any{int64(1), "x"}, []any{int64(2)}, func(*Row) bool { return true }),
+	}
+	for i, err := range arity {
+		if !errors.Is(err, ErrPrimaryKeyArity) {
+			t.Fatalf("call %d: %v, want ErrPrimaryKeyArity", i, err)
+		}
+	}
+	checkGet("p", []any{int64(1), "x", "new"}, int64(1), "x")
+}
@@ -1,8 +1,8 @@
-package main
+package renekton
 
 import (
+	"bytes"
 	"fmt"
-	"os"
 )
 
 /*
@@ -24,19 +24,36 @@ const (
 
 /*
  * Leaf Node Body Layout
+ * header之后是cell指针数组, 第i个指针为第i个cell在页面中的偏移, cell按key排序;
+ * cell的内容从页面末尾开始往前存放, 长度可变
  */
 const (
-	LEAF_NODE_KEY_SIZE   = uint32(4)
-	LEAF_NODE_KEY_OFFSET = uint32(0)
+	LEAF_NODE_CELL_POINTER_SIZE = uint32(4)
 
-	LEAF_NODE_VALUE_SIZE   = ROW_SIZE
-	LEAF_NODE_VALUE_OFFSET = LEAF_NODE_KEY_OFFSET + LEAF_NODE_KEY_SIZE
+	LEAF_NODE_SPACE_FOR_CELLS = PAGE_SIZE - LEAF_NODE_HEADER_SIZE // cell的数量只受页面空间限制
 
-	LEAF_NODE_CELL_SIZE = LEAF_NODE_KEY_SIZE + LEAF_NODE_VALUE_SIZE
+	// 已用空间(cell指针和cell内容)少于这个字节数需要向兄弟节点借或合并. 合并放不下时两个节点
+	// 按字节数平分, 各自都超过这个值, 不会在借和合并之间反复
+	LEAF_NODE_MIN_FILL = LEAF_NODE_SPACE_FOR_CELLS / 4
+)
+
+/*
+ * Leaf Cell Layout
+ * key长度 | payload总长度 | key | 页面内保存的payload | 第一个溢出页面(payload超过LEAF_NODE_MAX_LOCAL时才有)
+ */
+const (
+	LEAF_CELL_KEY_SIZE_SIZE   = uint32(4)
+	LEAF_CELL_KEY_SIZE_OFFSET = uint32(0)
 
-	LEAF_NODE_SPACE_FOR_CELLS = PAGE_SIZE - LEAF_NODE_HEADER_SIZE
-	//LEAF_NODE_MAX_CELLS       = LEAF_NODE_SPACE_FOR_CELLS / LEAF_NODE_CELL_SIZE
-	LEAF_NODE_MAX_CELLS = uint32(2) // debug用
+	LEAF_CELL_PAYLOAD_SIZE_SIZE   = uint32(4)
+	LEAF_CELL_PAYLOAD_SIZE_OFFSET = LEAF_CELL_KEY_SIZE_OFFSET + LEAF_CELL_KEY_SIZE_SIZE
+
+	LEAF_CELL_HEADER_SIZE   = LEAF_CELL_KEY_SIZE_SIZE + LEAF_CELL_PAYLOAD_SIZE_SIZE
+	LEAF_CELL_KEY_OFFSET    = LEAF_CELL_HEADER_SIZE
+	LEAF_CELL_OVERFLOW_SIZE = uint32(4)
+
+	// 一个叶子节点至少能放下4个cell, 超出的payload保存在溢出页面中
+	LEAF_NODE_MAX_LOCAL = LEAF_NODE_SPACE_FOR_CELLS/4 - LEAF_NODE_CELL_POINTER_SIZE - LEAF_CELL_HEADER_SIZE - BTREE_MAX_KEY_SIZE - LEAF_CELL_OVERFLOW_SIZE
 )
 
 // 初始化叶子节点
@@ -56,92 +73,180 @@ func (p *Page) LeafNodeGetCellsCount() uint32 {
 	return cellCount
 }
 
-func (p *Page) LeafNodeAddCellsCount() {
-	/*
-		像c语言实现这个函数可以直接取地址内容+1
-		为了用golang表达出相关意思， 这种实现方式实属无奈之举
+func (p *Page) leafNodeSetCellsCount(cellCount uint32) {
+	offset := LEAF_NODE_CELLS_COUNT_OFFSET
+	newCellCountStr := NumberToByte(cellCount)
+	p.markDirty()
+	copy((*p.data)[offset:offset+LEAF_NODE_CELLS_COUNT_SIZE], newCellCountStr[:])
+}
 
-		todo: 尝试用unsafe.Pointer改写一下
-	*/
-	cellCount := p.LeafNodeGetCellsCount()
+// 第cellTh个cell在页面中的偏移
+func (p *Page) leafNodeCellOffset(cellTh uint32) uint32 {
+	offset := LEAF_NODE_HEADER_SIZE + cellTh*LEAF_NODE_CELL_POINTER_SIZE
+	return ByteToNumber((*p.data)[offset : offset+LEAF_NODE_CELL_POINTER_SIZE])
+}
 
-	if cellCount == LEAF_NODE_MAX_CELLS {
-		fmt.Println("can not leafNodeGetCellsCount, because cell full")
-		os.Exit(0)
-	}
-	cellCount += 1
-	newCellCountStr := NumberToByte(cellCount)
+// 返回指定page(节点)中的指定cell (key + payload), 切片引用页面中的数据
+func (p *Page) LeafNodeGetCell(cellTh uint32) []byte {
+	offset := p.leafNodeCellOffset(cellTh)
+	cell := (*p.data)[offset:]
+	return cell[:leafCellSize(leafCellKeySize(cell), leafCellPayloadSize(cell))]
+}
 
-	offset := LEAF_NODE_CELLS_COUNT_OFFSET
-	copy((*p.data)[offset:offset+LEAF_NODE_VALUE_SIZE], newCellCountStr[:])
+// 返回指定page(节点)中的指定cell值 （key）, 切片引用页面中的数据
+func (p *Page) LeafNodeGetKey(cellTh uint32) []byte {
+	return leafCellKey(p.LeafNodeGetCell(cellTh))
 }
 
-func (p *Page) LeafNodeSubCellsCount() {
+// 节点中所有cell的副本
+func (p *Page) LeafNodeCells() [][]byte {
 	cellCount := p.LeafNodeGetCellsCount()
-
-	if cellCount - 1 == LEAF_NODE_MAX_CELLS {
-		fmt.Println("can not leafNodeGetCellsCount, because cell full")
-		os.Exit(0)
+	cells := make([][]byte, cellCount)
+	for i := uint32(0); i < cellCount; i++ {
+		cells[i] = append([]byte{}, p.LeafNodeGetCell(i)...)
 	}
-	if cellCount == 0 {
-		return
+	return cells
+}
+
+// 重写整个节点的cell, cell内容从页面末尾开始紧凑存放. 调用前需要用leafNodeFits检查
+func (p *Page) LeafNodeSetCells(cells [][]byte) {
+	p.markDirty()
+	clear((*p.data)[LEAF_NODE_HEADER_SIZE:])
+	p.leafNodeSetCellsCount(uint32(len(cells)))
+	contentOffset := PAGE_SIZE
+	for i, cell := range cells {
+		contentOffset -= uint32(len(cell))
+		copy((*p.data)[contentOffset:], cell)
+		pointer := NumberToByte(contentOffset)
+		offset := LEAF_NODE_HEADER_SIZE + uint32(i)*LEAF_NODE_CELL_POINTER_SIZE
+		copy((*p.data)[offset:offset+LEAF_NODE_CELL_POINTER_SIZE], pointer[:])
 	}
-	cellCount -= 1
-	newCellCountStr := NumberToByte(cellCount)
+}
 
-	offset := LEAF_NODE_CELLS_COUNT_OFFSET
-	copy((*p.data)[offset:offset+LEAF_NODE_VALUE_SIZE], newCellCountStr[:])
+// 检查cell指针和cell长度都在页面之内
+func (p *Page) leafNodeCheckCells() error {
+	cellCount := p.LeafNodeGetCellsCount()
+	contentStart := LEAF_NODE_HEADER_SIZE + cellCount*LEAF_NODE_CELL_POINTER_SIZE
+	for i := uint32(0); i < cellCount; i++ {
+		offset := p.leafNodeCellOffset(i)
+		if offset < contentStart || offset+LEAF_CELL_HEADER_SIZE > PAGE_SIZE {
+			return corruptPageError(p.pageTh, fmt.Sprintf("cell %d offset %d out of range", i, offset))
+		}
+		cell := (*p.data)[offset:]
+		keySize, payloadSize := leafCellKeySize(cell), leafCellPayloadSize(cell)
+		if keySize > BTREE_MAX_KEY_SIZE {
+			return corruptPageError(p.pageTh, fmt.Sprintf("cell %d key size %d out of range", i, keySize))
+		}
+		if offset+leafCellSize(keySize, payloadSize) > PAGE_SIZE {
+			return corruptPageError(p.pageTh, fmt.Sprintf("cell %d payload size %d out of range", i, payloadSize))
+		}
+	}
+	return nil
 }
 
-// 返回指定page(节点)中的指定cell值 （key + value）
-func (p *Page) LeafNodeGetCell(cellTh uint32) []byte {
-	offset := LEAF_NODE_HEADER_SIZE + cellTh*LEAF_NODE_CELL_SIZE
+// key为keySize字节, payload为payloadSize字节的cell的长度
+func leafCellSize(keySize uint32, payloadSize uint32) uint32 {
+	if payloadSize > LEAF_NODE_MAX_LOCAL {
+		return LEAF_CELL_HEADER_SIZE + keySize + LEAF_NODE_MAX_LOCAL + LEAF_CELL_OVERFLOW_SIZE
+	}
+	return LEAF_CELL_HEADER_SIZE + keySize + payloadSize
+}
 
-	return (*p.data)[offset : offset+LEAF_NODE_CELL_SIZE]
+// 这些cell占用的空间, 包括cell指针
+func leafCellsSize(cells [][]byte) uint32 {
+	size := uint32(0)
+	for _, cell := range cells {
+		size += uint32(len(cell)) + LEAF_NODE_CELL_POINTER_SIZE
+	}
+	return size
 }
 
-// 写入kv至指定Node
-func (p *Page) LeafNodeSetCell(cellTh uint32, keyAndValue []byte) {
-	offset := LEAF_NODE_HEADER_SIZE + cellTh*LEAF_NODE_CELL_SIZE
+// 这些cell能否放进一个叶子节点
+func leafNodeFits(cells [][]byte) bool {
+	return leafCellsSize(cells) <= LEAF_NODE_SPACE_FOR_CELLS
+}
 
-	copy((*p.data)[offset:offset+LEAF_NODE_CELL_SIZE], keyAndValue)
+// 节点已用的空间
+func (p *Page) leafNodeUsedSpace() uint32 {
+	cellCount := p.LeafNodeGetCellsCount()
+	size := cellCount * LEAF_NODE_CELL_POINTER_SIZE
+	for i := uint32(0); i < cellCount; i++ {
+		size += uint32(len(p.LeafNodeGetCell(i)))
+	}
+	return size
 }
 
-// 返回指定page(节点)中的指定cell值 （key）
-func (p *Page) LeafNodeGetKey(cellTh uint32) uint32 {
-	offset := LEAF_NODE_HEADER_SIZE + cellTh*LEAF_NODE_CELL_SIZE
-	keyStr := (*p.data)[offset : offset+LEAF_NODE_KEY_SIZE]
+// 生成一个cell, 放不下的payload写入溢出页面
+func newLeafCell(pager *Pager, key []byte, payload []byte) ([]byte, error) {
+	keySize, payloadSize := uint32(len(key)), uint32(len(payload))
+	if keySize > BTREE_MAX_KEY_SIZE {
+		return nil, fmt.Errorf("%w: %d bytes, max %d", ErrKeyTooLong, keySize, BTREE_MAX_KEY_SIZE)
+	}
+	cell := make([]byte, leafCellSize(keySize, payloadSize))
+	keySizeStr, payloadSizeStr := NumberToByte(keySize), NumberToByte(payloadSize)
+	copy(cell[LEAF_CELL_KEY_SIZE_OFFSET:], keySizeStr[:])
+	copy(cell[LEAF_CELL_PAYLOAD_SIZE_OFFSET:], payloadSizeStr[:])
+	copy(cell[LEAF_CELL_KEY_OFFSET:], key)
+	payloadOffset := LEAF_CELL_KEY_OFFSET + keySize
+	if payloadSize <= LEAF_NODE_MAX_LOCAL {
+		copy(cell[payloadOffset:], payload)
+		return cell, nil
+	}
+	copy(cell[payloadOffset:], payload[:LEAF_NODE_MAX_LOCAL])
+	overflowPageTh, err := overflowWrite(pager, payload[LEAF_NODE_MAX_LOCAL:])
+	if err != nil {
+		return nil, err
+	}
+	overflowPageThStr := NumberToByte(overflowPageTh)
+	copy(cell[payloadOffset+LEAF_NODE_MAX_LOCAL:], overflowPageThStr[:])
+	return cell, nil
+}
 
-	key := ByteToNumber(keyStr)
-	return key
+func leafCellKeySize(cell []byte) uint32 {
+	return ByteToNumber(cell[LEAF_CELL_KEY_SIZE_OFFSET : LEAF_CELL_KEY_SIZE_OFFSET+LEAF_CELL_KEY_SIZE_SIZE])
 }
 
-func (p *Page) LeafNodeSetKey(cellTh uint32, newKey []byte) {
-	offset := LEAF_NODE_HEADER_SIZE + cellTh*LEAF_NODE_CELL_SIZE
-	copy((*p.data)[offset:offset+LEAF_NODE_KEY_SIZE], newKey)
+func leafCellPayloadSize(cell []byte) uint32 {
+	return ByteToNumber(cell[LEAF_CELL_PAYLOAD_SIZE_OFFSET : LEAF_CELL_PAYLOAD_SIZE_OFFSET+LEAF_CELL_PAYLOAD_SIZE_SIZE])
 }
 
-// 返回指定page(节点)中的指定cell值 （value）
-func (p *Page) LeafNodeGetValue(cellTh uint32) []byte {
-	offset := LEAF_NODE_HEADER_SIZE + cellTh*LEAF_NODE_CELL_SIZE + LEAF_NODE_KEY_SIZE
-	return (*p.data)[offset : offset+LEAF_NODE_CELL_SIZE]
+func leafCellKey(cell []byte) []byte {
+	return cell[LEAF_CELL_KEY_OFFSET : LEAF_CELL_KEY_OFFSET+leafCellKeySize(cell)]
 }
 
-// 在同一个Node中，将第sourceTh个cell复制到第desTh个cell
-func (p *Page) LeafNodeMoveCell(desTh uint32, sourceTh uint32) {
-	desThStart := LEAF_NODE_HEADER_SIZE + desTh*LEAF_NODE_CELL_SIZE
-	desThEnd := desThStart + LEAF_NODE_CELL_SIZE
+// cell的完整payload(包括溢出页面中的部分), 返回的切片不引用页面
+func leafCellPayload(pager *Pager, cell []byte) ([]byte, error) {
+	payloadSize := leafCellPayloadSize(cell)
+	local := cell[LEAF_CELL_KEY_OFFSET+leafCellKeySize(cell):]
+	if payloadSize <= LEAF_NODE_MAX_LOCAL {
+		return append([]byte{}, local[:payloadSize]...), nil
+	}
+	payload := make([]byte, LEAF_NODE_MAX_LOCAL, payloadSize)
+	copy(payload, local)
+	overflowPageTh := ByteToNumber(local[LEAF_NODE_MAX_LOCAL:])
+	return overflowRead(pager, overflowPageTh, payloadSize-LEAF_NODE_MAX_LOCAL, payload)
+}
 
-	sourceThStart := LEAF_NODE_HEADER_SIZE + sourceTh*LEAF_NODE_CELL_SIZE
-	sourceThEnd := sourceThStart + LEAF_NODE_CELL_SIZE
+// 删除cell时回收它的溢出页面
+func leafCellFree(pager *Pager, cell []byte) error {
+	payloadSize := leafCellPayloadSize(cell)
+	if payloadSize <= LEAF_NODE_MAX_LOCAL {
+		return nil
+	}
+	overflowPageTh := ByteToNumber(cell[LEAF_CELL_KEY_OFFSET+leafCellKeySize(cell)+LEAF_NODE_MAX_LOCAL:])
+	return overflowFree(pager, overflowPageTh, payloadSize-LEAF_NODE_MAX_LOCAL)
+}
 
-	copy((*p.data)[desThStart:desThEnd], (*p.data)[sourceThStart:sourceThEnd])
+// 光标是否指向key对应的cell
+func (p *Page) leafNodeHasKey(cellTh uint32, key []byte) bool {
+	return cellTh < p.LeafNodeGetCellsCount() && bytes.Equal(p.LeafNodeGetKey(cellTh), key)
 }
 
 func (p *Page) LeafNodeSetNextLeaf(pageTh uint32) uint32 {
 	offset := LEAF_NODE_NEXT_LEAF_OFFSET
 
 	pageThByte := NumberToByte(pageTh)
+	p.markDirty()
 	copy((*p.data)[offset:offset+LEAF_NODE_NEXT_LEAF_SIZE], pageThByte[:])
 	return pageTh
 }
@@ -0,0 +1,203 @@
+package renekton
+
+import (
+	"encoding/hex"
+	"strings"
+)
+
+/*
+词法分析: 把输入切分成token, 每个token记录它在输入中的位置(字节偏移), 用于报错.
+关键字不区分大小写; 字符串用单引号, 两个单引号表示一个单引号; 标识符可以用双引号括起来;
+数字可以带小数部分和指数, 如1.5e-3; BLOB写成X'十六进制', 如X'00ff';
+-- 到行尾是注释, 块注释以斜杠星号开始, 星号斜杠结束.
+*/
+
+type TokenType int
+
+const (
+	TOKEN_EOF TokenType = iota
+	TOKEN_KEYWORD
+	TOKEN_IDENTIFIER
+	TOKEN_STRING
+	TOKEN_NUMBER
+	TOKEN_BLOB // X'...', Text为解码之后的字节
+	TOKEN_OPERATOR
+	TOKEN_PLACEHOLDER // ?
+)
+
+type Token struct {
+	Type TokenType
+	Text string // 关键字转为大写, 字符串和带引号的标识符去掉引号
+	Pos  int    // 在输入中的字节偏移
+}
+
+var keywords = map[string]bool{
+	"SELECT": true, "FROM": true, "WHERE": true,
+	"INSERT": true, "INTO": true, "VALUES": true,
+	"UPDATE": true, "SET": true, "DELETE": true,
+	"AND": true, "OR": true, "NOT": true,
+	"IS": true, "NULL": true, "BETWEEN": true, "IN": true, "LIKE": true,
+	"BEGIN": true, "COMMIT": true, "END": true, "ROLLBACK": true, "TRANSACTION": true,
+	"SAVEPOINT": true, "RELEASE": true, "TO": true,
+	"CREATE": true, "TABLE": true, "PRIMARY": true, "KEY": true,
+	"INDEX": true, "ON": true, "DROP": true, "UNIQUE": true, "AUTOINCREMENT": true,
+}
+
+// 多字符的运算符放在前面, 优先匹配
+var operators = []string{"<=", ">=", "!=", "<>", "=", "<", ">", "(", ")", ",", ";", "*", "-", "+"}
+
+func tokenize(input string) ([]Token, error) {
+	var tokens []Token
+	pos := 0
+	for {
+		pos = skipSpaceAndComments(input, pos)
+		if pos < 0 {
+			return nil, &SQLError{Err: ErrSyntax, Pos: len(input), Msg: "unterminated comment"}
+		}
+		if pos >= len(input) {
+			tokens = append(tokens, Token{Type: TOKEN_EOF, Pos: len(input)})
+			return tokens, nil
+		}
+
+		token, next, err := nextToken(input, pos)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+		pos = next
+	}
+}
+
+// 跳过空白和注释, 返回下一个token开始的位置; 注释没有结束时返回-1
+func skipSpaceAndComments(input string, pos int) int {
+	for pos < len(input) {
+		switch {
+		case isSpace(input[pos]):
+			pos++
+		case strings.HasPrefix(input[pos:], "--"):
+			end := strings.IndexByte(input[pos:], '\n')
+			if end < 0 {
+				return len(input)
+			}
+			pos += end + 1
+		case strings.HasPrefix(input[pos:], "/*"):
+			end := strings.Index(input[pos+2:], "*/")
+			if end < 0 {
+				return -1
+			}
+			pos += 2 + end + 2
+		default:
+			return pos
+		}
+	}
+	return pos
+}
+
+// 从pos开始读出一个token, 返回token和它之后的位置
+func nextToken(input string, pos int) (Token, int, error) {
+	c := input[pos]
+	switch {
+	case (c == 'x' || c == 'X') && pos+1 < len(input) && input[pos+1] == '\'':
+		text, end, ok := readQuoted(input, pos+1)
+		if !ok {
+			return Token{}, 0, &SQLError{Err: ErrSyntax, Pos: pos, Msg: "unterminated quoted string"}
+		}
+		blob, err := hex.DecodeString(text)
+		if err != nil {
+			return Token{}, 0, &SQLError{Err: ErrSyntax, Pos: pos, Near: input[pos:end], Msg: "malformed blob literal"}
+		}
+		return Token{Type: TOKEN_BLOB, Text: string(blob), Pos: pos}, end, nil
+
+	case isIdentifierStart(c):
+		end := pos
+		for end < len(input) && isIdentifierPart(input[end]) {
+			end++
+		}
+		word := input[pos:end]
+		if keywords[strings.ToUpper(word)] {
+			return Token{Type: TOKEN_KEYWORD, Text: strings.ToUpper(word), Pos: pos}, end, nil
+		}
+		return Token{Type: TOKEN_IDENTIFIER, Text: word, Pos: pos}, end, nil
+
+	case isDigit(c):
+		end := skipDigits(input, pos)
+		if end+1 < len(input) && input[end] == '.' && isDigit(input[end+1]) {
+			end = skipDigits(input, end+1)
+		}
+		if end < len(input) && (input[end] == 'e' || input[end] == 'E') {
+			exponent := end + 1
+			if exponent < len(input) && (input[exponent] == '+' || input[exponent] == '-') {
+				exponent++
+			}
+			if exponent < len(input) && isDigit(input[exponent]) {
+				end = skipDigits(input, exponent)
+			}
+		}
+		if end < len(input) && isIdentifierStart(input[end]) {
+			return Token{}, 0, &SQLError{Err: ErrSyntax, Pos: pos, Near: input[pos : end+1], Msg: "malformed number"}
+		}
+		return Token{Type: TOKEN_NUMBER, Text: input[pos:end], Pos: pos}, end, nil
+
+	case c == '\'' || c == '"':
+		text, end, ok := readQuoted(input, pos)
+		if !ok {
+			return Token{}, 0, &SQLError{Err: ErrSyntax, Pos: pos, Msg: "unterminated quoted string"}
+		}
+		if c == '"' {
+			return Token{Type: TOKEN_IDENTIFIER, Text: text, Pos: pos}, end, nil
+		}
+		return Token{Type: TOKEN_STRING, Text: text, Pos: pos}, end, nil
+
+	case c == '?':
+		return Token{Type: TOKEN_PLACEHOLDER, Text: "?", Pos: pos}, pos + 1, nil
+	}
+
+	for _, operator := range operators {
+		if strings.HasPrefix(input[pos:], operator) {
+			return Token{Type: TOKEN_OPERATOR, Text: operator, Pos: pos}, pos + len(operator), nil
+		}
+	}
+	return Token{}, 0, &SQLError{Err: ErrSyntax, Pos: pos, Near: input[pos : pos+1], Msg: "unexpected character"}
+}
+
+func skipDigits(input string, pos int) int {
+	for pos < len(input) && isDigit(input[pos]) {
+		pos++
+	}
+	return pos
+}
+
+// 读出以input[pos]为引号的字符串, 连续两个引号表示引号本身
+func readQuoted(input string, pos int) (string, int, bool) {
+	quote := input[pos]
+	var builder strings.Builder
+	for i := pos + 1; i < len(input); i++ {
+		if input[i] != quote {
+			builder.WriteByte(input[i])
+			continue
+		}
+		if i+1 < len(input) && input[i+1] == quote {
+			builder.WriteByte(quote)
+			i++
+			continue
+		}
+		return builder.String(), i + 1, true
+	}
+	return "", 0, false
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentifierStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isIdentifierPart(c byte) bool {
+	return isIdentifierStart(c) || isDigit(c)
+}
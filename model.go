@@ -1,17 +1,51 @@
-package main
+package renekton
 
-import "os"
+import (
+	"container/list"
+	"os"
+)
 
 type Pager struct {
 	fileDescriptor *os.File
-	fileLength     uint32
+	fileLength     int64
 	pagesCount     uint32
-	Pages          [TABLE_MAX_PAGES]*Page
+	Pages          map[uint32]*Page // 当前在内存中的页面(buffer pool)
+	lru            *list.List       // 最近访问的页面在头部, 换出时从尾部开始
+	maxCachedPages uint32
+	journalMode    JournalMode
+	wal            *Wal            // 只在WAL模式下使用
+	journal        *Journal        // 只在回滚日志模式下使用
+	inTransaction  bool            // BEGIN之后到COMMIT/ROLLBACK之前, 写语句不自动提交
+	savepoints     []*Savepoint    // 当前事务中的savepoint, 最新的在最后
+	spill          *SavepointSpill // savepoint保存的页面内容超出内存上限时写入的文件
 }
 
+// 一张表对应一棵B+树, 根节点的页面不会改变
 type Table struct {
 	rootPageCTh uint32
 	Pager       *Pager
+	schema      *Schema
+	indexes     []*Index // 表上的索引, 增删改时同步修改
+	sequence    *Table   // 仅适用于AUTOINCREMENT的表, 保存已经分配过的最大主键的SEQUENCE_TABLE
+}
+
+// 索引也是一棵B+树, key为列的值加上主键, 没有payload
+type Index struct {
+	Name   string
+	Column int    // 索引的列在表结构中的序号
+	Unique bool   // 唯一索引: 不同的行在索引的列上的值不能相同
+	SQL    string // CREATE INDEX语句原文
+	btree  *Table // 索引的B+树, schema为nil
+}
+
+// 一个数据库文件: 系统表中记录了所有表和索引的名字, 根节点和建表语句
+type Database struct {
+	Pager        *Pager
+	catalog      *Table            // 系统表, 根节点为ROOT_PAGE_TH
+	tables       map[string]*Table // 表名(小写) -> 表, 从系统表中读取
+	indexes      map[string]*Index // 索引名(小写) -> 索引
+	schemaCookie uint32            // 读取系统表时文件头中的schema cookie
+	schemaLoaded bool
 }
 
 type Cursor struct {
@@ -21,8 +55,11 @@ type Cursor struct {
 	EndOfTable bool
 }
 
-func (c *Cursor) advance() {
-	page, _ := getPage(c.Table.Pager, c.PageTh)
+func (c *Cursor) advance() error {
+	page, err := getPage(c.Table.Pager, c.PageTh)
+	if err != nil {
+		return err
+	}
 
 	// 先往下一行移动
 	c.CellTh += 1
@@ -31,27 +68,56 @@ func (c *Cursor) advance() {
 		nextLeafNodeTh := page.LeafNodeGetNextLeaf()
 		if nextLeafNodeTh == 0 {
 			c.EndOfTable = true
-			return
+			return nil
 		} else {
+			// pin随光标转移到下一个叶子节点
+			nextPage, err := getNode(c.Table.Pager, nextLeafNodeTh)
+			if err != nil {
+				return err
+			}
+			nextPage.pin()
+			page.unpin()
 			c.PageTh = nextLeafNodeTh
 			c.CellTh = 0
 		}
 	}
+	return nil
+}
+
+// 光标不再使用时释放它pin住的页面, 被pin住的页面一定还在buffer pool中
+func (c *Cursor) close() {
+	if page, ok := c.Table.Pager.Pages[c.PageTh]; ok {
+		page.unpin()
+	}
 }
 
 type Page struct {
 	//pageLength uint32 // 维护当前切片最大长度
 	data *[]byte // 包括meta信息+cells信息
+
+	pageTh     uint32
+	dirty      bool          // 内存中的内容与磁盘不一致, 换出或关闭时需要写回
+	pinCount   uint32        // 大于0时不能被换出
+	lruElement *list.Element // 在Pager.lru中的位置
+	pager      *Pager        // 所属的pager, 修改前需要把原始内容保存到savepoint中
+}
+
+// 所有修改页面内容的方法都需要先调用
+func (p *Page) markDirty() {
+	if p.pager != nil {
+		savepointSaveImage(p.pager, p)
+	}
+	p.dirty = true
+}
+
+func (p *Page) pin() {
+	p.pinCount++
 }
 
-func (p *Page) GetNodeMaxKey() uint32 {
-	switch getNodeType(p) {
-	case NODE_INTERNAL:
-		return p.InternalNodeGetKey(p.InternalNodeGetKeyCount() - 1)
-	case NODE_LEAF:
-		return p.LeafNodeGetKey(p.LeafNodeGetCellsCount() - 1)
+func (p *Page) unpin() {
+	if p.pinCount > 0 {
+		p.pinCount--
 	}
-	return 0
 }
 
 // get父节点
@@ -68,5 +134,6 @@ func (p *Page) LeafNodeSetParent(parentPageTh uint32) {
 
 	parentByte := NumberToByte(parentPageTh)
 
+	p.markDirty()
 	copy((*p.data)[offset:offset+PARENT_POINTER_SIZE], parentByte[:])
 }
@@ -0,0 +1,95 @@
+package renekton
+
+import "fmt"
+
+/*
+溢出页面: 叶子节点中放不下的payload按顺序写入一串溢出页面, 每个页面记录下一个页面的序号.
+溢出页面只被一个cell引用, 删除cell时一起回收
+*/
+
+/*
+ * Overflow Page Layout
+ */
+const (
+	OVERFLOW_NEXT_SIZE   = uint32(4)
+	OVERFLOW_NEXT_OFFSET = uint32(0)
+
+	OVERFLOW_DATA_OFFSET = OVERFLOW_NEXT_OFFSET + OVERFLOW_NEXT_SIZE
+	OVERFLOW_DATA_SIZE   = PAGE_SIZE - OVERFLOW_DATA_OFFSET
+)
+
+func (p *Page) OverflowGetNext() uint32 {
+	offset := OVERFLOW_NEXT_OFFSET
+	return ByteToNumber((*p.data)[offset : offset+OVERFLOW_NEXT_SIZE])
+}
+
+func (p *Page) OverflowSetNext(pageTh uint32) {
+	offset := OVERFLOW_NEXT_OFFSET
+	pageThByte := NumberToByte(pageTh)
+	p.markDirty()
+	copy((*p.data)[offset:offset+OVERFLOW_NEXT_SIZE], pageThByte[:])
+}
+
+// 把data写入新申请的溢出页面, 返回第一个页面. 从最后一个页面开始写, 每个页面写入时已经知道下一个页面
+func overflowWrite(pager *Pager, data []byte) (uint32, error) {
+	nextPageTh := uint32(0)
+	pagesCount := (uint32(len(data)) + OVERFLOW_DATA_SIZE - 1) / OVERFLOW_DATA_SIZE
+	for i := pagesCount; i > 0; i-- {
+		pageTh, err := getUnusedPageTh(pager)
+		if err != nil {
+			return 0, err
+		}
+		page, err := getPage(pager, pageTh)
+		if err != nil {
+			return 0, err
+		}
+		start := (i - 1) * OVERFLOW_DATA_SIZE
+		end := min(start+OVERFLOW_DATA_SIZE, uint32(len(data)))
+		page.markDirty()
+		clear(*page.data)
+		page.OverflowSetNext(nextPageTh)
+		copy((*page.data)[OVERFLOW_DATA_OFFSET:], data[start:end])
+		nextPageTh = pageTh
+	}
+	return nextPageTh, nil
+}
+
+// 检查溢出页面的序号, 避免损坏的链表越界或者成环
+func overflowGetPage(pager *Pager, pageTh uint32, remaining uint32) (*Page, error) {
+	if pageTh <= ROOT_PAGE_TH || pageTh >= pager.pagesCount {
+		return nil, corruptPageError(pageTh, fmt.Sprintf("overflow page %d out of range, %d bytes remaining", pageTh, remaining))
+	}
+	return getPage(pager, pageTh)
+}
+
+// 从第一个溢出页面开始读出size字节, 追加到payload之后
+func overflowRead(pager *Pager, pageTh uint32, size uint32, payload []byte) ([]byte, error) {
+	for size > 0 {
+		page, err := overflowGetPage(pager, pageTh, size)
+		if err != nil {
+			return nil, err
+		}
+		n := min(size, OVERFLOW_DATA_SIZE)
+		payload = append(payload, (*page.data)[OVERFLOW_DATA_OFFSET:OVERFLOW_DATA_OFFSET+n]...)
+		size -= n
+		pageTh = page.OverflowGetNext()
+	}
+	return payload, nil
+}
+
+// 回收保存size字节的溢出页面链表
+func overflowFree(pager *Pager, pageTh uint32, size uint32) error {
+	for size > 0 {
+		page, err := overflowGetPage(pager, pageTh, size)
+		if err != nil {
+			return err
+		}
+		nextPageTh := page.OverflowGetNext()
+		if err := freePage(pager, pageTh); err != nil {
+			return err
+		}
+		size -= min(size, OVERFLOW_DATA_SIZE)
+		pageTh = nextPageTh
+	}
+	return nil
+}
@@ -0,0 +1,683 @@
+package renekton
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+/*
+递归下降的语法分析, 输入一条语句(末尾的分号可选), 输出语法树.
+表达式的优先级从低到高: OR, AND, NOT, 比较运算(包括IS NULL, BETWEEN, IN, LIKE), 一元负号
+*/
+
+type Parser struct {
+	tokens       []Token
+	th           int // 下一个要读取的token
+	placeholders int // 已经读到的?个数
+}
+
+// 返回语法树和其中?的个数
+func parse(input string) (Stmt, int, error) {
+	tokens, err := tokenize(input)
+	if err != nil {
+		return nil, 0, err
+	}
+	parser := &Parser{tokens: tokens}
+	stmt, err := parser.parseStatement()
+	if err != nil {
+		return nil, 0, err
+	}
+	end := parser.peek().Pos
+	parser.acceptOperator(";")
+	if token := parser.peek(); token.Type != TOKEN_EOF {
+		return nil, 0, parser.errorAt(token, "unexpected token after end of statement")
+	}
+	switch stmt := stmt.(type) {
+	case *CreateTableStmt:
+		stmt.SQL = strings.TrimSpace(input[tokens[0].Pos:end])
+	case *CreateIndexStmt:
+		stmt.SQL = strings.TrimSpace(input[tokens[0].Pos:end])
+	}
+	return stmt, parser.placeholders, nil
+}
+
+func (p *Parser) parseStatement() (Stmt, error) {
+	token := p.peek()
+	if token.Type != TOKEN_KEYWORD {
+		return nil, p.errorAt(token, "expected a statement")
+	}
+	switch token.Text {
+	case "SELECT":
+		return p.parseSelect()
+	case "INSERT":
+		return p.parseInsert()
+	case "UPDATE":
+		return p.parseUpdate()
+	case "DELETE":
+		return p.parseDelete()
+	case "CREATE":
+		if next := p.tokens[p.th+1]; next.Type == TOKEN_KEYWORD && (next.Text == "INDEX" || next.Text == "UNIQUE") {
+			return p.parseCreateIndex()
+		}
+		return p.parseCreateTable()
+	case "DROP":
+		p.next()
+		if err := p.expectKeyword("INDEX"); err != nil {
+			return nil, err
+		}
+		name, err := p.expectIdentifier()
+		if err != nil {
+			return nil, err
+		}
+		return &DropIndexStmt{Name: name}, nil
+	case "BEGIN":
+		p.next()
+		p.acceptKeyword("TRANSACTION")
+		return &BeginStmt{}, nil
+	case "COMMIT", "END":
+		p.next()
+		p.acceptKeyword("TRANSACTION")
+		return &CommitStmt{}, nil
+	case "ROLLBACK":
+		return p.parseRollback()
+	case "SAVEPOINT":
+		p.next()
+		name, err := p.expectIdentifier()
+		if err != nil {
+			return nil, err
+		}
+		return &SavepointStmt{Name: name}, nil
+	case "RELEASE":
+		p.next()
+		p.acceptKeyword("SAVEPOINT")
+		name, err := p.expectIdentifier()
+		if err != nil {
+			return nil, err
+		}
+		return &ReleaseStmt{Name: name}, nil
+	}
+	return nil, p.errorAt(token, "expected a statement")
+}
+
+// SELECT * | column, ... FROM table [WHERE expr]
+func (p *Parser) parseSelect() (Stmt, error) {
+	p.next()
+	stmt := &SelectStmt{}
+	if !p.acceptOperator("*") {
+		columns, err := p.parseIdentifierList()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Columns = columns
+	}
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	table, err := p.expectIdentifier()
+	if err != nil {
+		return nil, err
+	}
+	stmt.Table = table
+	if stmt.Where, err = p.parseWhere(); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// INSERT INTO table [(column, ...)] VALUES (expr, ...)
+func (p *Parser) parseInsert() (Stmt, error) {
+	p.next()
+	if err := p.expectKeyword("INTO"); err != nil {
+		return nil, err
+	}
+	table, err := p.expectIdentifier()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &InsertStmt{Table: table}
+	if p.acceptOperator("(") {
+		if stmt.Columns, err = p.parseIdentifierList(); err != nil {
+			return nil, err
+		}
+		if err := p.expectOperator(")"); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expectKeyword("VALUES"); err != nil {
+		return nil, err
+	}
+	if err := p.expectOperator("("); err != nil {
+		return nil, err
+	}
+	for {
+		value, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Values = append(stmt.Values, value)
+		if !p.acceptOperator(",") {
+			break
+		}
+	}
+	if err := p.expectOperator(")"); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// UPDATE table SET column = expr, ... [WHERE expr]
+func (p *Parser) parseUpdate() (Stmt, error) {
+	p.next()
+	table, err := p.expectIdentifier()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("SET"); err != nil {
+		return nil, err
+	}
+	stmt := &UpdateStmt{Table: table}
+	for {
+		column, err := p.expectIdentifier()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectOperator("="); err != nil {
+			return nil, err
+		}
+		value, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Assignments = append(stmt.Assignments, &Assignment{Column: column, Value: value})
+		if !p.acceptOperator(",") {
+			break
+		}
+	}
+	if stmt.Where, err = p.parseWhere(); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// DELETE FROM table [WHERE expr]
+func (p *Parser) parseDelete() (Stmt, error) {
+	p.next()
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	table, err := p.expectIdentifier()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &DeleteStmt{Table: table}
+	if stmt.Where, err = p.parseWhere(); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// CREATE TABLE name (column type [(size)] [PRIMARY KEY] [AUTOINCREMENT] [UNIQUE], ... [, PRIMARY KEY (column, ...)])
+func (p *Parser) parseCreateTable() (Stmt, error) {
+	p.next()
+	if err := p.expectKeyword("TABLE"); err != nil {
+		return nil, err
+	}
+	name, err := p.expectIdentifier()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectOperator("("); err != nil {
+		return nil, err
+	}
+	stmt := &CreateTableStmt{Name: name}
+	for {
+		if p.acceptKeyword("PRIMARY") {
+			// 表级约束放在所有列的后面
+			if stmt.PrimaryKey, err = p.parsePrimaryKey(); err != nil {
+				return nil, err
+			}
+			break
+		}
+		column, err := p.parseColumnDef()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Columns = append(stmt.Columns, column)
+		if !p.acceptOperator(",") {
+			break
+		}
+	}
+	if err := p.expectOperator(")"); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// KEY (column, ...), PRIMARY已经读出
+func (p *Parser) parsePrimaryKey() ([]*Identifier, error) {
+	if err := p.expectKeyword("KEY"); err != nil {
+		return nil, err
+	}
+	if err := p.expectOperator("("); err != nil {
+		return nil, err
+	}
+	columns, err := p.parseIdentifierList()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectOperator(")"); err != nil {
+		return nil, err
+	}
+	return columns, nil
+}
+
+// CREATE [UNIQUE] INDEX name ON table (column)
+func (p *Parser) parseCreateIndex() (Stmt, error) {
+	p.next()
+	unique := p.acceptKeyword("UNIQUE")
+	if err := p.expectKeyword("INDEX"); err != nil {
+		return nil, err
+	}
+	name, err := p.expectIdentifier()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("ON"); err != nil {
+		return nil, err
+	}
+	table, err := p.expectIdentifier()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectOperator("("); err != nil {
+		return nil, err
+	}
+	column, err := p.expectIdentifier()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectOperator(")"); err != nil {
+		return nil, err
+	}
+	return &CreateIndexStmt{Name: name, Table: table, Column: column, Unique: unique}, nil
+}
+
+func (p *Parser) parseColumnDef() (*ColumnDef, error) {
+	name, err := p.expectIdentifier()
+	if err != nil {
+		return nil, err
+	}
+	columnType, err := p.expectIdentifier()
+	if err != nil {
+		return nil, err
+	}
+	column := &ColumnDef{Name: name, Type: columnType}
+	if p.acceptOperator("(") {
+		token := p.next()
+		if token.Type != TOKEN_NUMBER {
+			return nil, p.errorAt(token, "expected a column size")
+		}
+		size, err := strconv.ParseInt(token.Text, 10, 64)
+		if err != nil {
+			return nil, p.errorAt(token, "column size out of range")
+		}
+		column.Size = &IntegerLiteral{Value: size, Pos: token.Pos}
+		if err := p.expectOperator(")"); err != nil {
+			return nil, err
+		}
+	}
+	// 列约束可以按任意顺序出现
+	for {
+		if p.acceptKeyword("PRIMARY") {
+			if err := p.expectKeyword("KEY"); err != nil {
+				return nil, err
+			}
+			column.PrimaryKey = true
+		} else if p.acceptKeyword("NOT") {
+			if err := p.expectKeyword("NULL"); err != nil {
+				return nil, err
+			}
+			column.NotNull = true
+		} else if p.acceptKeyword("AUTOINCREMENT") {
+			column.Autoincrement = true
+		} else if p.acceptKeyword("UNIQUE") {
+			column.Unique = true
+		} else {
+			return column, nil
+		}
+	}
+}
+
+// ROLLBACK [TRANSACTION] [TO [SAVEPOINT] name]
+func (p *Parser) parseRollback() (Stmt, error) {
+	p.next()
+	p.acceptKeyword("TRANSACTION")
+	if !p.acceptKeyword("TO") {
+		return &RollbackStmt{}, nil
+	}
+	p.acceptKeyword("SAVEPOINT")
+	name, err := p.expectIdentifier()
+	if err != nil {
+		return nil, err
+	}
+	return &RollbackStmt{Savepoint: name}, nil
+}
+
+func (p *Parser) parseWhere() (Expr, error) {
+	if !p.acceptKeyword("WHERE") {
+		return nil, nil
+	}
+	return p.parseExpr()
+}
+
+func (p *Parser) parseIdentifierList() ([]*Identifier, error) {
+	var identifiers []*Identifier
+	for {
+		identifier, err := p.expectIdentifier()
+		if err != nil {
+			return nil, err
+		}
+		identifiers = append(identifiers, identifier)
+		if !p.acceptOperator(",") {
+			return identifiers, nil
+		}
+	}
+}
+
+func (p *Parser) parseExpr() (Expr, error) {
+	return p.parseOr()
+}
+
+func (p *Parser) parseOr() (Expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().Type == TOKEN_KEYWORD && p.peek().Text == "OR" {
+		op := p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpr{Op: "OR", Left: left, Right: right, Pos: op.Pos}
+	}
+	return left, nil
+}
+
+func (p *Parser) parseAnd() (Expr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().Type == TOKEN_KEYWORD && p.peek().Text == "AND" {
+		op := p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpr{Op: "AND", Left: left, Right: right, Pos: op.Pos}
+	}
+	return left, nil
+}
+
+func (p *Parser) parseNot() (Expr, error) {
+	if token := p.peek(); token.Type == TOKEN_KEYWORD && token.Text == "NOT" {
+		p.next()
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &UnaryExpr{Op: "NOT", Operand: operand, Pos: token.Pos}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *Parser) parseComparison() (Expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	token := p.peek()
+	if token.Type == TOKEN_KEYWORD {
+		return p.parsePredicate(left)
+	}
+	if token.Type != TOKEN_OPERATOR {
+		return left, nil
+	}
+	switch token.Text {
+	case "=", "!=", "<>", "<", "<=", ">", ">=":
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		op := token.Text
+		if op == "<>" {
+			op = "!="
+		}
+		return &BinaryExpr{Op: op, Left: left, Right: right, Pos: token.Pos}, nil
+	}
+	return left, nil
+}
+
+// left之后的IS [NOT] NULL, [NOT] BETWEEN, [NOT] IN, [NOT] LIKE. NOT解析为外层的NOT运算
+func (p *Parser) parsePredicate(left Expr) (Expr, error) {
+	token := p.peek()
+	if token.Text == "IS" {
+		p.next()
+		not := p.peek()
+		negate := p.acceptKeyword("NOT")
+		if err := p.expectKeyword("NULL"); err != nil {
+			return nil, err
+		}
+		var expr Expr = &IsNullExpr{Operand: left, Pos: token.Pos}
+		if negate {
+			expr = &UnaryExpr{Op: "NOT", Operand: expr, Pos: not.Pos}
+		}
+		return expr, nil
+	}
+
+	not := token
+	negate := false
+	if token.Text == "NOT" {
+		next := p.tokens[p.th+1]
+		if next.Type != TOKEN_KEYWORD || (next.Text != "BETWEEN" && next.Text != "IN" && next.Text != "LIKE") {
+			return left, nil
+		}
+		p.next()
+		negate = true
+		token = p.peek()
+	}
+	var expr Expr
+	switch token.Text {
+	case "BETWEEN":
+		p.next()
+		low, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("AND"); err != nil {
+			return nil, err
+		}
+		high, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		expr = &BetweenExpr{Operand: left, Low: low, High: high, Pos: token.Pos}
+	case "IN":
+		p.next()
+		if err := p.expectOperator("("); err != nil {
+			return nil, err
+		}
+		in := &InExpr{Operand: left, Pos: token.Pos}
+		for {
+			value, err := p.parseUnary()
+			if err != nil {
+				return nil, err
+			}
+			in.Values = append(in.Values, value)
+			if !p.acceptOperator(",") {
+				break
+			}
+		}
+		if err := p.expectOperator(")"); err != nil {
+			return nil, err
+		}
+		expr = in
+	case "LIKE":
+		p.next()
+		pattern, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		expr = &BinaryExpr{Op: "LIKE", Left: left, Right: pattern, Pos: token.Pos}
+	default:
+		return left, nil
+	}
+	if negate {
+		expr = &UnaryExpr{Op: "NOT", Operand: expr, Pos: not.Pos}
+	}
+	return expr, nil
+}
+
+func (p *Parser) parseUnary() (Expr, error) {
+	token := p.peek()
+	if token.Type == TOKEN_OPERATOR && (token.Text == "-" || token.Text == "+") {
+		p.next()
+		if number := p.peek(); token.Text == "-" && number.Type == TOKEN_NUMBER {
+			// 负号和数字一起解析, 这样才能写出-9223372036854775808
+			p.next()
+			return p.parseNumber(number, "-", token.Pos)
+		}
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if token.Text == "+" {
+			return operand, nil
+		}
+		// 负数直接折叠成字面量
+		switch literal := operand.(type) {
+		case *IntegerLiteral:
+			if literal.Value == math.MinInt64 {
+				return nil, p.errorAt(token, "integer out of range")
+			}
+			return &IntegerLiteral{Value: -literal.Value, Pos: token.Pos}, nil
+		case *RealLiteral:
+			return &RealLiteral{Value: -literal.Value, Pos: token.Pos}, nil
+		}
+		return &UnaryExpr{Op: "-", Operand: operand, Pos: token.Pos}, nil
+	}
+	return p.parsePrimary()
+}
+
+// 数字字面量, sign为""或者"-", pos为字面量(包括负号)的位置
+func (p *Parser) parseNumber(token Token, sign string, pos int) (Expr, error) {
+	if strings.ContainsAny(token.Text, ".eE") {
+		value, err := strconv.ParseFloat(sign+token.Text, 64)
+		if err != nil {
+			return nil, p.errorAt(token, "real out of range")
+		}
+		return &RealLiteral{Value: value, Pos: pos}, nil
+	}
+	value, err := strconv.ParseInt(sign+token.Text, 10, 64)
+	if err != nil {
+		return nil, p.errorAt(token, "integer out of range")
+	}
+	return &IntegerLiteral{Value: value, Pos: pos}, nil
+}
+
+func (p *Parser) parsePrimary() (Expr, error) {
+	token := p.next()
+	switch token.Type {
+	case TOKEN_NUMBER:
+		return p.parseNumber(token, "", token.Pos)
+	case TOKEN_STRING:
+		return &StringLiteral{Value: token.Text, Pos: token.Pos}, nil
+	case TOKEN_BLOB:
+		return &BlobLiteral{Value: []byte(token.Text), Pos: token.Pos}, nil
+	case TOKEN_KEYWORD:
+		if token.Text == "NULL" {
+			return &NullLiteral{Pos: token.Pos}, nil
+		}
+	case TOKEN_IDENTIFIER:
+		return &ColumnRef{Name: token.Text, Pos: token.Pos}, nil
+	case TOKEN_PLACEHOLDER:
+		placeholder := &Placeholder{Th: p.placeholders, Pos: token.Pos}
+		p.placeholders++
+		return placeholder, nil
+	case TOKEN_OPERATOR:
+		if token.Text == "(" {
+			expr, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectOperator(")"); err != nil {
+				return nil, err
+			}
+			return expr, nil
+		}
+	}
+	return nil, p.errorAt(token, "expected an expression")
+}
+
+func (p *Parser) peek() Token {
+	return p.tokens[p.th]
+}
+
+// 读出下一个token, 停在EOF上
+func (p *Parser) next() Token {
+	token := p.tokens[p.th]
+	if token.Type != TOKEN_EOF {
+		p.th++
+	}
+	return token
+}
+
+func (p *Parser) acceptKeyword(keyword string) bool {
+	if token := p.peek(); token.Type == TOKEN_KEYWORD && token.Text == keyword {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *Parser) expectKeyword(keyword string) error {
+	if !p.acceptKeyword(keyword) {
+		return p.errorAt(p.peek(), "expected "+keyword)
+	}
+	return nil
+}
+
+func (p *Parser) acceptOperator(operator string) bool {
+	if token := p.peek(); token.Type == TOKEN_OPERATOR && token.Text == operator {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *Parser) expectOperator(operator string) error {
+	if !p.acceptOperator(operator) {
+		return p.errorAt(p.peek(), "expected \""+operator+"\"")
+	}
+	return nil
+}
+
+func (p *Parser) expectIdentifier() (*Identifier, error) {
+	token := p.peek()
+	if token.Type != TOKEN_IDENTIFIER {
+		return nil, p.errorAt(token, "expected an identifier")
+	}
+	p.next()
+	return &Identifier{Name: token.Text, Pos: token.Pos}, nil
+}
+
+func (p *Parser) errorAt(token Token, msg string) error {
+	near := token.Text
+	if token.Type == TOKEN_EOF {
+		msg += ", got end of input"
+	}
+	return &SQLError{Err: ErrSyntax, Pos: token.Pos, Near: near, Msg: msg}
+}
@@ -0,0 +1,141 @@
+package renekton
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	input := "Select 'it''s a select', \"my col\", X'00fF', 1.5e-3 -- comment\n/* block */ ? <> -"
+	want := []Token{
+		{Type: TOKEN_KEYWORD, Text: "SELECT", Pos: 0},
+		{Type: TOKEN_STRING, Text: "it's a select", Pos: 7},
+		{Type: TOKEN_OPERATOR, Text: ",", Pos: 23},
+		{Type: TOKEN_IDENTIFIER, Text: "my col", Pos: 25},
+		{Type: TOKEN_OPERATOR, Text: ",", Pos: 33},
+		{Type: TOKEN_BLOB, Text: "\x00\xff", Pos: 35},
+		{Type: TOKEN_OPERATOR, Text: ",", Pos: 42},
+		{Type: TOKEN_NUMBER, Text: "1.5e-3", Pos: 44},
+		{Type: TOKEN_PLACEHOLDER, Text: "?", Pos: 74},
+		{Type: TOKEN_OPERATOR, Text: "<>", Pos: 76},
+		{Type: TOKEN_OPERATOR, Text: "-", Pos: 79},
+		{Type: TOKEN_EOF, Pos: 80},
+	}
+	tokens, err := tokenize(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tokens, want) {
+		t.Fatalf("tokens\n%v\nwant\n%v", tokens, want)
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input        string
+		want         Stmt
+		placeholders int
+	}{
+		{
+			"insert into users values (1, 'select * from users', ?);",
+			&InsertStmt{
+				Table:  &Identifier{Name: "users", Pos: 12},
+				Values: []Expr{&IntegerLiteral{Value: 1, Pos: 26}, &StringLiteral{Value: "select * from users", Pos: 29}, &Placeholder{Th: 0, Pos: 52}},
+			},
+			1,
+		},
+		{
+			"DELETE FROM t WHERE id = -9223372036854775808 OR id = - 1.5",
+			&DeleteStmt{
+				Table: &Identifier{Name: "t", Pos: 12},
+				Where: &BinaryExpr{Op: "OR", Pos: 46,
+					Left:  &BinaryExpr{Op: "=", Pos: 23, Left: &ColumnRef{Name: "id", Pos: 20}, Right: &IntegerLiteral{Value: math.MinInt64, Pos: 25}},
+					Right: &BinaryExpr{Op: "=", Pos: 52, Left: &ColumnRef{Name: "id", Pos: 49}, Right: &RealLiteral{Value: -1.5, Pos: 54}},
+				},
+			},
+			0,
+		},
+		{
+			"update t set a = ?, b = 'x' where not a = ? and (b <> 2 or b <= a)",
+			&UpdateStmt{
+				Table: &Identifier{Name: "t", Pos: 7},
+				Assignments: []*Assignment{
+					{Column: &Identifier{Name: "a", Pos: 13}, Value: &Placeholder{Th: 0, Pos: 17}},
+					{Column: &Identifier{Name: "b", Pos: 20}, Value: &StringLiteral{Value: "x", Pos: 24}},
+				},
+				Where: &BinaryExpr{Op: "AND", Pos: 44,
+					Left: &UnaryExpr{Op: "NOT", Pos: 34, Operand: &BinaryExpr{Op: "=", Pos: 40, Left: &ColumnRef{Name: "a", Pos: 38}, Right: &Placeholder{Th: 1, Pos: 42}}},
+					Right: &BinaryExpr{Op: "OR", Pos: 56,
+						Left:  &BinaryExpr{Op: "!=", Pos: 51, Left: &ColumnRef{Name: "b", Pos: 49}, Right: &IntegerLiteral{Value: 2, Pos: 54}},
+						Right: &BinaryExpr{Op: "<=", Pos: 61, Left: &ColumnRef{Name: "b", Pos: 59}, Right: &ColumnRef{Name: "a", Pos: 64}},
+					},
+				},
+			},
+			2,
+		},
+		{
+			"update t set a = ?, b = NULL where not a is null and b in (?, 2)",
+			&UpdateStmt{
+				Table: &Identifier{Name: "t", Pos: 7},
+				Assignments: []*Assignment{
+					{Column: &Identifier{Name: "a", Pos: 13}, Value: &Placeholder{Th: 0, Pos: 17}},
+					{Column: &Identifier{Name: "b", Pos: 20}, Value: &NullLiteral{Pos: 24}},
+				},
+				Where: &BinaryExpr{Op: "AND", Pos: 49,
+					Left:  &UnaryExpr{Op: "NOT", Pos: 35, Operand: &IsNullExpr{Operand: &ColumnRef{Name: "a", Pos: 39}, Pos: 41}},
+					Right: &InExpr{Operand: &ColumnRef{Name: "b", Pos: 53}, Values: []Expr{&Placeholder{Th: 1, Pos: 59}, &IntegerLiteral{Value: 2, Pos: 62}}, Pos: 55},
+				},
+			},
+			2,
+		},
+		{
+			"rollback transaction to savepoint sp",
+			&RollbackStmt{Savepoint: &Identifier{Name: "sp", Pos: 34}},
+			0,
+		},
+	}
+	for _, test := range tests {
+		stmt, placeholders, err := parse(test.input)
+		if err != nil {
+			t.Fatalf("%q: %v", test.input, err)
+		}
+		if !reflect.DeepEqual(stmt, test.want) {
+			t.Fatalf("%q: got %#v", test.input, stmt)
+		}
+		if placeholders != test.placeholders {
+			t.Fatalf("%q: %d placeholders, want %d", test.input, placeholders, test.placeholders)
+		}
+	}
+}
+
+// 出错时指出出错的token的位置
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		pos   int
+		near  string
+	}{
+		{"selct * from t", 0, "selct"},
+		{"select * form t", 9, "form"},
+		{"select * from t where", 21, ""},
+		{"select * from t where a = 'abc", 26, ""},
+		{"insert into t values (1, 2", 26, ""},
+		{"select * from t where id = 9223372036854775808", 27, "9223372036854775808"},
+		{"select * from t where id = -9223372036854775809", 28, "9223372036854775809"},
+		{"select * from t where id = 12abc", 27, "12a"},
+		{"select * from t /* comment", 26, ""},
+		{"delete from t where a = 1 garbage", 26, "garbage"},
+	}
+	for _, test := range tests {
+		_, _, err := parse(test.input)
+		var sqlErr *SQLError
+		if !errors.As(err, &sqlErr) || !errors.Is(err, ErrSyntax) {
+			t.Fatalf("%q: got %v", test.input, err)
+		}
+		if sqlErr.Pos != test.pos || sqlErr.Near != test.near {
+			t.Fatalf("%q: error at %d near %q, want %d near %q: %v", test.input, sqlErr.Pos, sqlErr.Near, test.pos, test.near, err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package renekton
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 把数据库文件和日志文件复制到同一目录下的snapshot中, 相当于在这一刻崩溃之后磁盘上留下的内容
+func crashSnapshot(t *testing.T, path, snapshot string) string {
+	t.Helper()
+	snapshot = filepath.Join(filepath.Dir(path), snapshot)
+	for _, suffix := range []string{"", "-wal", "-journal"} {
+		data, err := os.ReadFile(path + suffix)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(snapshot+suffix, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return snapshot
+}
+
+// 打开崩溃之后的文件, 检查表中的行与want(id -> email)相同, B+树的结构正确
+func checkRecovered(t *testing.T, path string, mode JournalMode, want map[uint32]string) {
+	t.Helper()
+	db := testReopen(t, path, mode)
+	defer db.Close()
+	if _, err := os.Stat(path + "-journal"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("journal left after recovery: %v", err)
+	}
+	checkRows(t, db, want)
+}
+
+// 提交一部分行之后开始一个大事务, cache很小, 事务中修改过的页面被换出写入日志(或数据库文件).
+// 在事务中间和提交之后分别保存崩溃时的文件, 恢复之后分别只包含已提交的行和事务的全部修改.
+// tornCommit不为nil时在提交之后调用, 返回提交没有完成时崩溃的文件, 恢复之后只包含已提交的行
+func testCrashRecovery(t *testing.T, mode JournalMode, logSuffix string, tornCommit func(path string) string) {
+	db, path := testOpen(t, mode, 10)
+	committed := map[uint32]string{}
+	if err := db.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	for id := uint32(0); id < 60; id++ {
+		testInsert(t, db, committed, id)
+	}
+	if err := db.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	logSize := fileSize(t, path+logSuffix)
+	if err := db.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	modified := maps.Clone(committed)
+	for id := uint32(0); id < 60; id += 2 {
+		testUpdate(t, db, modified, id, fmt.Sprintf("updated%d@example.com", id))
+	}
+	for id := uint32(1); id < 60; id += 3 {
+		testDelete(t, db, modified, id)
+	}
+	for id := uint32(60); id < 90; id++ {
+		testInsert(t, db, modified, id)
+	}
+	if size := fileSize(t, path+logSuffix); size <= logSize {
+		t.Fatalf("nothing written to %s before commit, %d bytes", logSuffix, size)
+	}
+	midTransaction := crashSnapshot(t, path, "transaction.db")
+	if err := db.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	afterCommit := crashSnapshot(t, path, "commit.db")
+	torn := ""
+	if tornCommit != nil {
+		torn = tornCommit(path)
+	}
+	db.Close()
+
+	checkRecovered(t, midTransaction, mode, committed)
+	checkRecovered(t, afterCommit, mode, modified)
+	if torn != "" {
+		checkRecovered(t, torn, mode, committed)
+	}
+}
+
+// WAL模式: 事务中间崩溃时WAL中没有提交标记的帧被丢弃; 最后的提交帧没有写完整时整个事务都被丢弃
+func TestRecoveryWAL(t *testing.T) {
+	testCrashRecovery(t, JOURNAL_MODE_WAL, "-wal", func(path string) string {
+		torn := crashSnapshot(t, path, "torn.db")
+		size := fileSize(t, torn+"-wal")
+		if size <= int64(WAL_HEADER_SIZE+WAL_FRAME_SIZE) {
+			t.Fatalf("wal checkpointed at commit, %d bytes", size)
+		}
+		if err := os.Truncate(torn+"-wal", size-1); err != nil {
+			t.Fatal(err)
+		}
+		return torn
+	})
+}
+
+// 回滚日志模式: 事务中间崩溃时数据库文件中已经写入的页面用journal中的原始内容恢复;
+// 提交之后journal已经删除, 不需要恢复
+func TestRecoveryRollback(t *testing.T) {
+	testCrashRecovery(t, JOURNAL_MODE_ROLLBACK, "-journal", nil)
+}
+
+// journal头没有写完整时数据库文件还没有被修改过, 打开时直接删除journal
+func TestRecoveryRollbackTornJournalHeader(t *testing.T) {
+	db, path := testOpen(t, JOURNAL_MODE_ROLLBACK, 0)
+	want := map[uint32]string{}
+	for id := uint32(0); id < 30; id++ {
+		testInsert(t, db, want, id)
+	}
+	db.Close()
+	if err := os.WriteFile(path+"-journal", []byte(JOURNAL_MAGIC[:4]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	checkRecovered(t, path, JOURNAL_MODE_ROLLBACK, want)
+}
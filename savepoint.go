@@ -0,0 +1,220 @@
+package renekton
+
+import (
+	"fmt"
+	"os"
+)
+
+/*
+savepoint: 事务中的部分回滚点.
+savepoint建立之后, 页面第一次被修改(markDirty)之前的内容保存在最新的savepoint中;
+ROLLBACK TO时从最新的savepoint往回, 把这些页面恢复成保存的内容, 只有savepoint之后改过的页面会被恢复.
+savepoint之后新申请的页面直接丢弃, 页面总数恢复到savepoint建立时的值.
+所有savepoint保存的页面内容最多maxCachedPages个留在内存中, 超过之后写入 <数据库文件>-savepoint,
+内存中只记录位置. 所有savepoint删除(事务结束, 或事务之外的写语句结束)时删除这个文件, 崩溃之后残留的文件不会被读取.
+*/
+
+type Savepoint struct {
+	name       string
+	pagesCount uint32                     // 建立savepoint时的页面总数
+	images     map[uint32]*savepointImage // savepoint之后第一次修改之前的页面内容
+}
+
+// 保存的页面内容, data为nil时写在spill文件中offset的位置
+type savepointImage struct {
+	data   []byte
+	offset int64
+}
+
+// 页面内容超出内存上限时写入的文件, 所有savepoint共用
+type SavepointSpill struct {
+	filePath       string
+	fileDescriptor *os.File // 还没有写过时为nil
+	size           int64    // 已经写入的字节数, 新的内容追加在后面
+	memoryImages   uint32   // 留在内存中的页面内容个数
+}
+
+func newSavepointSpill(filePath string) *SavepointSpill {
+	return &SavepointSpill{filePath: filePath}
+}
+
+// 在markDirty中调用: 页面在最新的savepoint之后第一次被修改时保存它原来的内容
+func savepointSaveImage(pager *Pager, page *Page) {
+	if len(pager.savepoints) == 0 {
+		return
+	}
+	savepoint := pager.savepoints[len(pager.savepoints)-1]
+	if page.pageTh >= savepoint.pagesCount {
+		// savepoint之后新申请的页面, 回滚时直接丢弃
+		return
+	}
+	if _, ok := savepoint.images[page.pageTh]; ok {
+		return
+	}
+	spill := pager.spill
+	if spill.memoryImages >= pager.maxCachedPages {
+		if offset, err := savepointSpillWrite(spill, (*page.data)[:PAGE_SIZE]); err == nil {
+			savepoint.images[page.pageTh] = &savepointImage{offset: offset}
+			return
+		}
+		// 写入失败时留在内存中, 只是超出了上限
+	}
+	spill.memoryImages++
+	savepoint.images[page.pageTh] = &savepointImage{data: append([]byte{}, (*page.data)[:PAGE_SIZE]...)}
+}
+
+// 页面内容追加到spill文件, 返回写入的位置
+func savepointSpillWrite(spill *SavepointSpill, data []byte) (int64, error) {
+	if spill.fileDescriptor == nil {
+		file, err := os.OpenFile(spill.filePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+		if err != nil {
+			return 0, ioError("open savepoint file", err)
+		}
+		spill.fileDescriptor = file
+		spill.size = 0
+	}
+	offset := spill.size
+	if _, err := spill.fileDescriptor.WriteAt(data, offset); err != nil {
+		return 0, ioError("write savepoint file", err)
+	}
+	spill.size += int64(len(data))
+	return offset, nil
+}
+
+// 保存的页面内容, 写在spill文件中时读出来
+func savepointImageData(pager *Pager, pageTh uint32, image *savepointImage) ([]byte, error) {
+	if image.data != nil {
+		return image.data, nil
+	}
+	data := make([]byte, PAGE_SIZE)
+	if _, err := pager.spill.fileDescriptor.ReadAt(data, image.offset); err != nil {
+		return nil, ioError(fmt.Sprintf("read savepoint image of page %d", pageTh), err)
+	}
+	return data, nil
+}
+
+// 不再需要的页面内容. spill文件中的空间不回收, 删除所有savepoint时一起删除
+func savepointDropImage(pager *Pager, image *savepointImage) {
+	if image.data != nil {
+		pager.spill.memoryImages--
+	}
+}
+
+// 同名的savepoint以最新的为准, 没有找到返回-1
+func savepointFind(pager *Pager, name string) int {
+	for i := len(pager.savepoints) - 1; i >= 0; i-- {
+		if pager.savepoints[i].name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// 在栈顶建立一个savepoint, 返回它在栈中的位置
+func savepointBegin(pager *Pager, name string) int {
+	pager.savepoints = append(pager.savepoints, &Savepoint{
+		name:       name,
+		pagesCount: pager.pagesCount,
+		images:     make(map[uint32]*savepointImage),
+	})
+	return len(pager.savepoints) - 1
+}
+
+// 删除第th个savepoint以及之后建立的savepoint, 它们保存的页面内容合并到前一个savepoint中
+func savepointRelease(pager *Pager, th int) {
+	if th == 0 {
+		savepointReset(pager)
+		return
+	}
+	previous := pager.savepoints[th-1]
+	for _, savepoint := range pager.savepoints[th:] {
+		for pageTh, image := range savepoint.images {
+			if _, ok := previous.images[pageTh]; !ok && pageTh < previous.pagesCount {
+				previous.images[pageTh] = image
+			} else {
+				savepointDropImage(pager, image)
+			}
+		}
+	}
+	pager.savepoints = pager.savepoints[:th]
+}
+
+// 删除所有savepoint和spill文件, 事务结束时调用
+func savepointReset(pager *Pager) {
+	pager.savepoints = nil
+	spill := pager.spill
+	spill.memoryImages = 0
+	if spill.fileDescriptor != nil {
+		// 删除失败时残留的文件不影响数据库, 下次写入时被截断
+		_ = spill.fileDescriptor.Close()
+		_ = os.Remove(spill.filePath)
+		spill.fileDescriptor = nil
+		spill.size = 0
+	}
+}
+
+// 页面恢复到第th个savepoint建立时的内容, 之后建立的savepoint被删除, 这个savepoint本身保留
+func savepointRollback(pager *Pager, th int) error {
+	target := pager.savepoints[th]
+
+	// 先丢弃savepoint之后新申请的页面
+	for pageTh, page := range pager.Pages {
+		if pageTh >= target.pagesCount {
+			pager.lru.Remove(page.lruElement)
+			delete(pager.Pages, pageTh)
+		}
+	}
+	pager.pagesCount = target.pagesCount
+
+	// 从新到旧恢复, 越早的savepoint保存的内容越接近target建立时的状态
+	for i := len(pager.savepoints) - 1; i >= th; i-- {
+		for pageTh, image := range pager.savepoints[i].images {
+			if pageTh < target.pagesCount {
+				data, err := savepointImageData(pager, pageTh, image)
+				if err != nil {
+					return err
+				}
+				page, err := getPage(pager, pageTh)
+				if err != nil {
+					return err
+				}
+				// 不经过markDirty, 恢复的内容不需要再保存到savepoint中
+				*page.data = append([]byte{}, data...)
+				page.dirty = true
+			}
+			savepointDropImage(pager, image)
+			delete(pager.savepoints[i].images, pageTh)
+		}
+	}
+
+	pager.savepoints = pager.savepoints[:th+1]
+	return nil
+}
+
+func executeSavepoint(statement *Statement, database *Database) error {
+	if !database.Pager.inTransaction {
+		return ErrNoTransaction
+	}
+	savepointBegin(database.Pager, statement.SavepointName)
+	return nil
+}
+
+// RELEASE: 删除这个savepoint以及之后建立的savepoint
+func executeRelease(statement *Statement, database *Database) error {
+	th := savepointFind(database.Pager, statement.SavepointName)
+	if th < 0 {
+		return ErrNoSuchSavepoint
+	}
+	savepointRelease(database.Pager, th)
+	return nil
+}
+
+// ROLLBACK TO: 回滚到这个savepoint, 这个savepoint本身保留
+func executeRollbackTo(statement *Statement, database *Database) error {
+	th := savepointFind(database.Pager, statement.SavepointName)
+	if th < 0 {
+		return ErrNoSuchSavepoint
+	}
+	database.schemaLoaded = false
+	return savepointRollback(database.Pager, th)
+}
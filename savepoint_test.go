@@ -0,0 +1,108 @@
+package renekton
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"testing"
+)
+
+// cache很小, savepoint之后修改过的页面被换出, ROLLBACK TO时同样恢复.
+// 嵌套的savepoint: ROLLBACK TO只撤销内层的修改, RELEASE保留修改并合并到外层.
+// 保存的页面内容超过cache大小的部分写入spill文件, 事务结束时删除
+func TestSavepoint(t *testing.T) {
+	for _, journal := range testJournalModes {
+		t.Run(journal.name, func(t *testing.T) {
+			db, path := testOpen(t, journal.mode, 10)
+			pager := db.database.Pager
+			check := func(err error) {
+				t.Helper()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			// spilled为true时保存的页面内容应当有一部分写在spill文件中
+			checkSpill := func(spilled bool) {
+				t.Helper()
+				if pager.spill.memoryImages > pager.maxCachedPages {
+					t.Fatalf("%d savepoint images in memory, cache size %d", pager.spill.memoryImages, pager.maxCachedPages)
+				}
+				_, err := os.Stat(path + "-savepoint")
+				if spilled && (err != nil || pager.spill.size == 0) {
+					t.Fatalf("savepoint images not spilled: %v", err)
+				}
+				if !spilled && (!errors.Is(err, os.ErrNotExist) || pager.spill.memoryImages != 0) {
+					t.Fatalf("savepoint file left after commit: %v, %d images in memory", err, pager.spill.memoryImages)
+				}
+			}
+			check(db.Begin())
+			want := map[uint32]string{}
+			for id := uint32(0); id < 40; id++ {
+				testInsert(t, db, want, id)
+			}
+
+			// 插入和修改之后回滚到a, 页面数超过cache, 被换出的dirty页面也恢复
+			check(db.Savepoint("a"))
+			atA := maps.Clone(want)
+			pagesCount := pager.pagesCount
+			for id := uint32(40); id < 80; id++ {
+				testInsert(t, db, want, id)
+			}
+			for id := uint32(0); id < 40; id += 3 {
+				testUpdate(t, db, want, id, "a@example.com")
+			}
+			if uint32(len(pager.Pages)) >= pager.pagesCount {
+				t.Fatalf("all %d pages cached", pager.pagesCount)
+			}
+			checkSpill(true)
+			check(db.RollbackTo("a"))
+			want = maps.Clone(atA)
+			checkRows(t, db, want)
+			if pager.pagesCount != pagesCount {
+				t.Fatalf("%d pages after rollback to, want %d", pager.pagesCount, pagesCount)
+			}
+
+			// a仍然存在; 在a中嵌套b, 回滚到b只撤销b之后的修改
+			for id := uint32(0); id < 40; id += 2 {
+				testUpdate(t, db, want, id, fmt.Sprintf("a%d@example.com", id))
+			}
+			check(db.Savepoint("b"))
+			atB := maps.Clone(want)
+			for id := uint32(1); id < 40; id += 2 {
+				testDelete(t, db, want, id)
+			}
+			check(db.RollbackTo("b"))
+			want = maps.Clone(atB)
+			checkRows(t, db, want)
+			checkSpill(true)
+
+			// RELEASE b之后b的修改保留, 属于a, 回滚到a时与a之后的其他修改一起撤销
+			for id := uint32(40); id < 60; id++ {
+				testInsert(t, db, want, id)
+			}
+			check(db.Release("b"))
+			checkRows(t, db, want)
+			if err := db.Release("b"); !errors.Is(err, ErrNoSuchSavepoint) {
+				t.Fatalf("release b twice: %v", err)
+			}
+			check(db.Savepoint("c"))
+			for id := uint32(60); id < 70; id++ {
+				testInsert(t, db, want, id)
+			}
+			check(db.Release("c"))
+			checkRows(t, db, want)
+			checkSpill(true)
+			check(db.RollbackTo("a"))
+			checkRows(t, db, atA)
+			check(db.Release("a"))
+			check(db.Commit())
+			checkSpill(false)
+			db.Close()
+
+			db = testReopen(t, path, journal.mode)
+			defer db.Close()
+			checkRows(t, db, atA)
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package renekton
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// ScanRange返回的主键
+func scanRangeIds(t *testing.T, db *DB, low, high int64, limit int) []int64 {
+	t.Helper()
+	ids := []int64{}
+	err := db.ScanRange("users", []any{low}, []any{high}, func(row *Row) bool {
+		ids = append(ids, row.Values[0].(int64))
+		return len(ids) != limit
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+// 主键为偶数0, 2, ..., 1998, 每个叶子节点只能放下几行
+func TestScanRange(t *testing.T) {
+	db, path := testOpen(t, JOURNAL_MODE_WAL, 0)
+	if err := db.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	model := map[uint32]string{}
+	for id := uint32(0); id < 2000; id += 2 {
+		testInsert(t, db, model, id)
+	}
+	if err := db.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	between := func(low, high int64) []int64 {
+		ids := []int64{}
+		for id := max(low, 0); id < min(high, 2000); id++ {
+			if id%2 == 0 {
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+
+	tests := []struct{ low, high int64 }{
+		{100, 120},
+		{101, 121},
+		{0, 1},
+		{-10, 5},
+		{1990, math.MaxInt64},
+		{math.MinInt64, math.MaxInt64},
+		{500, 500},
+		{600, 400},
+		{2000, 3000},
+	}
+	for _, test := range tests {
+		got := scanRangeIds(t, db, test.low, test.high, -1)
+		if want := between(test.low, test.high); !reflect.DeepEqual(got, want) {
+			t.Fatalf("[%d, %d): got %v, want %v", test.low, test.high, got, want)
+		}
+	}
+	// fn返回false时停止
+	if got := scanRangeIds(t, db, 1001, 1500, 3); !reflect.DeepEqual(got, []int64{1002, 1004, 1006}) {
+		t.Fatalf("early stop: got %v", got)
+	}
+	if err := db.ScanRange("nosuch", []any{0}, []any{1}, func(*Row) bool { return true }); err == nil {
+		t.Fatal("scan of a missing table succeeded")
+	}
+	db.Close()
+
+	// 重新打开之后buffer pool为空, 扫描读入的页面只有根节点到第一个叶子节点的路径和范围内的叶子节点,
+	// 以及最后一个叶子节点之后的一个叶子节点(读到它的第一个key才知道超过了上界); 溢出页面只有返回的行和之后一行的
+	for _, test := range []struct {
+		low, high int64
+		limit     int
+	}{{1000, 1040, -1}, {1000, 2000, 3}} {
+		db = testReopen(t, path, JOURNAL_MODE_WAL)
+		table := testTable(t, db, "users")
+		pager := db.database.Pager
+		cached := map[uint32]bool{}
+		for pageTh := range pager.Pages {
+			cached[pageTh] = true
+		}
+		ids := scanRangeIds(t, db, test.low, test.high, test.limit)
+		low, last := appendIntegerKey(nil, test.low), appendIntegerKey(nil, ids[len(ids)-1])
+		leaves, afterLast, overflows := 0, 0, 0
+		for pageTh, page := range pager.Pages {
+			if cached[pageTh] || getNodeType(page) == NODE_INTERNAL {
+				continue
+			}
+			if getNodeType(page) != NODE_LEAF {
+				overflows++
+				continue
+			}
+			first := page.LeafNodeGetKey(0)
+			switch {
+			case bytes.Compare(first, last) <= 0 && bytes.Compare(page.LeafNodeGetKey(page.LeafNodeGetCellsCount()-1), low) >= 0:
+				leaves++
+			case bytes.Compare(first, last) > 0:
+				afterLast++
+			default:
+				t.Fatalf("[%d, %d): read leaf %d with keys before the range", test.low, test.high, pageTh)
+			}
+		}
+		if leaves == 0 || afterLast > 1 || overflows > len(ids)+1 {
+			t.Fatalf("[%d, %d): read %d leaves in range, %d after, %d overflow pages", test.low, test.high, leaves, afterLast, overflows)
+		}
+		read := len(pager.Pages) - len(cached)
+		_, depth := checkBtree(t, table)
+		if depth < 2 {
+			t.Fatalf("depth %d", depth)
+		}
+		if read > leaves+afterLast+overflows+depth {
+			t.Fatalf("[%d, %d): read %d pages for %d leaves", test.low, test.high, read, leaves)
+		}
+		db.Close()
+	}
+}
+
+// 组合主键的范围按第一列, 第二列的顺序比较; 扫描只读入第一列在范围内的叶子节点
+func TestScanRangeCompositeKey(t *testing.T) {
+	db, path := testOpen(t, JOURNAL_MODE_WAL, 0)
+	if _, err := db.Exec("create table c (a integer, b text, v text, primary key (a, b))"); err != nil {
+		t.Fatal(err)
+	}
+	check(t, db.Begin())
+	var keys [][]any
+	for a := int64(0); a < 100; a++ {
+		for b := 0; b < 10; b++ {
+			key := []any{a, fmt.Sprint("b", b)}
+			check(t, db.Insert("c", a, key[1], strings.Repeat("v", 300)))
+			keys = append(keys, key)
+		}
+	}
+	check(t, db.Commit())
+	scan := func(low, high []any, limit int) [][]any {
+		t.Helper()
+		got := [][]any{}
+		err := db.ScanRange("c", low, high, func(row *Row) bool {
+			got = append(got, row.Values[:2])
+			return len(got) != limit
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	between := func(low, high []any) [][]any {
+		want := [][]any{}
+		for _, key := range keys {
+			if compareKeyValues(key, low) >= 0 && compareKeyValues(key, high) < 0 {
+				want = append(want, key)
+			}
+		}
+		return want
+	}
+
+	tests := []struct{ low, high []any }{
+		{[]any{int64(10), "b5"}, []any{int64(12), "b3"}},
+		{[]any{int64(10), "b5"}, []any{int64(10), "b7"}},
+		{[]any{int64(10), "b55"}, []any{int64(11), ""}},
+		{[]any{int64(-1), ""}, []any{int64(1), "b0"}},
+		{[]any{int64(98), "b9"}, []any{int64(math.MaxInt64), ""}},
+		{[]any{int64(20), "b5"}, []any{int64(20), "b5"}},
+		{[]any{int64(30), "b5"}, []any{int64(20), "b5"}},
+	}
+	for _, test := range tests {
+		if got, want := scan(test.low, test.high, -1), between(test.low, test.high); !reflect.DeepEqual(got, want) {
+			t.Fatalf("[%v, %v): got %v, want %v", test.low, test.high, got, want)
+		}
+	}
+	if got := scan([]any{int64(10), "b8"}, []any{int64(50), ""}, 3); !reflect.DeepEqual(got, [][]any{{int64(10), "b8"}, {int64(10), "b9"}, {int64(11), "b0"}}) {
+		t.Fatalf("early stop: got %v", got)
+	}
+	db.Close()
+
+	db = testReopen(t, path, JOURNAL_MODE_WAL)
+	defer db.Close()
+	pager := db.database.Pager
+	cached := map[uint32]bool{}
+	for pageTh := range pager.Pages {
+		cached[pageTh] = true
+	}
+	low, high := []any{int64(40), "b5"}, []any{int64(42), "b3"}
+	if got := scan(low, high, -1); len(got) != 18 {
+		t.Fatalf("got %d rows", len(got))
+	}
+	// 第一列上的条件确定了扫描的范围: 读入的叶子节点都有第一列在[40, 42]之间的key
+	first, last := appendIntegerKey(nil, 40), appendIntegerKey(nil, 43)
+	leaves := 0
+	for pageTh, page := range pager.Pages {
+		if cached[pageTh] || getNodeType(page) != NODE_LEAF {
+			continue
+		}
+		leaves++
+		if bytes.Compare(page.LeafNodeGetKey(page.LeafNodeGetCellsCount()-1), first) < 0 || bytes.Compare(page.LeafNodeGetKey(0), last) > 0 {
+			t.Fatalf("read leaf %d outside of the range", pageTh)
+		}
+	}
+	if _, depth := checkBtree(t, testTable(t, db, "c")); depth < 2 || leaves == 0 {
+		t.Fatalf("depth %d, %d leaves", depth, leaves)
+	}
+}
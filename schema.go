@@ -0,0 +1,287 @@
+package renekton
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+/*
+表结构: 由CREATE TABLE语句定义, 语句原文保存在catalog中.
+一行序列化成一条变长记录: 记录头为每一列的类型码, 之后依次是每一列的内容
+*/
+
+type ColumnType int
+
+const (
+	COLUMN_TYPE_INTEGER ColumnType = iota // int64
+	COLUMN_TYPE_TEXT                      // string
+	COLUMN_TYPE_REAL                      // float64
+	COLUMN_TYPE_BLOB                      // []byte
+)
+
+// 列中非NULL的值的类型
+func (t ColumnType) valueType() ValueType {
+	switch t {
+	case COLUMN_TYPE_INTEGER:
+		return VALUE_INTEGER
+	case COLUMN_TYPE_TEXT:
+		return VALUE_TEXT
+	case COLUMN_TYPE_REAL:
+		return VALUE_REAL
+	}
+	return VALUE_BLOB
+}
+
+type Column struct {
+	Name          string
+	Type          ColumnType
+	Size          uint32 // TEXT(n)的最大字节数, 0表示不限制
+	NotNull       bool   // 主键的列都是NOT NULL
+	PrimaryKey    bool   // 是否为主键中的一列
+	Autoincrement bool   // 分配的主键不会重复使用, 已经分配过的最大值保存在SEQUENCE_TABLE中
+	Unique        bool   // 由自动创建的唯一索引保证, 单列的主键本身就是唯一的
+}
+
+type Schema struct {
+	Name       string
+	Columns    []*Column
+	PrimaryKey []int  // 主键各列的序号, 按主键中的顺序
+	SQL        string // CREATE TABLE语句原文
+}
+
+func (s *Schema) ColumnNames() []string {
+	names := make([]string, len(s.Columns))
+	for i, column := range s.Columns {
+		names[i] = column.Name
+	}
+	return names
+}
+
+// 列名不区分大小写, 没有找到返回-1
+func (s *Schema) columnIndex(name string) int {
+	for i, column := range s.Columns {
+		if strings.EqualFold(column.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// 检查CREATE TABLE语句并生成表结构
+func schemaFromCreateTable(stmt *CreateTableStmt) (*Schema, error) {
+	schema := &Schema{Name: stmt.Name.Name, SQL: stmt.SQL}
+	for i, def := range stmt.Columns {
+		if schema.columnIndex(def.Name.Name) >= 0 {
+			return nil, &SQLError{Err: ErrSyntax, Pos: def.Name.Pos, Near: def.Name.Name, Msg: "duplicate column"}
+		}
+		column := &Column{Name: def.Name.Name, NotNull: def.NotNull || def.PrimaryKey, PrimaryKey: def.PrimaryKey,
+			Autoincrement: def.Autoincrement, Unique: def.Unique}
+		typeName := strings.ToUpper(def.Type.Name)
+		if def.Size != nil && typeName != "TEXT" && typeName != "VARCHAR" && typeName != "CHAR" {
+			return nil, &SQLError{Err: ErrSyntax, Pos: def.Size.Pos, Msg: "only TEXT columns have a size"}
+		}
+		switch typeName {
+		case "INTEGER", "INT":
+			column.Type = COLUMN_TYPE_INTEGER
+		case "REAL", "FLOAT", "DOUBLE":
+			column.Type = COLUMN_TYPE_REAL
+		case "BLOB":
+			column.Type = COLUMN_TYPE_BLOB
+		case "TEXT", "VARCHAR", "CHAR":
+			column.Type = COLUMN_TYPE_TEXT
+			if def.Size != nil {
+				if def.Size.Value <= 0 || def.Size.Value > math.MaxUint32 {
+					return nil, &SQLError{Err: ErrSyntax, Pos: def.Size.Pos, Msg: fmt.Sprintf("column size must be between 1 and %d", uint32(math.MaxUint32))}
+				}
+				column.Size = uint32(def.Size.Value)
+			}
+		default:
+			return nil, &SQLError{Err: ErrSyntax, Pos: def.Type.Pos, Near: def.Type.Name, Msg: "unknown column type"}
+		}
+		if column.Autoincrement && (!column.PrimaryKey || column.Type != COLUMN_TYPE_INTEGER) {
+			return nil, &SQLError{Err: ErrSyntax, Pos: def.Name.Pos, Near: def.Name.Name, Msg: "AUTOINCREMENT is only allowed on an INTEGER PRIMARY KEY"}
+		}
+		if column.PrimaryKey && column.Type != COLUMN_TYPE_INTEGER && column.Type != COLUMN_TYPE_TEXT {
+			return nil, &SQLError{Err: ErrSyntax, Pos: def.Type.Pos, Near: def.Type.Name, Msg: "primary key must be INTEGER or TEXT"}
+		}
+		if column.PrimaryKey {
+			if len(schema.PrimaryKey) > 0 {
+				return nil, &SQLError{Err: ErrSyntax, Pos: def.Name.Pos, Near: def.Name.Name, Msg: "table has more than one primary key"}
+			}
+			schema.PrimaryKey = []int{i}
+		}
+		schema.Columns = append(schema.Columns, column)
+	}
+	if len(stmt.PrimaryKey) > 0 && len(schema.PrimaryKey) > 0 {
+		identifier := stmt.PrimaryKey[0]
+		return nil, &SQLError{Err: ErrSyntax, Pos: identifier.Pos, Near: identifier.Name, Msg: "table has more than one primary key"}
+	}
+	for _, identifier := range stmt.PrimaryKey {
+		th := schema.columnIndex(identifier.Name)
+		if th < 0 {
+			return nil, &SQLError{Err: ErrNoSuchColumn, Pos: identifier.Pos, Near: identifier.Name}
+		}
+		column := schema.Columns[th]
+		if column.PrimaryKey {
+			return nil, &SQLError{Err: ErrSyntax, Pos: identifier.Pos, Near: identifier.Name, Msg: "duplicate column in primary key"}
+		}
+		if column.Type != COLUMN_TYPE_INTEGER && column.Type != COLUMN_TYPE_TEXT {
+			return nil, &SQLError{Err: ErrSyntax, Pos: identifier.Pos, Near: identifier.Name, Msg: "primary key must be INTEGER or TEXT"}
+		}
+		column.PrimaryKey = true
+		column.NotNull = true
+		schema.PrimaryKey = append(schema.PrimaryKey, th)
+	}
+	if len(schema.PrimaryKey) == 0 {
+		return nil, &SQLError{Err: ErrSyntax, Pos: stmt.Name.Pos, Near: stmt.Name.Name, Msg: "table must have a PRIMARY KEY"}
+	}
+	if len(schema.PrimaryKey) == 1 {
+		// 单列的主键不需要另外的唯一索引
+		schema.Columns[schema.PrimaryKey[0]].Unique = false
+	}
+	return schema, nil
+}
+
+// 单列的INTEGER主键的序号, 插入时没有给出主键会自动分配. 其它表返回-1
+func (s *Schema) rowIdColumn() int {
+	if len(s.PrimaryKey) == 1 && s.Columns[s.PrimaryKey[0]].Type == COLUMN_TYPE_INTEGER {
+		return s.PrimaryKey[0]
+	}
+	return -1
+}
+
+// 是否有AUTOINCREMENT的主键
+func (s *Schema) autoincrement() bool {
+	th := s.rowIdColumn()
+	return th >= 0 && s.Columns[th].Autoincrement
+}
+
+// 一行数据在表的B+树中的key: 主键各列的值依次编码
+func (s *Schema) rowKey(row *Row) []byte {
+	var key []byte
+	for _, th := range s.PrimaryKey {
+		key = appendValueKey(key, row.Values[th])
+	}
+	return key
+}
+
+/*
+ * Record Layout
+ * 记录头长度(varint) | 每一列的类型码(varint) | 每一列的内容
+ * 类型码: 0 NULL, 1/2/3/4 为1/2/4/8字节的整数(大端), 7 为8字节的浮点数(大端),
+ * 大于等于12的偶数N为(N-12)/2字节的BLOB, 大于等于13的奇数N为(N-13)/2字节的字符串
+ */
+const (
+	RECORD_TYPE_NULL  = uint64(0)
+	RECORD_TYPE_INT8  = uint64(1)
+	RECORD_TYPE_INT16 = uint64(2)
+	RECORD_TYPE_INT32 = uint64(3)
+	RECORD_TYPE_INT64 = uint64(4)
+	RECORD_TYPE_REAL  = uint64(7)
+	RECORD_TYPE_BLOB  = uint64(12)
+	RECORD_TYPE_TEXT  = uint64(13)
+)
+
+// 能保存n的最短的整数类型码
+func recordIntegerType(n int64) uint64 {
+	switch {
+	case n >= math.MinInt8 && n <= math.MaxInt8:
+		return RECORD_TYPE_INT8
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		return RECORD_TYPE_INT16
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		return RECORD_TYPE_INT32
+	}
+	return RECORD_TYPE_INT64
+}
+
+// 类型码对应的内容长度, 不认识的类型码返回false
+func recordTypeSize(recordType uint64) (uint64, bool) {
+	switch {
+	case recordType == RECORD_TYPE_NULL:
+		return 0, true
+	case recordType >= RECORD_TYPE_INT8 && recordType <= RECORD_TYPE_INT32:
+		return 1 << (recordType - 1), true
+	case recordType == RECORD_TYPE_INT64 || recordType == RECORD_TYPE_REAL:
+		return 8, true
+	case recordType >= RECORD_TYPE_BLOB:
+		return (recordType - RECORD_TYPE_BLOB) / 2, true
+	}
+	return 0, false
+}
+
+// 按表结构把一行序列化成一条记录, 长度取决于内容
+func serializeRow(schema *Schema, row *Row) []byte {
+	var types, body []byte
+	for i := range schema.Columns {
+		switch value := row.Values[i].(type) {
+		case nil:
+			types = binary.AppendUvarint(types, RECORD_TYPE_NULL)
+		case int64:
+			recordType := recordIntegerType(value)
+			size, _ := recordTypeSize(recordType)
+			var buf [8]byte
+			binary.BigEndian.PutUint64(buf[:], uint64(value))
+			types = binary.AppendUvarint(types, recordType)
+			body = append(body, buf[8-size:]...)
+		case float64:
+			types = binary.AppendUvarint(types, RECORD_TYPE_REAL)
+			body = binary.BigEndian.AppendUint64(body, math.Float64bits(value))
+		case string:
+			types = binary.AppendUvarint(types, RECORD_TYPE_TEXT+2*uint64(len(value)))
+			body = append(body, value...)
+		case []byte:
+			types = binary.AppendUvarint(types, RECORD_TYPE_BLOB+2*uint64(len(value)))
+			body = append(body, value...)
+		}
+	}
+	record := binary.AppendUvarint(nil, uint64(len(types)))
+	record = append(record, types...)
+	return append(record, body...)
+}
+
+// 反序列化, 返回的行不引用source. 记录和表结构不一致时返回错误
+func deserializeRow(schema *Schema, source []byte) (*Row, error) {
+	headerSize, n := binary.Uvarint(source)
+	if n <= 0 || headerSize > uint64(len(source)-n) {
+		return nil, errors.New("invalid record header size")
+	}
+	types, body := source[n:n+int(headerSize)], source[n+int(headerSize):]
+	row := &Row{Values: make([]Value, len(schema.Columns))}
+	for i, column := range schema.Columns {
+		recordType, n := binary.Uvarint(types)
+		if n <= 0 {
+			return nil, fmt.Errorf("missing type of column %s", column.Name)
+		}
+		types = types[n:]
+		size, ok := recordTypeSize(recordType)
+		if !ok || size > uint64(len(body)) {
+			return nil, fmt.Errorf("invalid type %d of column %s", recordType, column.Name)
+		}
+		data := body[:size]
+		body = body[size:]
+		switch {
+		case recordType == RECORD_TYPE_NULL && !column.NotNull:
+			row.Values[i] = nil
+		case column.Type == COLUMN_TYPE_INTEGER && recordType >= RECORD_TYPE_INT8 && recordType <= RECORD_TYPE_INT64:
+			var buf [8]byte
+			if data[0]&0x80 != 0 {
+				buf = [8]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+			}
+			copy(buf[8-size:], data)
+			row.Values[i] = int64(binary.BigEndian.Uint64(buf[:]))
+		case column.Type == COLUMN_TYPE_REAL && recordType == RECORD_TYPE_REAL:
+			row.Values[i] = math.Float64frombits(binary.BigEndian.Uint64(data))
+		case column.Type == COLUMN_TYPE_TEXT && recordType >= RECORD_TYPE_TEXT && recordType%2 == 1:
+			row.Values[i] = string(data)
+		case column.Type == COLUMN_TYPE_BLOB && recordType >= RECORD_TYPE_BLOB && recordType%2 == 0:
+			row.Values[i] = append([]byte{}, data...)
+		default:
+			return nil, fmt.Errorf("type %d does not match column %s", recordType, column.Name)
+		}
+	}
+	return row, nil
+}
@@ -0,0 +1,148 @@
+package renekton
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// 违反UNIQUE约束时返回ErrUniqueViolation, 错误信息中有列名, 失败的语句不修改表和索引
+func TestUnique(t *testing.T) {
+	db, _ := testOpen(t, JOURNAL_MODE_WAL, 0)
+	defer db.Close()
+	for _, sql := range []string{
+		"create table u (id integer primary key, email text unique, name text)",
+		"create unique index u_name on u (name)",
+		"insert into u values (1, 'a@example.com', 'alice')",
+		"insert into u values (2, 'b@example.com', 'bob')",
+	} {
+		if _, err := db.Exec(sql); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := map[uint32][]any{1: {"a@example.com", "alice"}, 2: {"b@example.com", "bob"}}
+	checkUnique := func() {
+		t.Helper()
+		table := testTable(t, db, "u")
+		if len(table.indexes) != 2 {
+			t.Fatalf("%d indexes", len(table.indexes))
+		}
+		checkIndexes(t, table)
+		got := map[uint32][]any{}
+		err := db.Scan("u", func(row *Row) bool {
+			got[uint32(row.Values[0].(int64))] = row.Values[1:]
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("rows %v, want %v", got, want)
+		}
+	}
+	violation := func(sql, column string) {
+		t.Helper()
+		_, err := db.Exec(sql)
+		if !errors.Is(err, ErrUniqueViolation) || !strings.Contains(err.Error(), column) {
+			t.Fatalf("%s: got %v, want a UNIQUE violation on %s", sql, err, column)
+		}
+		checkUnique()
+	}
+
+	violation("insert into u values (3, 'a@example.com', 'carol')", "email")
+	violation("insert into u values (3, 'c@example.com', 'bob')", "name")
+	violation("update u set email = 'a@example.com' where id = 2", "email")
+	violation("update u set name = 'alice', email = 'x@example.com' where id = 2", "name")
+
+	// 修改成自己原来的值不冲突; 一行改掉的值可以被另一行使用
+	for _, sql := range []string{
+		"update u set email = 'a@example.com', name = 'alice' where id = 1",
+		"update u set email = 'c@example.com' where id = 1",
+		"update u set email = 'a@example.com' where id = 2",
+		"delete from u where id = 1",
+		"insert into u values (3, 'b@example.com', 'alice')",
+	} {
+		if _, err := db.Exec(sql); err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+	}
+	want = map[uint32][]any{2: {"a@example.com", "bob"}, 3: {"b@example.com", "alice"}}
+	checkUnique()
+
+	// 事务中失败的语句不影响之前的语句
+	if err := db.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("insert into u values (4, 'd@example.com', 'dave')"); err != nil {
+		t.Fatal(err)
+	}
+	want[4] = []any{"d@example.com", "dave"}
+	violation("insert into u values (5, 'd@example.com', 'eve')", "email")
+	if err := db.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	checkUnique()
+
+	// NULL与任何值都不相等, 唯一列中可以有多个NULL
+	for _, sql := range []string{
+		"insert into u values (6, NULL, 'frank')",
+		"insert into u (id, name) values (7, 'grace')",
+		"update u set name = NULL where id = 6",
+		"update u set name = NULL where id = 7",
+	} {
+		if _, err := db.Exec(sql); err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+	}
+	want[6] = []any{nil, nil}
+	want[7] = []any{nil, nil}
+	checkUnique()
+	violation("update u set email = 'a@example.com' where id = 6", "email")
+	for _, id := range []int64{6, 7} {
+		check(t, db.Delete("u", id))
+		delete(want, uint32(id))
+	}
+
+	// 超长的值在索引中只保存前缀, 前缀相同的值不冲突, 完全相同的值仍然冲突
+	prefix := strings.Repeat("p", int(INDEX_MAX_VALUE_KEY_SIZE))
+	for id, suffix := range map[int64]string{8: "x", 9: "y"} {
+		check(t, db.Insert("u", id, prefix+suffix, nil))
+		want[uint32(id)] = []any{prefix + suffix, nil}
+	}
+	checkUnique()
+	violation("insert into u values (10, '"+prefix+"x', NULL)", "email")
+	violation("update u set email = '"+prefix+"y' where id = 8", "email")
+	if _, err := db.Exec("update u set email = '" + prefix + "y' where id = 9"); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int64{8, 9} {
+		check(t, db.Delete("u", id))
+		delete(want, uint32(id))
+	}
+
+	// 已有重复的值时不能建立唯一索引
+	if _, err := db.Exec("insert into u values (5, 'e@example.com', 'eve')"); err != nil {
+		t.Fatal(err)
+	}
+	want[5] = []any{"e@example.com", "eve"}
+	if _, err := db.Exec("update u set name = 'dave' where id = 5"); !errors.Is(err, ErrUniqueViolation) {
+		t.Fatalf("update: %v", err)
+	}
+	if _, err := db.Exec("drop index u_name"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("update u set name = 'dave' where id = 5"); err != nil {
+		t.Fatal(err)
+	}
+	want[5] = []any{"e@example.com", "dave"}
+	_, err := db.Exec("create unique index u_name on u (name)")
+	if !errors.Is(err, ErrUniqueViolation) || !strings.Contains(err.Error(), "name") {
+		t.Fatalf("create unique index over duplicates: %v", err)
+	}
+	table := testTable(t, db, "u")
+	if len(table.indexes) != 1 {
+		t.Fatalf("%d indexes after failed create index", len(table.indexes))
+	}
+	checkIndexes(t, table)
+}
@@ -0,0 +1,114 @@
+package renekton
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+/*
+SQL的值: 行中的列, 字面量, 绑定的参数和表达式的结果都使用同一种表示.
+NULL为nil, INTEGER为int64, REAL为float64, TEXT为string, BLOB为[]byte
+*/
+
+type Value = any
+
+type ValueType int
+
+const (
+	VALUE_NULL ValueType = iota
+	VALUE_INTEGER
+	VALUE_REAL
+	VALUE_TEXT
+	VALUE_BLOB
+)
+
+func (t ValueType) String() string {
+	switch t {
+	case VALUE_NULL:
+		return "null"
+	case VALUE_INTEGER:
+		return "integer"
+	case VALUE_REAL:
+		return "real"
+	case VALUE_TEXT:
+		return "text"
+	}
+	return "blob"
+}
+
+func valueType(value Value) ValueType {
+	switch value.(type) {
+	case nil:
+		return VALUE_NULL
+	case int64:
+		return VALUE_INTEGER
+	case float64:
+		return VALUE_REAL
+	case string:
+		return VALUE_TEXT
+	case []byte:
+		return VALUE_BLOB
+	}
+	panic(fmt.Sprintf("unsupported value %T", value))
+}
+
+// 比较两个值, 返回-1, 0, 1. 顺序为NULL < 数字(INTEGER和REAL按数值) < TEXT < BLOB, 字符串按字节比较.
+// 这是排序用的全序, NULL等于NULL; SQL中的比较运算见where.go
+func compareValues(a, b Value) int {
+	typeA, typeB := valueClass(a), valueClass(b)
+	if typeA != typeB {
+		if typeA < typeB {
+			return -1
+		}
+		return 1
+	}
+	switch a := a.(type) {
+	case nil:
+		return 0
+	case int64:
+		if b, ok := b.(int64); ok {
+			return compareOrdered(a, b)
+		}
+		return -compareIntegerReal(b.(float64), a)
+	case float64:
+		if b, ok := b.(float64); ok {
+			return compareOrdered(a, b)
+		}
+		return compareIntegerReal(a, b.(int64))
+	case string:
+		return strings.Compare(a, b.(string))
+	}
+	return bytes.Compare(a.([]byte), b.([]byte))
+}
+
+// INTEGER和REAL属于同一类, 按数值比较
+func valueClass(value Value) ValueType {
+	if valueType(value) == VALUE_REAL {
+		return VALUE_INTEGER
+	}
+	return valueType(value)
+}
+
+func compareOrdered[T int64 | float64](a, b T) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+// REAL和INTEGER比较. 超过2^53的整数转成float64时会丢失精度, 先比较整数部分
+func compareIntegerReal(f float64, n int64) int {
+	if f >= 1<<63 {
+		return 1
+	}
+	if f < -(1 << 63) {
+		return -1
+	}
+	if c := compareOrdered(int64(f), n); c != 0 {
+		return c
+	}
+	return compareOrdered(f, float64(int64(f)))
+}
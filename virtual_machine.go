@@ -1,284 +1,809 @@
-package main
-
-/*
-#include <stdio.h>
-#include <stdlib.h>
-*/
-import "C"
+package renekton
 
 import (
+	"bytes"
+	"container/list"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"sort"
 )
 
-func PrintError(errMsg string) {
-	fmt.Println(errMsg)
-	os.Exit(0)
-}
-
-// 获取已有的节点/申请新的节点
+// 获取已有的节点/申请新的节点, 不在内存中的页面按需从磁盘加载
 func getPage(pager *Pager, pageIndex uint32) (*Page, error) {
-	if pageIndex > TABLE_MAX_PAGES {
-		fmt.Println("getPage pageNum too large")
-		return nil, errors.New("getPage pageNum too large")
+	if pageIndex >= TABLE_MAX_PAGES {
+		return nil, fmt.Errorf("%w: %d", ErrPageOutOfRange, pageIndex)
 	}
-	if pager.Pages[pageIndex] == nil {
+	page, ok := pager.Pages[pageIndex]
+	if !ok {
 
 		// miss cache
 		tempPage := make([]byte, PAGE_SIZE)
-		pagesCount := pager.fileLength / PAGE_SIZE
-		if (pager.fileLength % PAGE_SIZE) > 0 {
-			pagesCount++
-		}
-		// 访问的page位于文件边缘
-		if pageIndex <= pagesCount {
-			_, err := pager.fileDescriptor.Seek(int64(pageIndex*PAGE_SIZE), io.SeekStart)
-			if err != nil {
-				fmt.Println("fileDescriptor seek failed, err = ", err)
-				os.Exit(0)
-			}
-			offset := pageIndex * PAGE_SIZE
-			_, err = pager.fileDescriptor.ReadAt(tempPage, int64(offset)) // 最多读tempPage的长度
-			if err != nil && err != io.EOF {
-				fmt.Println("fileDescriptor read failed, err = ", err)
-				os.Exit(0)
+		offset := int64(pageIndex) * int64(PAGE_SIZE)
+		// 先查WAL, 再查数据库文件. 页面总数之外的是新申请的page, 文件或WAL中残留的可能是被回滚的内容
+		if pageIndex < pager.pagesCount {
+			if walOffset, ok := walFindPage(pager.wal, pageIndex); ok {
+				if err := walReadPage(pager.wal, walOffset, tempPage); err != nil {
+					return nil, err
+				}
+			} else if offset < pager.fileLength {
+				_, err := pager.fileDescriptor.ReadAt(tempPage, offset) // 最多读tempPage的长度
+				if err != nil && err != io.EOF {
+					return nil, ioError(fmt.Sprintf("read page %d", pageIndex), err)
+				}
 			}
 		}
-		pager.Pages[pageIndex] = &Page{
-			&tempPage,
+		page = &Page{
+			data:   &tempPage,
+			pageTh: pageIndex,
+			pager:  pager,
 		}
+		page.lruElement = pager.lru.PushFront(page)
+		pager.Pages[pageIndex] = page
 		if pageIndex >= pager.pagesCount {
 			pager.pagesCount = pageIndex + 1
 		}
+		// 为新加载的页面腾出空间, 新页面本身不能被换出
+		page.pin()
+		err := pagerEvict(pager)
+		page.unpin()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		pager.lru.MoveToFront(page.lruElement)
 	}
-	return pager.Pages[pageIndex], nil
+
+	return page, nil
 }
 
-func doMetaCommand(inputBuffer *InputBuffer, table *Table) MetaCommandResult {
-	if inputBuffer.buffer == ".exit" {
-		dbClose(table)
-		return META_COMMAND_EXIT
-	} else if inputBuffer.buffer == ".constants" {
-		printConstants()
+// buffer pool超出上限时, 从最久未访问的页面开始换出: 跳过被pin住的页面, dirty页面先写回磁盘.
+// 写回失败的页面留在buffer pool中
+func pagerEvict(pager *Pager) error {
+	element := pager.lru.Back()
+	for uint32(len(pager.Pages)) > pager.maxCachedPages && element != nil {
+		page := element.Value.(*Page)
+		element = element.Prev()
+		if page.pinCount > 0 {
+			continue
+		}
+		if page.dirty {
+			if err := pagerFlush(pager, page.pageTh); err != nil {
+				return err
+			}
+		}
+		pager.lru.Remove(page.lruElement)
+		delete(pager.Pages, page.pageTh)
 	}
-	return META_COMMAND_UNRECOGNIZED_COMMAND
+	return nil
 }
 
-type ExecuteResult int
+func executeStatement(statement *Statement, database *Database) error {
+	switch statement.SType {
+	case STATEMENT_BEGIN:
+		return executeBegin(database)
+	case STATEMENT_COMMIT:
+		return executeCommit(database)
+	case STATEMENT_ROLLBACK:
+		return executeRollback(database)
+	case STATEMENT_SAVEPOINT:
+		return executeSavepoint(statement, database)
+	case STATEMENT_RELEASE:
+		return executeRelease(statement, database)
+	case STATEMENT_ROLLBACK_TO:
+		return executeRollbackTo(statement, database)
+	case STATEMENT_SELECT:
+		return executeSelect(statement, statement.Table, func(row *Row) bool {
+			result := &Row{Values: make([]any, len(statement.ResultColumns))}
+			for i, th := range statement.ResultColumns {
+				result.Values[i] = row.Values[th]
+			}
+			statement.Result = append(statement.Result, result)
+			return true
+		})
+	}
+	return executeWrite(statement, database)
+}
 
-const (
-	EXECUTE_SUCCESS ExecuteResult = iota
-	EXECUTE_TABLE_FULL
-	EXECUTE_FAILED
-	EXECUTE_DUPLICATE_KEY
-)
+// 写语句: 执行前建立一个语句级的savepoint, 执行(或自动提交)失败时撤销这条语句的全部修改,
+// 数据库回到语句执行之前的状态, 事务中之前的语句不受影响
+func executeWrite(statement *Statement, database *Database) error {
+	pager := database.Pager
+	statementSavepointTh := savepointBegin(pager, "")
 
-func executeStatement(statement *Statement, table *Table) ExecuteResult {
+	var err error
 	switch statement.SType {
 	case STATEMENT_INSERT:
-		return executeInsert(statement, table)
-	case STATEMENT_SELECT:
-		return executeSelect(statement, table)
+		err = executeInsert(statement, statement.Table)
+	case STATEMENT_DELETE:
+		err = executeDelete(statement, statement.Table)
+	case STATEMENT_UPDATE:
+		err = executeUpdate(statement, statement.Table)
+	case STATEMENT_CREATE_TABLE:
+		err = executeCreateTable(statement, database)
+	case STATEMENT_CREATE_INDEX:
+		err = executeCreateIndex(statement, database)
+	case STATEMENT_DROP_INDEX:
+		err = executeDropIndex(statement, database)
+	default:
+		err = ErrExecuteFailed
 	}
-	return EXECUTE_FAILED
-}
 
-func executeInsert(statement *Statement, table *Table) ExecuteResult {
-	page, err := getPage(table.Pager, table.rootPageCTh)
+	if err == nil && !pager.inTransaction {
+		err = pagerCommit(pager) // 事务之外的写语句自动提交
+	}
 	if err != nil {
-		os.Exit(0)
+		if rollbackErr := savepointRollback(pager, statementSavepointTh); rollbackErr != nil {
+			err = errors.Join(err, rollbackErr)
+		}
+		database.schemaLoaded = false // 回滚之后schema cookie可能被重复使用
+	}
+	savepointRelease(pager, statementSavepointTh)
+	if evictErr := pagerEvict(pager); err == nil {
+		err = evictErr
+	}
+	return err
+}
+
+func executeBegin(database *Database) error {
+	if database.Pager.inTransaction {
+		return ErrTransactionActive
+	}
+	database.Pager.inTransaction = true
+	return nil
+}
+
+// 提交失败时事务保持打开, 可以重试COMMIT或者ROLLBACK
+func executeCommit(database *Database) error {
+	if !database.Pager.inTransaction {
+		return ErrNoTransaction
+	}
+	if err := pagerCommit(database.Pager); err != nil {
+		return err
+	}
+	database.Pager.inTransaction = false
+	savepointReset(database.Pager)
+	return nil
+}
+
+func executeRollback(database *Database) error {
+	if !database.Pager.inTransaction {
+		return ErrNoTransaction
 	}
-	cellsCount := page.LeafNodeGetCellsCount()
+	database.Pager.inTransaction = false
+	savepointReset(database.Pager)
+	database.schemaLoaded = false
+	return pagerRollback(database.Pager)
+}
 
+func executeInsert(statement *Statement, table *Table) error {
 	rowToInsert := &statement.RowToInsert
-	curSor := tableFind(table, rowToInsert.Id)
-	if curSor.CellTh < cellsCount {
-		keyAtTh := page.LeafNodeGetKey(uint32(curSor.PageTh))
-		if keyAtTh == rowToInsert.Id {
-			// 主键冲突
-			return EXECUTE_DUPLICATE_KEY
+	rowIdColumn := table.schema.rowIdColumn()
+	if statement.AssignRowId {
+		id, err := tableNextRowId(table)
+		if err != nil {
+			return err
 		}
+		rowToInsert.Values[rowIdColumn] = id
+	}
+	key := table.schema.rowKey(rowToInsert)
+	if uint32(len(key)) > PRIMARY_KEY_MAX_SIZE {
+		return fmt.Errorf("%w: primary key of %s, %d bytes, max %d", ErrKeyTooLong, table.schema.Name, len(key), PRIMARY_KEY_MAX_SIZE)
 	}
+	curSor, err := tableFind(table, key)
+	if err != nil {
+		return err
+	}
+	defer curSor.close()
 
-	idStr := NumberToByte(rowToInsert.Id)
-	leafNodeInsert(curSor, idStr[:], rowToInsert)
-	return EXECUTE_SUCCESS
+	page, err := getPage(table.Pager, curSor.PageTh)
+	if err != nil {
+		return err
+	}
+	if page.leafNodeHasKey(curSor.CellTh, key) {
+		// 主键冲突
+		return ErrDuplicateKey
+	}
+
+	if err := leafNodeInsert(curSor, key, serializeRow(table.schema, rowToInsert)); err != nil {
+		return err
+	}
+	if err := indexesInsert(table, rowToInsert); err != nil {
+		return err
+	}
+	if table.sequence != nil {
+		if err := sequenceUpdate(table, rowToInsert.Values[rowIdColumn].(int64)); err != nil {
+			return err
+		}
+	}
+	statement.RowsAffected = 1
+	return nil
 }
 
-func executeSelect(statement *Statement, table *Table) ExecuteResult {
-	row := &Row{}
-	curSor := tableStart(table)
-	for {
-		if curSor.EndOfTable == true {
-			break
+// 没有给出主键时分配的主键: 表中最大的主键加1, AUTOINCREMENT的表还要大于已经分配过的所有主键
+func tableNextRowId(table *Table) (int64, error) {
+	maxId := int64(0)
+	lastKey, err := tableLastKey(table)
+	if err != nil {
+		return 0, err
+	}
+	if lastKey != nil {
+		maxId = integerKeyValue(lastKey)
+	}
+	if table.sequence != nil {
+		seq, err := sequenceGet(table)
+		if err != nil {
+			return 0, err
 		}
-		data := cursorValue(curSor)
-		row = deserializeRow(data, 0)
-		if row != nil {
-			fmt.Println("\n*********************************************")
-			fmt.Println(" th row = ", row)
-			fmt.Println("id = ", row.Id)
-			fmt.Println("UserName = ", string(row.UserName))
-			fmt.Println("Email = ", string(row.Email))
-			fmt.Println("*********************************************\n")
+		maxId = max(maxId, seq)
+	}
+	if maxId == math.MaxInt64 {
+		return 0, ErrTableFull
+	}
+	return maxId + 1, nil
+}
+
+// 删除满足WHERE条件的行: 先按KeyRange和WHERE找出所有的key, 再逐行删除, 删除时不会影响遍历
+func executeDelete(statement *Statement, table *Table) error {
+	keys, err := executeCollectKeys(statement, table)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := tableDeleteRow(table, key); err != nil {
+			return err
+		}
+	}
+	statement.RowsAffected = int64(len(keys))
+	return nil
+}
+
+// 修改满足WHERE条件的行, 与executeDelete相同, 先找出所有的key
+func executeUpdate(statement *Statement, table *Table) error {
+	keys, err := executeCollectKeys(statement, table)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := tableUpdateRow(table, key, statement.Assignments); err != nil {
+			return err
 		}
-		curSor.advance()
 	}
-	return EXECUTE_SUCCESS
+	statement.RowsAffected = int64(len(keys))
+	return nil
 }
 
-func serializeRow(source *Row, page *Page, cellTh uint32) {
-	offset := LEAF_NODE_HEADER_SIZE + cellTh*LEAF_NODE_CELL_SIZE + LEAF_NODE_KEY_SIZE
+// 满足WHERE条件的行在表中的key, 按遍历的顺序
+func executeCollectKeys(statement *Statement, table *Table) ([][]byte, error) {
+	var keys [][]byte
+	err := executeSelect(statement, table, func(row *Row) bool {
+		keys = append(keys, table.schema.rowKey(row))
+		return true
+	})
+	return keys, err
+}
 
-	idStr := NumberToByte(source.Id)
-	copy((*page.data)[offset+ID_OFFSET:], idStr[:])
+// 按主键删除一行, 同时删除索引中的key. 行不存在时返回ErrKeyNotFound
+func tableDeleteRow(table *Table, key []byte) error {
+	curSor, err := tableFind(table, key)
+	if err != nil {
+		return err
+	}
+	defer curSor.close()
 
-	userNameByte := source.UserName
-	userNameLen := len(userNameByte)
-	if uint32(userNameLen) < USERNAME_SIZE {
-		for i := uint32(0); i < USERNAME_SIZE-uint32(userNameLen); i++ {
-			userNameByte = append(userNameByte, uint8(0))
+	page, err := getPage(table.Pager, curSor.PageTh)
+	if err != nil {
+		return err
+	}
+	if !page.leafNodeHasKey(curSor.CellTh, key) {
+		return ErrKeyNotFound
+	}
+
+	if len(table.indexes) == 0 {
+		return leafNodeDelete(curSor)
+	}
+	// 删除之前读取这一行, 用来删除索引中的key
+	row, err := cursorRow(curSor)
+	if err != nil {
+		return err
+	}
+	if err := leafNodeDelete(curSor); err != nil {
+		return err
+	}
+	for _, index := range table.indexes {
+		if err := indexDelete(index, table.schema, row); err != nil {
+			return err
 		}
 	}
-	emailByte := source.Email
-	if uint32(len(emailByte)) < EMAIL_SIZE {
-		for i := uint32(0); i < EMAIL_SIZE-uint32(userNameLen); i++ {
-			emailByte = append(emailByte, uint8(0))
+	return nil
+}
+
+// 原地重写主键对应的行, assignments为列序号 -> 新值. 行不存在时返回ErrKeyNotFound
+func tableUpdateRow(table *Table, key []byte, assignments map[int]any) error {
+	curSor, err := tableFind(table, key)
+	if err != nil {
+		return err
+	}
+	defer curSor.close()
+
+	page, err := getPage(table.Pager, curSor.PageTh)
+	if err != nil {
+		return err
+	}
+	if !page.leafNodeHasKey(curSor.CellTh, key) {
+		return ErrKeyNotFound
+	}
+
+	row, err := cursorRow(curSor)
+	if err != nil {
+		return err
+	}
+	oldRow := &Row{Values: append([]any{}, row.Values...)}
+	for th, value := range assignments {
+		row.Values[th] = value
+	}
+	// 新的行可能更长, 放不下时分割叶子节点
+	if err := leafNodeReplace(curSor, serializeRow(table.schema, row)); err != nil {
+		return err
+	}
+	// 索引的列改变时删除旧的key, 插入新的key
+	for _, index := range table.indexes {
+		if compareValues(oldRow.Values[index.Column], row.Values[index.Column]) == 0 {
+			continue
+		}
+		if err := indexDelete(index, table.schema, oldRow); err != nil {
+			return err
+		}
+		if err := indexInsert(index, table, row); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	copy((*page.data)[offset+USERNAME_OFFSET:], userNameByte)
-	copy((*page.data)[offset+EMAIL_OFFSET:], emailByte)
-	//page.pageLength = offset + ROW_SIZE
+// 按主键顺序遍历满足WHERE条件的行, fn返回false时停止. 有key范围时从下界开始, 超过上界时停止.
+// 范围在索引上时按索引的顺序遍历, 用索引的key中行的key到表中读取对应的行
+func executeSelect(statement *Statement, table *Table, fn func(row *Row) bool) error {
+	keyRange := statement.KeyRange
+	btree := table
+	var low []byte
+	if keyRange != nil {
+		low = keyRange.Low
+		if keyRange.Index != nil {
+			btree = keyRange.Index.btree
+		}
+	}
+	curSor, err := tableSeek(btree, low)
+	if err != nil {
+		return err
+	}
+	defer curSor.close()
+	for !curSor.EndOfTable {
+		var row *Row
+		if keyRange == nil {
+			if row, err = cursorRow(curSor); err != nil {
+				return err
+			}
+		} else {
+			key, err := cursorKey(curSor)
+			if err != nil {
+				return err
+			}
+			if keyRange.High != nil && keyBeyond(key, keyRange.High) {
+				break
+			}
+			if keyRange.Index == nil {
+				row, err = cursorRow(curSor)
+			} else {
+				row, err = indexGetRow(keyRange.Index, table, curSor, key)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if (statement.Where == nil || statement.Where(row)) && !fn(row) {
+			break
+		}
+		if err := curSor.advance(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// 反序列化，将字符串变成数据
-func deserializeRow(source []byte, offset uint32) *Row {
-	idStr := source[offset+ID_OFFSET : offset+ID_OFFSET+ID_SIZE]
-	idInt := ByteToNumber(idStr[0:4])
+// 索引光标当前的key对应的表中的行
+func indexGetRow(index *Index, table *Table, curSor *Cursor, key []byte) (*Row, error) {
+	rowKey, _, ok := indexRowKey(key)
+	if !ok {
+		return nil, corruptPageError(curSor.PageTh, fmt.Sprintf("index %s: invalid key in cell %d", index.Name, curSor.CellTh))
+	}
+	row, err := tableGetRow(table, rowKey)
+	if err != nil {
+		return nil, err
+	}
+	if row == nil {
+		return nil, corruptPageError(curSor.PageTh, fmt.Sprintf("index %s: no row for cell %d", index.Name, curSor.CellTh))
+	}
+	return row, nil
+}
 
-	destination := &Row{}
-	destination.Id = idInt
-	destination.UserName = source[offset+USERNAME_OFFSET : offset+USERNAME_OFFSET+USERNAME_SIZE]
-	destination.Email = source[offset+EMAIL_OFFSET : offset+EMAIL_OFFSET+EMAIL_SIZE]
-	return destination
+// 按主键读取一行, 不存在时返回nil
+func tableGetRow(table *Table, key []byte) (*Row, error) {
+	curSor, err := tableFind(table, key)
+	if err != nil {
+		return nil, err
+	}
+	defer curSor.close()
+	page, err := getPage(table.Pager, curSor.PageTh)
+	if err != nil {
+		return nil, err
+	}
+	if !page.leafNodeHasKey(curSor.CellTh, key) {
+		return nil, nil
+	}
+	return cursorRow(curSor)
 }
 
 const (
 	PAGE_SIZE       = uint32(4096)
-	TABLE_MAX_PAGES = uint32(100)
-	ROWS_PER_PAGE   = PAGE_SIZE / ROW_SIZE
-	TABLE_MAX_ROWS  = ROWS_PER_PAGE * TABLE_MAX_PAGES
+	TABLE_MAX_PAGES = uint32(math.MaxUint32) // 页面序号为uint32, 文件大小只受磁盘限制
+
+	PAGER_MAX_CACHED_PAGES = uint32(1024) // buffer pool默认最多缓存的页面数, 可以通过.cache_size修改
 )
 
-func cursorValue(curSor *Cursor) []byte {
+// 光标当前行的key(副本)
+func cursorKey(curSor *Cursor) ([]byte, error) {
 	page, err := getPage(curSor.Table.Pager, curSor.PageTh)
 	if err != nil {
-		fmt.Println("cursorValue.getPage failed , err = ", err)
-		os.Exit(1)
+		return nil, err
 	}
-	value := page.LeafNodeGetValue(curSor.CellTh)
+	return append([]byte{}, page.LeafNodeGetKey(curSor.CellTh)...), nil
+}
 
-	return value
+func cursorValue(curSor *Cursor) ([]byte, error) {
+	page, err := getPage(curSor.Table.Pager, curSor.PageTh)
+	if err != nil {
+		return nil, err
+	}
+	// payload较长时需要读取溢出页面
+	return leafCellPayload(curSor.Table.Pager, page.LeafNodeGetCell(curSor.CellTh))
 }
 
-func pagerOpen(fileName string) *Pager {
-	exPath, _ := os.Getwd()
-	filePath := exPath + "/" + fileName
+// 按表结构反序列化光标当前行, 返回的行不引用页面
+func cursorRow(curSor *Cursor) (*Row, error) {
+	value, err := cursorValue(curSor)
+	if err != nil {
+		return nil, err
+	}
+	row, err := deserializeRow(curSor.Table.schema, value)
+	if err != nil {
+		return nil, corruptPageError(curSor.PageTh, fmt.Sprintf("cell %d: %s", curSor.CellTh, err.Error()))
+	}
+	return row, nil
+}
+
+func pagerOpen(filePath string, journalMode JournalMode) (*Pager, error) {
 	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0666) //0666表示：创建了一个普通文件，所有人拥有对该文件的读、写权限，但是都不可执行
 	if err != nil {
-		fmt.Println("Unable to open file")
-		os.Exit(0)
+		return nil, ioError("open database file", err)
 	}
 	fileLength, err := file.Seek(0, io.SeekEnd)
 	if err != nil {
-		fmt.Println("file.Seek error, err=", err)
-		os.Exit(0)
+		_ = file.Close()
+		return nil, ioError("seek database file", err)
 	}
 
 	pager := &Pager{
 		fileDescriptor: file,
-		fileLength:     uint32(fileLength),
-		pagesCount:     uint32(fileLength) / PAGE_SIZE,
+		fileLength:     fileLength,
+		pagesCount:     uint32(fileLength / int64(PAGE_SIZE)),
+		Pages:          make(map[uint32]*Page),
+		lru:            list.New(),
+		maxCachedPages: PAGER_MAX_CACHED_PAGES,
+		journalMode:    journalMode,
+		journal:        newJournal(filePath + "-journal"),
+		spill:          newSavepointSpill(filePath + "-savepoint"),
 	}
+	if err := pagerRecover(pager, filePath); err != nil {
+		if pager.wal != nil {
+			_ = pager.wal.fileDescriptor.Close()
+		}
+		_ = file.Close()
+		return nil, err
+	}
+	return pager, nil
+}
 
-	return pager
+// 上次没有正常关闭: 用hot journal回滚未完成的事务, 重放WAL中已提交的帧.
+// 之后检查文件头, 已有的文件必须以合法的文件头开始, 页面总数以文件头记录的为准
+func pagerRecover(pager *Pager, filePath string) error {
+	if err := journalRecover(pager, filePath+"-journal"); err != nil {
+		return err
+	}
+	wal, err := walOpen(filePath + "-wal")
+	if err != nil {
+		return err
+	}
+	pager.wal = wal
+	if err := walCheckpoint(pager); err != nil {
+		return err
+	}
+	if pager.journalMode == JOURNAL_MODE_ROLLBACK {
+		if err := walClose(pager.wal); err != nil {
+			return err
+		}
+		pager.wal = nil
+	}
+
+	pager.pagesCount = uint32(pager.fileLength / int64(PAGE_SIZE))
+	if pager.fileLength > 0 {
+		header, err := getPage(pager, HEADER_PAGE_TH)
+		if err != nil {
+			return err
+		}
+		if err := header.validateHeader(); err != nil {
+			return fmt.Errorf("%w: %w", ErrCorruptPage, err)
+		}
+		pager.pagesCount = header.HeaderGetPagesCount()
+	}
+	return nil
+}
+
+func dbOpen(filePath string, journalMode JournalMode) (*Database, error) {
+	pager, err := pagerOpen(filePath, journalMode)
+	if err != nil {
+		return nil, err
+	}
+	database, err := dbInitialize(pager)
+	if err != nil {
+		_ = dbClose(&Database{Pager: pager})
+		return nil, err
+	}
+	return database, nil
 }
 
-func dbOpen(fileName string) *Table {
-	pager := pagerOpen(fileName)
+// 新文件写入文件头和空的系统表, 然后读取系统表中所有的表
+func dbInitialize(pager *Pager) (*Database, error) {
 	if pager.pagesCount == 0 {
-		rooPage, err := getPage(pager, 0)
+		header, err := getPage(pager, HEADER_PAGE_TH)
+		if err != nil {
+			return nil, err
+		}
+		header.initializeHeader()
+
+		rooPage, err := getPage(pager, ROOT_PAGE_TH)
 		if err != nil {
-			PrintError(fmt.Sprintf("dbOpen failed, err = %s", err.Error()))
-			os.Exit(0)
+			return nil, err
 		}
 		rooPage.initializeLeafNode()
 		setNodeRoot(rooPage, true)
+		// 新文件的文件头和根节点不能被之后的ROLLBACK丢弃
+		if err := pagerCommit(pager); err != nil {
+			return nil, err
+		}
 	}
 
-	return &Table{
-		rootPageCTh: 0,
-		Pager:       pager,
+	header, err := getPage(pager, HEADER_PAGE_TH)
+	if err != nil {
+		return nil, err
+	}
+	database := &Database{
+		Pager:   pager,
+		catalog: &Table{rootPageCTh: header.HeaderGetRootPage(), Pager: pager, schema: catalogSchema},
 	}
+	if err := catalogLoad(database); err != nil {
+		return nil, err
+	}
+	return database, nil
 }
 
-func pagerFlush(pager *Pager, pageTh uint32) {
-	if pager.Pages[pageTh] == nil {
-		fmt.Println("Tried to flush null page")
-		os.Exit(0)
+// 换出dirty页面. WAL模式下作为未提交的帧写入WAL, 提交之前数据库文件不会被修改;
+// 回滚日志模式下先把原始内容保存到journal, 再写数据库文件
+func pagerFlush(pager *Pager, pageTh uint32) error {
+	page := pager.Pages[pageTh]
+	if page == nil {
+		return fmt.Errorf("%w: flush page %d not in cache", ErrPageOutOfRange, pageTh)
 	}
 
-	_, err := pager.fileDescriptor.Seek(0, io.SeekCurrent)
-	if err != nil {
-		fmt.Println("pager fileDescriptor Seek failed, err = ", err)
-		os.Exit(0)
+	if pager.journalMode == JOURNAL_MODE_WAL {
+		if err := walAppendFrame(pager.wal, pageTh, *page.data, 0); err != nil {
+			return err
+		}
+	} else {
+		if err := journalSavePages(pager, []*Page{page}); err != nil {
+			return err
+		}
+		if err := pagerWrite(pager, pageTh, *page.data); err != nil {
+			return err
+		}
 	}
+	page.dirty = false
+	return nil
+}
 
+// 将页面内容写入数据库文件对应的位置
+func pagerWrite(pager *Pager, pageTh uint32, data []byte) error {
 	// 截断
-	data := (*pager.Pages[pageTh].data)[:PAGE_SIZE]
-	_, err = pager.fileDescriptor.Write(data)
+	data = data[:PAGE_SIZE]
+	offset := int64(pageTh) * int64(PAGE_SIZE)
+	_, err := pager.fileDescriptor.WriteAt(data, offset)
 	if err != nil {
-		fmt.Println("pager fileDescriptor Write failed, err = ", err)
-		os.Exit(0)
+		return ioError(fmt.Sprintf("write page %d", pageTh), err)
+	}
+	if offset+int64(PAGE_SIZE) > pager.fileLength {
+		pager.fileLength = offset + int64(PAGE_SIZE)
 	}
-	fileLength, err := pager.fileDescriptor.Seek(0, io.SeekEnd)
-	fmt.Println("len = ", fileLength)
+	return nil
 }
 
-func dbClose(table *Table) {
-	pager := table.Pager
-	for i := uint32(0); i <= pager.pagesCount; i++ {
-		if pager.Pages[i] == nil {
-			continue
+// 提交: WAL模式下所有dirty页面写入WAL, 最后一帧带有提交标记, WAL过大时顺便checkpoint;
+// 回滚日志模式下所有dirty页面写入数据库文件并fsync, 然后删除journal
+func pagerCommit(pager *Pager) error {
+	header, err := getPage(pager, HEADER_PAGE_TH)
+	if err != nil {
+		return err
+	}
+	if header.HeaderGetPagesCount() != pager.pagesCount {
+		header.HeaderSetPagesCount(pager.pagesCount)
+	}
+
+	var dirtyPages []*Page
+	for _, page := range pager.Pages {
+		if page.dirty {
+			dirtyPages = append(dirtyPages, page)
 		}
-		pagerFlush(table.Pager, i)
 	}
-	_ = table.Pager.fileDescriptor.Close()
+	if pager.journalMode == JOURNAL_MODE_ROLLBACK {
+		if len(dirtyPages) == 0 && pager.journal.fileDescriptor == nil {
+			return nil
+		}
+		if err := journalSavePages(pager, dirtyPages); err != nil {
+			return err
+		}
+		for _, page := range dirtyPages {
+			if err := pagerWrite(pager, page.pageTh, *page.data); err != nil {
+				return err
+			}
+			page.dirty = false
+		}
+		if err := pager.fileDescriptor.Sync(); err != nil {
+			return ioError("sync database file", err)
+		}
+		return journalCommit(pager)
+	}
+
+	if len(dirtyPages) == 0 {
+		if len(pager.wal.pending) == 0 {
+			return nil
+		}
+		// 修改过的页面都已经被换出到WAL中了, 提交标记写在文件头这一帧上
+		dirtyPages = append(dirtyPages, header)
+	}
+	sort.Slice(dirtyPages, func(i, j int) bool {
+		return dirtyPages[i].pageTh < dirtyPages[j].pageTh
+	})
+
+	for i, page := range dirtyPages {
+		commitPagesCount := uint32(0)
+		if i == len(dirtyPages)-1 {
+			commitPagesCount = pager.pagesCount
+		}
+		if err := walAppendFrame(pager.wal, page.pageTh, *page.data, commitPagesCount); err != nil {
+			return err
+		}
+		page.dirty = false
+	}
+
+	if pager.wal.framesCount >= WAL_AUTOCHECKPOINT_FRAMES {
+		return walCheckpoint(pager)
+	}
+	return nil
+}
+
+// 回滚当前事务. 事务中被换出的页面重新加载后不是dirty的, 但内容同样没有提交,
+// 所以清空整个buffer pool, 之后按需重新从磁盘加载已提交的版本
+func pagerRollback(pager *Pager) error {
+	var err error
+	if pager.journalMode == JOURNAL_MODE_WAL {
+		err = walRollback(pager.wal)
+	} else {
+		err = journalRollback(pager)
+	}
+	pager.Pages = make(map[uint32]*Page)
+	pager.lru.Init()
+	if err != nil {
+		return err
+	}
+
+	header, err := getPage(pager, HEADER_PAGE_TH)
+	if err != nil {
+		return err
+	}
+	pager.pagesCount = header.HeaderGetPagesCount()
+	return nil
+}
+
+// 关闭数据库. 提交或checkpoint失败时保留WAL/journal, 下次打开时恢复
+func dbClose(database *Database) error {
+	pager := database.Pager
+	var err error
+	if pager.inTransaction {
+		// 关闭时还没有COMMIT的事务被回滚
+		err = pagerRollback(pager)
+		pager.inTransaction = false
+		savepointReset(pager)
+	}
+	if err == nil {
+		err = pagerCommit(pager)
+	}
+	if pager.wal != nil {
+		if err == nil {
+			err = walCheckpoint(pager)
+		}
+		if err == nil {
+			err = walClose(pager.wal)
+		} else {
+			_ = pager.wal.fileDescriptor.Close()
+		}
+	}
+	if closeErr := pager.fileDescriptor.Close(); closeErr != nil && err == nil {
+		err = ioError("close database file", closeErr)
+	}
+	return err
 }
 
 // 创建一个位于table开始位置的光标
-func tableStart(table *Table) *Cursor {
-	cursor := tableFind(table, 0) // 先找到一个最小的叶子节点
+func tableStart(table *Table) (*Cursor, error) {
+	return tableSeek(table, nil) // 最小的叶子节点
+}
+
+// 表中最大的key, 表为空时返回nil
+func tableLastKey(table *Table) ([]byte, error) {
+	root, err := getNode(table.Pager, table.rootPageCTh)
+	if err != nil {
+		return nil, err
+	}
+	if getNodeType(root) == NODE_LEAF && root.LeafNodeGetCellsCount() == 0 {
+		return nil, nil
+	}
+	return getNodeMaxKey(table.Pager, root)
+}
+
+// 光标指向第一个key大于等于key的行, 没有这样的行时EndOfTable
+func tableSeek(table *Table, key []byte) (*Cursor, error) {
+	cursor, err := tableFind(table, key)
+	if err != nil {
+		return nil, err
+	}
 
 	node, err := getPage(table.Pager, cursor.PageTh)
 	if err != nil {
-		PrintError("tableStart.get 0 Page failed")
-		return nil
+		cursor.close()
+		return nil, err
 	}
 	cellCount := node.LeafNodeGetCellsCount()
-	cursor.EndOfTable = cellCount == 0
-
-	return cursor
+	if cellCount == 0 {
+		cursor.EndOfTable = true
+		return cursor, nil
+	}
+	if cursor.CellTh >= cellCount {
+		// key大于这个叶子节点中所有的key, 从下一个叶子节点开始
+		cursor.CellTh = cellCount - 1
+		if err := cursor.advance(); err != nil {
+			cursor.close()
+			return nil, err
+		}
+	}
+	return cursor, nil
 }
 
 // 创建一个指向特定位置的光标
-func tableFind(table *Table, key uint32) *Cursor {
-	rootPage, err := getPage(table.Pager, table.rootPageCTh)
+func tableFind(table *Table, key []byte) (*Cursor, error) {
+	rootPage, err := getNode(table.Pager, table.rootPageCTh)
 	if err != nil {
-		os.Exit(0)
+		return nil, err
 	}
 	nodeType := getNodeType(rootPage)
 	if nodeType == NODE_LEAF { // 如果是叶子节点对应的page，那么找一个特定的cell
@@ -287,36 +812,37 @@ func tableFind(table *Table, key uint32) *Cursor {
 	return InternalNodeFind(table, table.rootPageCTh, key)
 }
 
-func leafNodeFind(table *Table, pageTh uint32, key uint32) *Cursor {
-	node, err := getPage(table.Pager, pageTh)
+func leafNodeFind(table *Table, pageTh uint32, key []byte) (*Cursor, error) {
+	node, err := getNode(table.Pager, pageTh)
 	if err != nil {
-		os.Exit(0)
+		return nil, err
 	}
 	cellCount := node.LeafNodeGetCellsCount()
 
 	cursor := &Cursor{}
 	cursor.Table = table
 	cursor.PageTh = uint32(pageTh)
+	node.pin() // 光标指向的页面在光标关闭前不能被换出
 
 	// 二分
 	lIndex := uint32(0)
 	rIndex := cellCount
 	for lIndex < rIndex {
 		mid := (lIndex + rIndex) / 2
-		keyAtMid := node.LeafNodeGetKey(mid)
-		if keyAtMid == key {
-			cursor.PageTh = mid
-			return cursor
+		compare := bytes.Compare(node.LeafNodeGetKey(mid), key)
+		if compare == 0 {
+			cursor.CellTh = mid
+			return cursor, nil
 		}
 
-		if keyAtMid > key {
+		if compare > 0 {
 			rIndex = mid
 		} else {
 			lIndex = mid + 1
 		}
 	}
 	cursor.CellTh = lIndex
-	return cursor
+	return cursor, nil
 }
 
 // 输出B+树详情
@@ -0,0 +1,276 @@
+package renekton
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"os"
+)
+
+/*
+预写日志(WAL):
+修改过的页面以帧(frame)的形式追加到 <数据库文件>-wal 中, 提交时最后一帧带有提交标记并fsync, 之后修改才算持久化.
+读取页面时先查WAL再查数据库文件; checkpoint把WAL中已提交的页面写回数据库文件并清空WAL;
+打开数据库时重放WAL中已提交的帧, 最后一个提交标记之后的帧(崩溃时未完成的事务)被丢弃.
+*/
+
+const (
+	WAL_MAGIC   = "rnktwal\x00"
+	WAL_VERSION = uint32(1)
+
+	/*
+	 * WAL Header Layout
+	 */
+	WAL_HEADER_MAGIC_SIZE   = uint32(len(WAL_MAGIC))
+	WAL_HEADER_MAGIC_OFFSET = uint32(0)
+
+	WAL_HEADER_VERSION_SIZE   = uint32(4)
+	WAL_HEADER_VERSION_OFFSET = WAL_HEADER_MAGIC_OFFSET + WAL_HEADER_MAGIC_SIZE
+
+	WAL_HEADER_PAGE_SIZE_SIZE   = uint32(4)
+	WAL_HEADER_PAGE_SIZE_OFFSET = WAL_HEADER_VERSION_OFFSET + WAL_HEADER_VERSION_SIZE
+
+	WAL_HEADER_SALT_SIZE   = uint32(4) // 每次清空WAL时重新生成, 用来识别上一轮残留的帧
+	WAL_HEADER_SALT_OFFSET = WAL_HEADER_PAGE_SIZE_OFFSET + WAL_HEADER_PAGE_SIZE_SIZE
+
+	WAL_HEADER_SIZE = WAL_HEADER_SALT_OFFSET + WAL_HEADER_SALT_SIZE
+
+	/*
+	 * Frame Header Layout
+	 */
+	WAL_FRAME_PAGE_TH_SIZE   = uint32(4)
+	WAL_FRAME_PAGE_TH_OFFSET = uint32(0)
+
+	WAL_FRAME_COMMIT_SIZE   = uint32(4) // 提交帧记录提交之后的页面总数, 其他帧为0
+	WAL_FRAME_COMMIT_OFFSET = WAL_FRAME_PAGE_TH_OFFSET + WAL_FRAME_PAGE_TH_SIZE
+
+	WAL_FRAME_SALT_SIZE   = uint32(4)
+	WAL_FRAME_SALT_OFFSET = WAL_FRAME_COMMIT_OFFSET + WAL_FRAME_COMMIT_SIZE
+
+	WAL_FRAME_CHECKSUM_SIZE   = uint32(4) // 帧头(不含checksum)+页面数据的crc32
+	WAL_FRAME_CHECKSUM_OFFSET = WAL_FRAME_SALT_OFFSET + WAL_FRAME_SALT_SIZE
+
+	WAL_FRAME_HEADER_SIZE = WAL_FRAME_CHECKSUM_OFFSET + WAL_FRAME_CHECKSUM_SIZE
+	WAL_FRAME_SIZE        = WAL_FRAME_HEADER_SIZE + PAGE_SIZE
+
+	WAL_AUTOCHECKPOINT_FRAMES = uint32(1000) // 提交之后WAL超过这么多帧就自动checkpoint
+)
+
+type Wal struct {
+	fileDescriptor *os.File
+	salt           uint32
+	framesCount    uint32
+	committedSize  int64            // 最后一个提交帧结束的位置
+	index          map[uint32]int64 // 已提交的页面 -> 最新一帧页面数据在WAL中的偏移
+	pending        map[uint32]int64 // 当前事务中被换出的(未提交)页面
+}
+
+// 打开WAL文件, 读出其中已经提交的帧
+func walOpen(filePath string) (*Wal, error) {
+	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, ioError("open wal file", err)
+	}
+	wal := &Wal{
+		fileDescriptor: file,
+		index:          make(map[uint32]int64),
+		pending:        make(map[uint32]int64),
+	}
+	if err := walRecover(wal); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return wal, nil
+}
+
+// 清空WAL, 写入新的WAL头
+func walReset(wal *Wal) error {
+	wal.salt = rand.Uint32()
+	wal.framesCount = 0
+	wal.committedSize = int64(WAL_HEADER_SIZE)
+	wal.index = make(map[uint32]int64)
+	wal.pending = make(map[uint32]int64)
+
+	header := make([]byte, WAL_HEADER_SIZE)
+	copy(header[WAL_HEADER_MAGIC_OFFSET:], WAL_MAGIC)
+	putNumber(header[WAL_HEADER_VERSION_OFFSET:], WAL_VERSION)
+	putNumber(header[WAL_HEADER_PAGE_SIZE_OFFSET:], PAGE_SIZE)
+	putNumber(header[WAL_HEADER_SALT_OFFSET:], wal.salt)
+
+	err := wal.fileDescriptor.Truncate(0)
+	if err == nil {
+		_, err = wal.fileDescriptor.WriteAt(header, 0)
+	}
+	if err == nil {
+		err = wal.fileDescriptor.Sync()
+	}
+	if err != nil {
+		return ioError("reset wal", err)
+	}
+	return nil
+}
+
+// 从头扫描WAL: 帧的salt和checksum都正确才有效, 遇到提交帧时之前的帧才算提交. 最后一个提交帧之后的内容被截断
+func walRecover(wal *Wal) error {
+	header := make([]byte, WAL_HEADER_SIZE)
+	_, err := wal.fileDescriptor.ReadAt(header, 0)
+	if err != nil ||
+		!bytes.Equal(header[WAL_HEADER_MAGIC_OFFSET:WAL_HEADER_MAGIC_OFFSET+WAL_HEADER_MAGIC_SIZE], []byte(WAL_MAGIC)) ||
+		ByteToNumber(header[WAL_HEADER_VERSION_OFFSET:]) != WAL_VERSION ||
+		ByteToNumber(header[WAL_HEADER_PAGE_SIZE_OFFSET:]) != PAGE_SIZE {
+		// 没有WAL或者WAL头不完整, 其中不可能有已提交的帧
+		return walReset(wal)
+	}
+	wal.salt = ByteToNumber(header[WAL_HEADER_SALT_OFFSET:])
+	wal.committedSize = int64(WAL_HEADER_SIZE)
+
+	frame := make([]byte, WAL_FRAME_SIZE)
+	uncommitted := make(map[uint32]int64)
+	uncommittedFrames := uint32(0)
+	for offset := int64(WAL_HEADER_SIZE); ; offset += int64(WAL_FRAME_SIZE) {
+		_, err := wal.fileDescriptor.ReadAt(frame, offset)
+		if err != nil {
+			break
+		}
+		if ByteToNumber(frame[WAL_FRAME_SALT_OFFSET:]) != wal.salt ||
+			ByteToNumber(frame[WAL_FRAME_CHECKSUM_OFFSET:]) != walFrameChecksum(frame) {
+			break
+		}
+		pageTh := ByteToNumber(frame[WAL_FRAME_PAGE_TH_OFFSET:])
+		uncommitted[pageTh] = offset + int64(WAL_FRAME_HEADER_SIZE)
+		uncommittedFrames++
+
+		if ByteToNumber(frame[WAL_FRAME_COMMIT_OFFSET:]) != 0 {
+			for committedPageTh, dataOffset := range uncommitted {
+				wal.index[committedPageTh] = dataOffset
+			}
+			wal.framesCount += uncommittedFrames
+			wal.committedSize = offset + int64(WAL_FRAME_SIZE)
+			uncommitted = make(map[uint32]int64)
+			uncommittedFrames = 0
+		}
+	}
+
+	if err := wal.fileDescriptor.Truncate(wal.committedSize); err != nil {
+		return ioError("truncate wal", err)
+	}
+	return nil
+}
+
+func walFrameChecksum(frame []byte) uint32 {
+	checksum := crc32.NewIEEE()
+	checksum.Write(frame[:WAL_FRAME_CHECKSUM_OFFSET])
+	checksum.Write(frame[WAL_FRAME_HEADER_SIZE:WAL_FRAME_SIZE])
+	return checksum.Sum32()
+}
+
+// 页面在WAL中的最新版本: 先查本事务未提交的帧, 再查已提交的帧. 回滚日志模式下没有WAL
+func walFindPage(wal *Wal, pageTh uint32) (int64, bool) {
+	if wal == nil {
+		return 0, false
+	}
+	if offset, ok := wal.pending[pageTh]; ok {
+		return offset, true
+	}
+	offset, ok := wal.index[pageTh]
+	return offset, ok
+}
+
+func walReadPage(wal *Wal, offset int64, data []byte) error {
+	_, err := wal.fileDescriptor.ReadAt(data[:PAGE_SIZE], offset)
+	if err != nil {
+		return ioError(fmt.Sprintf("read wal frame at %d", offset), err)
+	}
+	return nil
+}
+
+// 在WAL末尾追加一帧, commitPagesCount不为0表示这是提交帧.
+// 写入或fsync失败时截断写了一半的帧, 之前追加的未提交帧仍然有效
+func walAppendFrame(wal *Wal, pageTh uint32, data []byte, commitPagesCount uint32) error {
+	frame := make([]byte, WAL_FRAME_SIZE)
+	putNumber(frame[WAL_FRAME_PAGE_TH_OFFSET:], pageTh)
+	putNumber(frame[WAL_FRAME_COMMIT_OFFSET:], commitPagesCount)
+	putNumber(frame[WAL_FRAME_SALT_OFFSET:], wal.salt)
+	copy(frame[WAL_FRAME_HEADER_SIZE:], data[:PAGE_SIZE])
+	putNumber(frame[WAL_FRAME_CHECKSUM_OFFSET:], walFrameChecksum(frame))
+
+	offset, err := wal.fileDescriptor.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = wal.fileDescriptor.WriteAt(frame, offset)
+	}
+	if err == nil && commitPagesCount != 0 {
+		err = wal.fileDescriptor.Sync()
+	}
+	if err != nil {
+		if offset > 0 {
+			_ = wal.fileDescriptor.Truncate(offset)
+		}
+		return ioError(fmt.Sprintf("append wal frame for page %d", pageTh), err)
+	}
+	wal.framesCount++
+	wal.pending[pageTh] = offset + int64(WAL_FRAME_HEADER_SIZE)
+
+	if commitPagesCount != 0 {
+		for committedPageTh, dataOffset := range wal.pending {
+			wal.index[committedPageTh] = dataOffset
+		}
+		wal.pending = make(map[uint32]int64)
+		wal.committedSize = offset + int64(WAL_FRAME_SIZE)
+	}
+	return nil
+}
+
+// 丢弃当前事务换出到WAL中的未提交帧
+func walRollback(wal *Wal) error {
+	if len(wal.pending) == 0 {
+		return nil
+	}
+	// 截断失败也不影响正确性: 残留的帧在提交标记之后, 恢复时会被丢弃
+	wal.framesCount = uint32((wal.committedSize - int64(WAL_HEADER_SIZE)) / int64(WAL_FRAME_SIZE))
+	wal.pending = make(map[uint32]int64)
+	if err := wal.fileDescriptor.Truncate(wal.committedSize); err != nil {
+		return ioError("truncate wal", err)
+	}
+	return nil
+}
+
+// 把WAL中已提交的页面写回数据库文件, fsync之后清空WAL. 只能在没有未提交的帧时调用
+// 中途失败时WAL保持原样, 之后可以重新checkpoint
+func walCheckpoint(pager *Pager) error {
+	wal := pager.wal
+	if len(wal.index) == 0 {
+		return nil
+	}
+	data := make([]byte, PAGE_SIZE)
+	for pageTh, offset := range wal.index {
+		if err := walReadPage(wal, offset, data); err != nil {
+			return err
+		}
+		if err := pagerWrite(pager, pageTh, data); err != nil {
+			return err
+		}
+	}
+	if err := pager.fileDescriptor.Sync(); err != nil {
+		return ioError("sync database file", err)
+	}
+	return walReset(wal)
+}
+
+// 正常关闭时WAL已经checkpoint, 不再需要WAL文件
+func walClose(wal *Wal) error {
+	filePath := wal.fileDescriptor.Name()
+	if err := wal.fileDescriptor.Close(); err != nil {
+		return ioError("close wal file", err)
+	}
+	if err := os.Remove(filePath); err != nil {
+		return ioError("remove wal file", err)
+	}
+	return nil
+}
+
+func putNumber(destination []byte, n uint32) {
+	nByte := NumberToByte(n)
+	copy(destination, nByte[:])
+}
@@ -0,0 +1,465 @@
+package renekton
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+WHERE条件: 编译时检查列名和类型, 生成对反序列化之后的行求值的函数, 与NULL有关的运算使用三值逻辑.
+AND连接的主键第一列或者索引列上的比较条件同时用来确定key的范围, 查询时从范围的下界开始seek, 超过上界时停止
+*/
+
+type ExprType int
+
+// 前五种与ValueType一一对应, 布尔值只出现在表达式中, 不能保存在列中
+const (
+	EXPR_TYPE_NULL    ExprType = iota // nil, NULL字面量或者绑定的nil
+	EXPR_TYPE_INTEGER                 // int64
+	EXPR_TYPE_REAL                    // float64
+	EXPR_TYPE_TEXT                    // string
+	EXPR_TYPE_BLOB                    // []byte
+	EXPR_TYPE_BOOLEAN                 // bool
+)
+
+func (t ExprType) String() string {
+	if t == EXPR_TYPE_BOOLEAN {
+		return "boolean"
+	}
+	return ValueType(t).String()
+}
+
+// 两种类型的值能否比较: 相同类型, INTEGER和REAL, 或者其中一个是NULL
+func (t ExprType) comparable(other ExprType) bool {
+	numeric := func(t ExprType) bool { return t == EXPR_TYPE_INTEGER || t == EXPR_TYPE_REAL }
+	return t == other || t == EXPR_TYPE_NULL || other == EXPR_TYPE_NULL || numeric(t) && numeric(other)
+}
+
+// 编译之后的表达式, eval的结果类型为typ, 任何类型的结果都可能是nil(NULL).
+// 布尔表达式使用三值逻辑, nil表示未知: 与NULL比较的结果未知, 未知的NOT仍然未知,
+// AND中有false时为false, OR中有true时为true, 否则有未知时为未知
+type compiledExpr struct {
+	typ  ExprType
+	eval func(row *Row) any
+}
+
+// 表或者索引的key范围: 从Low开始seek, 超过High时停止(见keyBeyond). Index为nil时为表的key,
+// Low为nil表示从头开始, High为nil表示没有上界
+type KeyRange struct {
+	Index *Index
+	Low   []byte
+	High  []byte
+}
+
+// 编译WHERE条件, 结果必须是布尔值, 只有结果为true的行满足条件
+func (c *Compiler) compileWhere(where Expr) (func(row *Row) bool, error) {
+	expr, err := c.compileBoolean(where)
+	if err != nil {
+		return nil, err
+	}
+	return func(row *Row) bool { return expr.eval(row) == true }, nil
+}
+
+// 布尔表达式, NULL也可以作为未知的布尔值
+func (c *Compiler) compileBoolean(expr Expr) (*compiledExpr, error) {
+	compiled, err := c.compileExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	if compiled.typ != EXPR_TYPE_BOOLEAN && compiled.typ != EXPR_TYPE_NULL {
+		return nil, &SQLError{Err: ErrSyntax, Pos: expr.Position(), Msg: "expected a boolean expression, got " + compiled.typ.String()}
+	}
+	return compiled, nil
+}
+
+func (c *Compiler) compileExpr(expr Expr) (*compiledExpr, error) {
+	switch expr := expr.(type) {
+	case *ColumnRef:
+		th, err := c.column(&Identifier{Name: expr.Name, Pos: expr.Pos})
+		if err != nil {
+			return nil, err
+		}
+		typ := ExprType(c.schema.Columns[th].Type.valueType())
+		return &compiledExpr{typ: typ, eval: func(row *Row) any { return row.Values[th] }}, nil
+
+	case *NullLiteral, *IntegerLiteral, *RealLiteral, *StringLiteral, *BlobLiteral, *Placeholder:
+		value, err := c.value(expr)
+		if err != nil {
+			return nil, err
+		}
+		return &compiledExpr{typ: ExprType(valueType(value)), eval: func(*Row) any { return value }}, nil
+
+	case *UnaryExpr:
+		if expr.Op == "NOT" {
+			operand, err := c.compileBoolean(expr.Operand)
+			if err != nil {
+				return nil, err
+			}
+			return &compiledExpr{typ: EXPR_TYPE_BOOLEAN, eval: func(row *Row) any {
+				if value := operand.eval(row); value != nil {
+					return !value.(bool)
+				}
+				return nil
+			}}, nil
+		}
+		operand, err := c.compileExpr(expr.Operand)
+		if err != nil {
+			return nil, err
+		}
+		if operand.typ != EXPR_TYPE_INTEGER && operand.typ != EXPR_TYPE_REAL && operand.typ != EXPR_TYPE_NULL {
+			return nil, &SQLError{Err: ErrSyntax, Pos: expr.Operand.Position(), Msg: "expected a number, got " + operand.typ.String()}
+		}
+		return &compiledExpr{typ: operand.typ, eval: func(row *Row) any {
+			switch value := operand.eval(row).(type) {
+			case int64:
+				return -value
+			case float64:
+				return -value
+			}
+			return nil
+		}}, nil
+
+	case *BinaryExpr:
+		return c.compileBinary(expr)
+
+	case *IsNullExpr:
+		operand, err := c.compileExpr(expr.Operand)
+		if err != nil {
+			return nil, err
+		}
+		return &compiledExpr{typ: EXPR_TYPE_BOOLEAN, eval: func(row *Row) any { return operand.eval(row) == nil }}, nil
+
+	case *BetweenExpr:
+		operand, err := c.compileComparable(expr.Operand)
+		if err != nil {
+			return nil, err
+		}
+		low, err := c.compileComparableWith(expr.Low, operand.typ)
+		if err != nil {
+			return nil, err
+		}
+		high, err := c.compileComparableWith(expr.High, operand.typ)
+		if err != nil {
+			return nil, err
+		}
+		// 等价于operand >= low AND operand <= high
+		return &compiledExpr{typ: EXPR_TYPE_BOOLEAN, eval: func(row *Row) any {
+			value := operand.eval(row)
+			return and(compare(value, low.eval(row), func(n int) bool { return n >= 0 }),
+				compare(value, high.eval(row), func(n int) bool { return n <= 0 }))
+		}}, nil
+
+	case *InExpr:
+		operand, err := c.compileComparable(expr.Operand)
+		if err != nil {
+			return nil, err
+		}
+		values := make([]*compiledExpr, len(expr.Values))
+		for i, value := range expr.Values {
+			if values[i], err = c.compileComparableWith(value, operand.typ); err != nil {
+				return nil, err
+			}
+		}
+		// 没有相等的值时, 操作数或者候选值中有NULL则结果未知
+		return &compiledExpr{typ: EXPR_TYPE_BOOLEAN, eval: func(row *Row) any {
+			value := operand.eval(row)
+			if value == nil {
+				return nil
+			}
+			var result any = false
+			for _, candidate := range values {
+				candidateValue := candidate.eval(row)
+				if candidateValue == nil {
+					result = nil
+				} else if compareValues(value, candidateValue) == 0 {
+					return true
+				}
+			}
+			return result
+		}}, nil
+	}
+	return nil, &SQLError{Err: ErrSyntax, Pos: expr.Position(), Msg: "unsupported expression"}
+}
+
+func (c *Compiler) compileBinary(expr *BinaryExpr) (*compiledExpr, error) {
+	switch expr.Op {
+	case "AND", "OR":
+		left, err := c.compileBoolean(expr.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := c.compileBoolean(expr.Right)
+		if err != nil {
+			return nil, err
+		}
+		if expr.Op == "AND" {
+			return &compiledExpr{typ: EXPR_TYPE_BOOLEAN, eval: func(row *Row) any { return and(left.eval(row), right.eval(row)) }}, nil
+		}
+		return &compiledExpr{typ: EXPR_TYPE_BOOLEAN, eval: func(row *Row) any { return or(left.eval(row), right.eval(row)) }}, nil
+
+	case "LIKE":
+		left, err := c.compileComparableWith(expr.Left, EXPR_TYPE_TEXT)
+		if err != nil {
+			return nil, err
+		}
+		pattern, err := c.compileComparableWith(expr.Right, EXPR_TYPE_TEXT)
+		if err != nil {
+			return nil, err
+		}
+		return &compiledExpr{typ: EXPR_TYPE_BOOLEAN, eval: func(row *Row) any {
+			patternValue, value := pattern.eval(row), left.eval(row)
+			if patternValue == nil || value == nil {
+				return nil
+			}
+			return like(patternValue.(string), value.(string))
+		}}, nil
+	}
+
+	left, err := c.compileComparable(expr.Left)
+	if err != nil {
+		return nil, err
+	}
+	right, err := c.compileComparableWith(expr.Right, left.typ)
+	if err != nil {
+		return nil, err
+	}
+	var test func(n int) bool
+	switch expr.Op {
+	case "=":
+		test = func(n int) bool { return n == 0 }
+	case "!=":
+		test = func(n int) bool { return n != 0 }
+	case "<":
+		test = func(n int) bool { return n < 0 }
+	case "<=":
+		test = func(n int) bool { return n <= 0 }
+	case ">":
+		test = func(n int) bool { return n > 0 }
+	case ">=":
+		test = func(n int) bool { return n >= 0 }
+	default:
+		return nil, &SQLError{Err: ErrSyntax, Pos: expr.Pos, Near: expr.Op, Msg: "unsupported operator"}
+	}
+	return &compiledExpr{typ: EXPR_TYPE_BOOLEAN, eval: func(row *Row) any {
+		return compare(left.eval(row), right.eval(row), test)
+	}}, nil
+}
+
+// 比较运算的操作数不能是布尔值
+func (c *Compiler) compileComparable(expr Expr) (*compiledExpr, error) {
+	compiled, err := c.compileExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	if compiled.typ == EXPR_TYPE_BOOLEAN {
+		return nil, &SQLError{Err: ErrSyntax, Pos: expr.Position(), Msg: "cannot compare boolean expressions"}
+	}
+	return compiled, nil
+}
+
+// 能和typ类型的值比较的表达式
+func (c *Compiler) compileComparableWith(expr Expr, typ ExprType) (*compiledExpr, error) {
+	compiled, err := c.compileExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	if compiled.typ == EXPR_TYPE_BOOLEAN || !compiled.typ.comparable(typ) {
+		return nil, &SQLError{Err: ErrSyntax, Pos: expr.Position(), Msg: fmt.Sprintf("expected %s, got %s", typ, compiled.typ)}
+	}
+	return compiled, nil
+}
+
+// 比较两个值, 有NULL时结果未知
+func compare(a, b Value, test func(n int) bool) any {
+	if a == nil || b == nil {
+		return nil
+	}
+	return test(compareValues(a, b))
+}
+
+func and(a, b any) any {
+	if a == false || b == false {
+		return false
+	}
+	if a == nil || b == nil {
+		return nil
+	}
+	return true
+}
+
+func or(a, b any) any {
+	if a == true || b == true {
+		return true
+	}
+	if a == nil || b == nil {
+		return nil
+	}
+	return false
+}
+
+// LIKE: %匹配任意个字符, _匹配一个字符, ASCII字母不区分大小写
+func like(pattern, s string) bool {
+	for len(pattern) > 0 {
+		p, size := utf8.DecodeRuneInString(pattern)
+		switch p {
+		case '%':
+			rest := pattern[size:]
+			for i := 0; ; {
+				if like(rest, s[i:]) {
+					return true
+				}
+				if i == len(s) {
+					return false
+				}
+				_, n := utf8.DecodeRuneInString(s[i:])
+				i += n
+			}
+		case '_':
+			if len(s) == 0 {
+				return false
+			}
+			_, n := utf8.DecodeRuneInString(s)
+			s = s[n:]
+		default:
+			if len(s) == 0 {
+				return false
+			}
+			r, n := utf8.DecodeRuneInString(s)
+			if r != p && !(r < utf8.RuneSelf && p < utf8.RuneSelf && strings.EqualFold(string(r), string(p))) {
+				return false
+			}
+			s = s[n:]
+		}
+		pattern = pattern[size:]
+	}
+	return len(s) == 0
+}
+
+// 从AND连接的条件中提取key的范围, 没有可用的条件时返回nil(全表扫描). 依次考虑主键的第一列和各个索引,
+// 优先使用有等值条件的. 只用来缩小扫描的范围, 范围内的行仍然要用完整的WHERE条件过滤
+func (c *Compiler) keyRange(where Expr, indexes []*Index) *KeyRange {
+	var best *KeyRange
+	bestEquality := false
+	candidate := func(index *Index, th int) {
+		low, high, equality, found := c.columnRange(where, th)
+		if index != nil {
+			// 索引中超长的值只保存前缀
+			if low != nil {
+				low = indexValueKey(low)
+			}
+			if high != nil {
+				high = indexValueKey(high)
+			}
+		}
+		if found && (best == nil || equality && !bestEquality) {
+			best, bestEquality = &KeyRange{Index: index, Low: low, High: high}, equality
+		}
+	}
+	candidate(nil, c.schema.PrimaryKey[0])
+	for _, index := range indexes {
+		candidate(index, index.Column)
+	}
+	return best
+}
+
+// 第th列上的比较条件确定的范围. key以列的值开头, 值为v的key都以v的编码为前缀,
+// 所以<和>也使用<=和>=的范围
+func (c *Compiler) columnRange(where Expr, th int) (low, high []byte, equality, found bool) {
+	raiseLow := func(key []byte) {
+		if low == nil || bytes.Compare(key, low) > 0 {
+			low = key
+		}
+	}
+	lowerHigh := func(key []byte) {
+		if high == nil || bytes.Compare(key, high) < 0 {
+			high = key
+		}
+	}
+	for _, expr := range conjuncts(where) {
+		switch expr := expr.(type) {
+		case *IsNullExpr:
+			if !c.isColumn(expr.Operand, th) {
+				continue
+			}
+			key := appendValueKey(nil, nil)
+			raiseLow(key)
+			lowerHigh(key)
+			equality, found = true, true
+		case *BinaryExpr:
+			op, operand := expr.Op, expr.Right
+			if !c.isColumn(expr.Left, th) {
+				// 常量在左边时交换两边
+				op, operand = reverseComparison[op], expr.Left
+				if !c.isColumn(expr.Right, th) {
+					continue
+				}
+			}
+			value, ok := c.columnConstant(operand, th)
+			if !ok {
+				continue
+			}
+			key := appendValueKey(nil, value)
+			switch op {
+			case "=":
+				raiseLow(key)
+				lowerHigh(key)
+				equality = true
+			case "<", "<=":
+				lowerHigh(key)
+			case ">", ">=":
+				raiseLow(key)
+			default:
+				continue
+			}
+			found = true
+		case *BetweenExpr:
+			if !c.isColumn(expr.Operand, th) {
+				continue
+			}
+			lowValue, lowOk := c.columnConstant(expr.Low, th)
+			highValue, highOk := c.columnConstant(expr.High, th)
+			if !lowOk || !highOk {
+				continue
+			}
+			raiseLow(appendValueKey(nil, lowValue))
+			lowerHigh(appendValueKey(nil, highValue))
+			found = true
+		}
+	}
+	return low, high, equality, found
+}
+
+// 展开AND连接的条件
+func conjuncts(where Expr) []Expr {
+	if binary, ok := where.(*BinaryExpr); ok && binary.Op == "AND" {
+		return append(conjuncts(binary.Left), conjuncts(binary.Right)...)
+	}
+	return []Expr{where}
+}
+
+// 交换比较运算两边时对应的运算符
+var reverseComparison = map[string]string{"=": "=", "<": ">", "<=": ">=", ">": "<", ">=": "<="}
+
+func (c *Compiler) isColumn(expr Expr, th int) bool {
+	column, ok := expr.(*ColumnRef)
+	return ok && strings.EqualFold(column.Name, c.schema.Columns[th].Name)
+}
+
+// 与第th列类型相同的字面量或者绑定的值, REAL列的整数转为float64. NULL不在任何比较的范围内, 返回false
+func (c *Compiler) columnConstant(expr Expr, th int) (Value, bool) {
+	switch expr.(type) {
+	case *IntegerLiteral, *RealLiteral, *StringLiteral, *BlobLiteral, *Placeholder:
+		value, err := c.value(expr)
+		if err != nil || value == nil {
+			return nil, false
+		}
+		columnType := c.schema.Columns[th].Type
+		if n, ok := value.(int64); ok && columnType == COLUMN_TYPE_REAL {
+			value = float64(n)
+		}
+		return value, valueType(value) == columnType.valueType()
+	}
+	return nil, false
+}
@@ -0,0 +1,245 @@
+package renekton
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// 查询结果的第一列(主键), 按返回的顺序
+func queryIds(t *testing.T, db *DB, sql string, args ...any) []int64 {
+	t.Helper()
+	result, err := db.Exec(sql, args...)
+	if err != nil {
+		t.Fatalf("%s: %v", sql, err)
+	}
+	ids := []int64{}
+	for _, row := range result.Rows {
+		ids = append(ids, row.Values[0].(int64))
+	}
+	return ids
+}
+
+// WHERE的结果与逐行计算条件相同, 没有索引时按主键顺序
+func TestWhere(t *testing.T) {
+	db, _ := testOpen(t, JOURNAL_MODE_WAL, 0)
+	defer db.Close()
+	if _, err := db.Exec("create table t (id integer primary key, n integer, s text)"); err != nil {
+		t.Fatal(err)
+	}
+	type row struct {
+		id, n int64
+		s     string
+	}
+	var rows []row
+	for id := int64(0); id < 300; id++ {
+		r := row{id, id % 7, fmt.Sprintf("s%03d", id*37%300)}
+		if id%10 == 0 {
+			r.s = strings.ToUpper(r.s)
+		}
+		if err := db.Insert("t", r.id, r.n, r.s); err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, r)
+	}
+
+	tests := []struct {
+		where string
+		args  []any
+		match func(r row) bool
+	}{
+		{"n = 3", nil, func(r row) bool { return r.n == 3 }},
+		{"n != 3 and id < 50", nil, func(r row) bool { return r.n != 3 && r.id < 50 }},
+		{"id >= 100 and id < 120 or n = 0 and id > 290", nil, func(r row) bool { return r.id >= 100 && r.id < 120 || r.n == 0 && r.id > 290 }},
+		{"not (id <= 250) and n <> 1", nil, func(r row) bool { return r.id > 250 && r.n != 1 }},
+		{"150 < id and ? >= id", []any{160}, func(r row) bool { return r.id > 150 && r.id <= 160 }},
+		{"id between 10 and 20 and n between 2 and 4", nil, func(r row) bool { return r.id >= 10 && r.id <= 20 && r.n >= 2 && r.n <= 4 }},
+		{"id not between 5 and 295", nil, func(r row) bool { return r.id < 5 || r.id > 295 }},
+		{"n in (1, ?) and id < 30", []any{5}, func(r row) bool { return (r.n == 1 || r.n == 5) && r.id < 30 }},
+		{"s < 's010'", nil, func(r row) bool { return r.s < "s010" }},
+		{"s like 's1_0'", nil, func(r row) bool { return strings.EqualFold(r.s[:2], "s1") && r.s[3] == '0' }},
+		{"s like 'S%0'", nil, func(r row) bool { return strings.HasSuffix(r.s, "0") }},
+		{"s not like '%1%'", nil, func(r row) bool { return !strings.Contains(r.s, "1") }},
+		{"s is null or n is not null and id = 7", nil, func(r row) bool { return r.id == 7 }},
+		{"id = -1 or id > 1000", nil, func(r row) bool { return false }},
+		{"id > 10 and id < 5", nil, func(r row) bool { return false }},
+		{"-id > -3", nil, func(r row) bool { return r.id < 3 }},
+	}
+	// 建立索引之后按索引的范围查找, 结果按索引的顺序, 排序之后与没有索引时相同
+	for _, indexed := range []bool{false, true} {
+		if indexed {
+			for _, sql := range []string{"create index t_n on t (n)", "create index t_s on t (s)"} {
+				if _, err := db.Exec(sql); err != nil {
+					t.Fatal(err)
+				}
+			}
+			statement := &Statement{}
+			if err := prepareStatement("select id from t where n = 3 and s > 'a'", db.database, statement); err != nil {
+				t.Fatal(err)
+			}
+			if statement.KeyRange == nil || statement.KeyRange.Index == nil {
+				t.Fatal("index not used")
+			}
+		}
+		for _, test := range tests {
+			want := []int64{}
+			for _, r := range rows {
+				if test.match(r) {
+					want = append(want, r.id)
+				}
+			}
+			got := queryIds(t, db, "select id from t where "+test.where, test.args...)
+			if indexed {
+				slices.Sort(got)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("indexed %v: %s: got %v, want %v", indexed, test.where, got, want)
+			}
+		}
+	}
+
+	for _, where := range []string{"n", "s = 1", "n like 'a'", "id + 1", "m = 1"} {
+		if _, err := db.Exec("select * from t where " + where); err == nil {
+			t.Fatalf("%s: no error", where)
+		}
+	}
+}
+
+// 从WHERE中提取主键的范围, 只有AND连接的主键条件缩小范围. 范围是key的前缀, <和>也使用包含边界的范围
+func TestWhereKeyRange(t *testing.T) {
+	db, _ := testOpen(t, JOURNAL_MODE_WAL, 0)
+	defer db.Close()
+	k := func(n int64) []byte { return appendIntegerKey(nil, n) }
+	tests := []struct {
+		where string
+		want  *KeyRange
+	}{
+		{"id = 5", &KeyRange{Low: k(5), High: k(5)}},
+		{"id >= 10 and id < 20", &KeyRange{Low: k(10), High: k(20)}},
+		{"5 < id and email = 'x'", &KeyRange{Low: k(5)}},
+		{"id between 3 and 8 and id > 5", &KeyRange{Low: k(5), High: k(8)}},
+		{"id <= 7 and not id = 3", &KeyRange{High: k(7)}},
+		{"id = 3 or id = 4", nil},
+		{"email = 'x'", nil},
+		{"id > 10 and id < 5", &KeyRange{Low: k(10), High: k(5)}},
+	}
+	for _, test := range tests {
+		statement := &Statement{}
+		if err := prepareStatement("select * from users where "+test.where, db.database, statement); err != nil {
+			t.Fatalf("%s: %v", test.where, err)
+		}
+		if !reflect.DeepEqual(statement.KeyRange, test.want) {
+			t.Fatalf("%s: key range %+v, want %+v", test.where, statement.KeyRange, test.want)
+		}
+	}
+}
+
+// 三值逻辑的真值, 按false < unknown < true排列, AND取较小的, OR取较大的
+type truth int
+
+const (
+	TRUTH_FALSE truth = iota
+	TRUTH_UNKNOWN
+	TRUTH_TRUE
+)
+
+func (v truth) String() string {
+	return [...]string{"false", "unknown", "true"}[v]
+}
+
+func truthOf(b bool) truth {
+	if b {
+		return TRUTH_TRUE
+	}
+	return TRUTH_FALSE
+}
+
+// 与NULL比较的结果未知
+func compareTruth(a, b Value, ok func(n int) bool) truth {
+	if a == nil || b == nil {
+		return TRUTH_UNKNOWN
+	}
+	return truthOf(ok(compareValues(a, b)))
+}
+
+func notTruth(v truth) truth { return TRUTH_TRUE - v }
+
+// 表n中a和b分别取1, 2, NULL, 共9行. 对每个表达式E, WHERE E查询到的行为true,
+// WHERE NOT (E)查询到的行为false, 其余的行为unknown, 与按三值逻辑计算的结果比较
+func TestNullTruthTables(t *testing.T) {
+	db, _ := testOpen(t, JOURNAL_MODE_WAL, 0)
+	defer db.Close()
+	if _, err := db.Exec("create table n (id integer primary key, a integer, b integer)"); err != nil {
+		t.Fatal(err)
+	}
+	values := []Value{int64(1), int64(2), nil}
+	rows := map[int64][2]Value{}
+	for i, a := range values {
+		for j, b := range values {
+			id := int64(i*len(values) + j)
+			rows[id] = [2]Value{a, b}
+			if err := db.Insert("n", id, a, b); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	equal := func(n int) bool { return n == 0 }
+	less := func(n int) bool { return n < 0 }
+	tests := []struct {
+		where string
+		want  func(a, b Value) truth
+	}{
+		{"a = b", func(a, b Value) truth { return compareTruth(a, b, equal) }},
+		{"a != b", func(a, b Value) truth { return notTruth(compareTruth(a, b, equal)) }},
+		{"a < b", func(a, b Value) truth { return compareTruth(a, b, less) }},
+		{"a >= b", func(a, b Value) truth { return notTruth(compareTruth(a, b, less)) }},
+		{"a = NULL", func(a, b Value) truth { return TRUTH_UNKNOWN }},
+		{"NULL = NULL", func(a, b Value) truth { return TRUTH_UNKNOWN }},
+		{"a IS NULL", func(a, b Value) truth { return truthOf(a == nil) }},
+		{"a IS NOT NULL", func(a, b Value) truth { return truthOf(a != nil) }},
+		{"a = 1 AND b = 1", func(a, b Value) truth {
+			return min(compareTruth(a, int64(1), equal), compareTruth(b, int64(1), equal))
+		}},
+		{"a = 1 OR b = 1", func(a, b Value) truth {
+			return max(compareTruth(a, int64(1), equal), compareTruth(b, int64(1), equal))
+		}},
+		{"NOT (a = 1 OR b = 1)", func(a, b Value) truth {
+			return notTruth(max(compareTruth(a, int64(1), equal), compareTruth(b, int64(1), equal)))
+		}},
+		{"a IN (1, NULL)", func(a, b Value) truth {
+			return max(compareTruth(a, int64(1), equal), TRUTH_UNKNOWN)
+		}},
+		{"a NOT IN (2, b)", func(a, b Value) truth {
+			return notTruth(max(compareTruth(a, int64(2), equal), compareTruth(a, b, equal)))
+		}},
+		{"a BETWEEN 1 AND b", func(a, b Value) truth {
+			return min(notTruth(compareTruth(a, int64(1), less)), notTruth(compareTruth(b, a, less)))
+		}},
+	}
+	for _, test := range tests {
+		got := map[int64]truth{}
+		for id := range rows {
+			got[id] = TRUTH_UNKNOWN
+		}
+		for _, query := range []struct {
+			where string
+			value truth
+		}{{test.where, TRUTH_TRUE}, {"NOT (" + test.where + ")", TRUTH_FALSE}} {
+			result, err := db.Exec("select id from n where " + query.where)
+			if err != nil {
+				t.Fatalf("%s: %v", query.where, err)
+			}
+			for _, row := range result.Rows {
+				got[row.Values[0].(int64)] = query.value
+			}
+		}
+		for id, row := range rows {
+			if want := test.want(row[0], row[1]); got[id] != want {
+				t.Errorf("%s with a = %v, b = %v: got %v, want %v", test.where, row[0], row[1], got[id], want)
+			}
+		}
+	}
+}